@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 )
 
 const (
@@ -14,6 +15,7 @@ const (
 	// Radio to server
 
 	AuthenticateType = "authenticate"
+	EnrollType       = "enroll"
 	StatusType       = "status"
 
 	// Server to radio
@@ -21,6 +23,12 @@ const (
 	FilesType     = "files"
 	PlaylistsType = "playlists"
 	StopType      = "stop"
+	TriggerType   = "trigger"
+
+	// Server to radio while enrolling
+
+	PairingCodeType = "pairing_code"
+	EnrolledType    = "enrolled"
 
 	// Status values
 
@@ -39,6 +47,31 @@ type Message struct {
 type AuthenticateMessage struct {
 	T     string
 	Token string
+
+	// Time zone the radio uses to interpret start times, e.g. "Australia/Hobart"
+	TimeZone string
+}
+
+// Initial message from a radio that has no token, asking to be enrolled. The server replies with a
+// PairingCodeMessage, then an EnrolledMessage once an operator has approved the radio.
+type EnrollMessage struct {
+	T string
+
+	// Host name of the device, suggested as the radio's name
+	Hostname string
+}
+
+// Code that the radio shows so an operator can match it up when approving the enrollment.
+type PairingCodeMessage struct {
+	T    string
+	Code string
+}
+
+// The radio has been approved and should authenticate with this token from now on.
+type EnrolledMessage struct {
+	T     string
+	Name  string
+	Token string
 }
 
 // Server updates the radio with the list of files that currently exist.
@@ -47,6 +80,11 @@ type AuthenticateMessage struct {
 type FilesMessage struct {
 	T     string
 	Files []FileSpec
+
+	// Names of files referenced by playlists scheduled within the server's
+	// sync horizon, in the order they will be played. A radio which only syncs
+	// scheduled files should download these and nothing else.
+	Scheduled []string
 }
 
 type PlaylistsMessage struct {
@@ -59,6 +97,13 @@ type StopMessage struct {
 	T string
 }
 
+// The given playlist should be played immediately, regardless of its start time.
+// Ignored if the radio is already playing something.
+type TriggerMessage struct {
+	T        string
+	Playlist PlaylistSpec
+}
+
 type StatusMessage struct {
 	T string
 
@@ -89,6 +134,25 @@ type StatusMessage struct {
 
 	// Time zone in use, e.g. "Australia/Hobart"
 	TimeZone string
+
+	// Pre-flight checks of the soonest upcoming playlists, in order of start time
+	Readiness []PlaylistReadiness
+}
+
+// Whether a radio expects to be able to play an upcoming playlist.
+type PlaylistReadiness struct {
+	// Id of the playlist
+	Id int
+
+	Name string
+
+	// When the playlist will start, interpreted in the radio's time zone, in RFC 3339 format
+	StartTime string
+
+	Ready bool
+
+	// Human-readable reasons why the playlist isn't ready - empty if Ready
+	Problems []string
 }
 
 // Description of an individual file available in the broadcasting system.
@@ -97,6 +161,8 @@ type FileSpec struct {
 	Name string
 	// SHA-256 hash of the file's contents
 	Hash string
+	// Size of the file in bytes
+	Size int64
 }
 
 type PlaylistSpec struct {
@@ -112,6 +178,15 @@ type EntrySpec struct {
 	IsRelative   bool
 }
 
+// Parse a playlist start time, which may or may not include seconds.
+func ParseStartTime(startTime string, loc *time.Location) (time.Time, error) {
+	t, err := time.ParseInLocation(StartTimeFormatSecs, startTime, loc)
+	if err != nil {
+		t, err = time.ParseInLocation(StartTimeFormat, startTime, loc)
+	}
+	return t, err
+}
+
 func ParseMessage(data []byte) (string, interface{}, error) {
 	var t Message
 	err := json.Unmarshal(data, &t)
@@ -128,6 +203,33 @@ func ParseMessage(data []byte) (string, interface{}, error) {
 		return t.T, auth, nil
 	}
 
+	if t.T == EnrollType {
+		var enroll EnrollMessage
+		err = json.Unmarshal(data, &enroll)
+		if err != nil {
+			return "", nil, err
+		}
+		return t.T, enroll, nil
+	}
+
+	if t.T == PairingCodeType {
+		var code PairingCodeMessage
+		err = json.Unmarshal(data, &code)
+		if err != nil {
+			return "", nil, err
+		}
+		return t.T, code, nil
+	}
+
+	if t.T == EnrolledType {
+		var enrolled EnrolledMessage
+		err = json.Unmarshal(data, &enrolled)
+		if err != nil {
+			return "", nil, err
+		}
+		return t.T, enrolled, nil
+	}
+
 	if t.T == FilesType {
 		var files FilesMessage
 		err = json.Unmarshal(data, &files)
@@ -164,5 +266,14 @@ func ParseMessage(data []byte) (string, interface{}, error) {
 		return t.T, stop, nil
 	}
 
+	if t.T == TriggerType {
+		var trigger TriggerMessage
+		err = json.Unmarshal(data, &trigger)
+		if err != nil {
+			return "", nil, err
+		}
+		return t.T, trigger, nil
+	}
+
 	return "", nil, errors.New(fmt.Sprintf("unknown message type %v", t.T))
 }
@@ -1,33 +1,55 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
+const (
+	// Download every file the server has
+	SyncAll = "all"
+	// Download only the files needed by upcoming scheduled playlists
+	SyncScheduled = "scheduled"
+)
+
 type RadioConfig struct {
-	GpioDevice string
-	PTTPin     int
-	COSPin     int
-	ServerURL  string
-	Token      string
-	CachePath  string
-	TimeZone   string
+	GpioDevice      string
+	PTTPin          int
+	COSPin          int
+	ServerURL       string
+	Token           string
+	CertificateFile string
+	KeyFile         string
+	CAFile          string
+	StatePath       string
+	CachePath       string
+	TimeZone        string
+	SyncMode        string
+	CacheQuotaMB    int
 }
 
 func NewRadioConfig() RadioConfig {
 	return RadioConfig{
-		GpioDevice: "gpiochip0",
-		PTTPin:     -1,
-		COSPin:     -1,
-		ServerURL:  "",
-		Token:      "",
-		CachePath:  "",
-		TimeZone:   "Local",
+		GpioDevice:      "gpiochip0",
+		PTTPin:          -1,
+		COSPin:          -1,
+		ServerURL:       "",
+		Token:           "",
+		CertificateFile: "",
+		KeyFile:         "",
+		CAFile:          "",
+		StatePath:       "",
+		CachePath:       "",
+		TimeZone:        "Local",
+		SyncMode:        SyncAll,
+		CacheQuotaMB:    0,
 	}
 }
 
@@ -36,6 +58,15 @@ func (c *RadioConfig) LoadFromFile(path string) {
 	if err != nil {
 		log.Fatal("could not read config file for reading at path:", path, err)
 	}
+	if c.StatePath == "" {
+		c.StatePath = filepath.Dir(path)
+	}
+	if c.Token == "" && c.CertificateFile == "" {
+		c.Token, err = c.LoadToken()
+		if err != nil {
+			log.Fatal("could not read token saved by enrollment: ", err)
+		}
+	}
 	err = c.Validate()
 	if err != nil {
 		log.Fatal(err)
@@ -47,8 +78,14 @@ func (c *RadioConfig) Validate() error {
 	if c.ServerURL == "" {
 		return errors.New("ServerURL must be provided in the configuration")
 	}
-	if c.Token == "" {
-		return errors.New("token must be provided in the configuration")
+	if (c.CertificateFile == "") != (c.KeyFile == "") {
+		return errors.New("CertificateFile and KeyFile must be provided together")
+	}
+	if c.SyncMode != SyncAll && c.SyncMode != SyncScheduled {
+		return errors.New("SyncMode must be \"all\" or \"scheduled\"")
+	}
+	if c.CacheQuotaMB < 0 {
+		return errors.New("CacheQuotaMB cannot be negative")
 	}
 	return nil
 }
@@ -68,3 +105,55 @@ func (c *RadioConfig) WebsocketURL() string {
 	addr = strings.Replace(addr, "http://", "ws://", -1)
 	return addr + "/radio-ws"
 }
+
+// TLS settings for connecting to the server, or nil to use the defaults. A client certificate is presented
+// if one is configured, and the server is trusted if its certificate was issued by CAFile.
+func (c *RadioConfig) TLSConfig() (*tls.Config, error) {
+	if c.CertificateFile == "" && c.CAFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CertificateFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertificateFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CAFile " + c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// Where the token issued when the radio was enrolled is kept, if the config file doesn't have one
+func (c *RadioConfig) TokenPath() string {
+	return filepath.Join(c.StatePath, "radio-token")
+}
+
+// Read the token saved by a previous enrollment, or an empty string if the radio hasn't been enrolled.
+func (c *RadioConfig) LoadToken() (string, error) {
+	b, err := os.ReadFile(c.TokenPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (c *RadioConfig) SaveToken(token string) error {
+	if err := os.MkdirAll(c.StatePath, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.TokenPath(), []byte(token+"\n"), 0600)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+
+	"code.octet-stream.net/broadcaster/internal/protocol"
+)
+
+// Ask the server for a token. The server replies with a pairing code, which an operator enters on the
+// server's Radios page to approve this radio. The token that comes back is saved in the state directory
+// so that the radio doesn't need to be enrolled again.
+func enroll() error {
+	log.Println("No token configured, asking to be enrolled by:", config.WebsocketURL())
+	ws, err := dialServer()
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	hostname, _ := os.Hostname()
+	msg, _ := json.Marshal(protocol.EnrollMessage{
+		T:        protocol.EnrollType,
+		Hostname: hostname,
+	})
+	if _, err := ws.Write(msg); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 16384)
+	for {
+		n, err := ws.Read(buf)
+		if err != nil {
+			return errors.New("server closed the connection before this radio was approved")
+		}
+		t, msg, err := protocol.ParseMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+
+		if t == protocol.PairingCodeType {
+			code := msg.(protocol.PairingCodeMessage).Code
+			log.Println("Waiting for approval. Enter pairing code", code, "on the server's Radios page to enroll this radio")
+		}
+
+		if t == protocol.EnrolledType {
+			enrolled := msg.(protocol.EnrolledMessage)
+			if err := config.SaveToken(enrolled.Token); err != nil {
+				log.Fatal("could not save token: ", err)
+			}
+			config.Token = enrolled.Token
+			log.Println("Enrolled as radio", enrolled.Name+", token saved to", config.TokenPath())
+			return nil
+		}
+	}
+}
@@ -5,33 +5,69 @@ import (
 	"encoding/hex"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 
 	"code.octet-stream.net/broadcaster/internal/protocol"
 )
 
 type FilesMachine struct {
 	specs     []protocol.FileSpec
+	scheduled []string
 	cachePath string
+	syncMode  string
+	quota     int64
 	missing   []string
+	skipped   int // missing files that won't be downloaded because they don't fit in the quota
+	evicted   int // unscheduled cached files deleted to make room for scheduled ones
 }
 
-func NewFilesMachine(cachePath string) FilesMachine {
+func NewFilesMachine(cachePath string, syncMode string, quotaMB int) FilesMachine {
 	if err := os.MkdirAll(cachePath, 0750); err != nil {
 		log.Fatal(err)
 	}
 	return FilesMachine{
 		cachePath: cachePath,
+		syncMode:  syncMode,
+		quota:     int64(quotaMB) * 1024 * 1024,
 	}
 }
 
-func (m *FilesMachine) UpdateSpecs(specs []protocol.FileSpec) {
+func (m *FilesMachine) UpdateSpecs(specs []protocol.FileSpec, scheduled []string) {
 	m.specs = specs
+	m.scheduled = scheduled
 	m.RefreshMissing()
 }
 
+func (m *FilesMachine) spec(name string) (protocol.FileSpec, bool) {
+	for _, spec := range m.specs {
+		if spec.Name == name {
+			return spec, true
+		}
+	}
+	return protocol.FileSpec{}, false
+}
+
+// Files we want in the cache, with those needed by scheduled playlists first in the order they will play.
+func (m *FilesMachine) wanted() []string {
+	wanted := make([]string, 0)
+	for _, name := range m.scheduled {
+		if _, ok := m.spec(name); ok {
+			wanted = append(wanted, name)
+		}
+	}
+	if m.syncMode == SyncAll {
+		for _, spec := range m.specs {
+			if !slices.Contains(wanted, spec.Name) {
+				wanted = append(wanted, spec.Name)
+			}
+		}
+	}
+	return wanted
+}
+
 func (m *FilesMachine) RefreshMissing() {
 	// Delete any files in the cache dir who are not in the spec
 	entries, err := os.ReadDir(m.cachePath)
@@ -60,6 +96,7 @@ func (m *FilesMachine) RefreshMissing() {
 		}
 		hasher := sha256.New()
 		io.Copy(hasher, f)
+		f.Close()
 		if hex.EncodeToString(hasher.Sum(nil)) != hash {
 			log.Println("Deleting cached audio file with incorrect hash:", file.Name())
 			os.Remove(filepath.Join(m.cachePath, file.Name()))
@@ -68,25 +105,82 @@ func (m *FilesMachine) RefreshMissing() {
 		}
 	}
 	m.missing = nil
-	for _, spec := range m.specs {
-		missing := true
-		for _, file := range okay {
-			if spec.Name == file {
-				missing = false
-			}
-		}
-		if missing {
-			m.missing = append(m.missing, spec.Name)
+	for _, name := range m.wanted() {
+		if !slices.Contains(okay, name) {
+			m.missing = append(m.missing, name)
 		}
 	}
+	m.skipped = 0
+	m.evicted = 0
+	if m.quota > 0 {
+		m.applyQuota(okay)
+	}
 	if len(m.missing) > 1 {
 		log.Println(len(m.missing), "missing files")
 	} else if len(m.missing) == 1 {
 		log.Println("1 missing file")
-	} else {
+	} else if m.skipped == 0 {
 		log.Println("All files are in sync with server")
 	}
-	statusCollector.FilesInSync <- len(m.missing) == 0
+	if m.skipped > 0 {
+		log.Println(m.skipped, "files skipped because the cache quota is full")
+	}
+	if m.evicted > 0 {
+		log.Println(m.evicted, "unscheduled files evicted from the cache to make room for scheduled ones")
+	}
+	statusCollector.FilesInSync <- len(m.missing) == 0 && m.skipped == 0
+}
+
+// Limit the missing files to those that will fit within the cache quota.
+// Cached files that aren't needed by a scheduled playlist are evicted, oldest first, to make room for ones that are.
+func (m *FilesMachine) applyQuota(cached []string) {
+	type cachedFile struct {
+		name    string
+		size    int64
+		modTime int64
+	}
+	var used int64
+	evictable := make([]cachedFile, 0)
+	for _, name := range cached {
+		info, err := os.Stat(filepath.Join(m.cachePath, name))
+		if err != nil {
+			continue
+		}
+		used += info.Size()
+		if !slices.Contains(m.scheduled, name) {
+			evictable = append(evictable, cachedFile{name: name, size: info.Size(), modTime: info.ModTime().UnixNano()})
+		}
+	}
+	sort.Slice(evictable, func(i, j int) bool {
+		return evictable[i].modTime < evictable[j].modTime
+	})
+
+	fits := make([]string, 0)
+	for _, name := range m.missing {
+		spec, _ := m.spec(name)
+		var reclaimable int64
+		for _, f := range evictable {
+			reclaimable += f.size
+		}
+		if slices.Contains(m.scheduled, name) && used-reclaimable+spec.Size <= m.quota {
+			for used+spec.Size > m.quota {
+				victim := evictable[0]
+				evictable = evictable[1:]
+				log.Println("Evicting unscheduled cached audio file to stay within quota:", victim.name)
+				os.Remove(filepath.Join(m.cachePath, victim.name))
+				used -= victim.size
+				m.evicted++
+			}
+		}
+		if used+spec.Size > m.quota {
+			log.Println("Not enough cache quota to download", name)
+			m.skipped++
+			continue
+		}
+		used += spec.Size
+		fits = append(fits, name)
+	}
+	m.missing = fits
 }
 
 func (m *FilesMachine) IsCacheComplete() bool {
@@ -107,7 +201,7 @@ func (m *FilesMachine) DownloadSingle(filename string, downloadResult chan<- err
 		return
 	}
 	defer out.Close()
-	resp, err := http.Get(config.ServerURL + "/file-downloads/" + filename)
+	resp, err := httpClient.Get(config.ServerURL + "/file-downloads/" + filename)
 	if err != nil {
 		downloadResult <- err
 		return
@@ -10,11 +10,13 @@ import (
 type PTT interface {
 	EngagePTT()
 	DisengagePTT()
+	Check() error
 }
 
 type COS interface {
 	WaitForChannelClear()
 	COSValue() bool
+	Check() error
 }
 
 var ptt PTT = &DefaultPTT{}
@@ -78,6 +80,11 @@ func (g *PiCOS) COSValue() bool {
 	return val != 0
 }
 
+func (g *PiCOS) Check() error {
+	_, err := g.cosLine.Value()
+	return err
+}
+
 func (g *PiCOS) WaitForChannelClear() {
 	ch := g.clearWait
 	val, err := g.cosLine.Value()
@@ -100,6 +107,11 @@ func (g *PiPTT) DisengagePTT() {
 	statusCollector.PTT <- false
 }
 
+func (g *PiPTT) Check() error {
+	_, err := g.pttLine.Value()
+	return err
+}
+
 type DefaultPTT struct {
 }
 
@@ -111,6 +123,10 @@ func (g *DefaultPTT) DisengagePTT() {
 	statusCollector.PTT <- false
 }
 
+func (g *DefaultPTT) Check() error {
+	return nil
+}
+
 type DefaultCOS struct {
 }
 
@@ -121,3 +137,7 @@ func (g *DefaultCOS) WaitForChannelClear() {
 func (g *DefaultCOS) COSValue() bool {
 	return false
 }
+
+func (g *DefaultCOS) Check() error {
+	return nil
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -40,6 +42,13 @@ func main() {
 
 	log.Println("Broadcaster Radio", version, "starting up")
 	config.LoadFromFile(*configFlag)
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		log.Fatal("could not load certificates: ", err)
+	}
+	if tlsConfig != nil {
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
 	statusCollector.Config <- config
 
 	playbackSampleRate := beep.SampleRate(sampleRate)
@@ -65,30 +74,55 @@ func main() {
 	log.Println("Config checks out, radio coming online")
 	log.Println("Audio file cache:", config.CachePath)
 
-	fileSpecChan := make(chan []protocol.FileSpec)
+	go readiness.Run()
+
+	fileSpecChan := make(chan protocol.FilesMessage)
 	go filesWorker(config.CachePath, fileSpecChan)
 
 	stop := make(chan bool)
+	trigger := make(chan protocol.PlaylistSpec)
 	playlistSpecChan := make(chan []protocol.PlaylistSpec)
-	go playlistWorker(playlistSpecChan, stop)
+	go playlistWorker(playlistSpecChan, stop, trigger)
+
+	for config.Token == "" && config.CertificateFile == "" {
+		if err := enroll(); err != nil {
+			log.Println("Enrollment failed, retry in 30 seconds:", err)
+			time.Sleep(time.Second * time.Duration(30))
+		}
+	}
 
 	for {
-		runWebsocket(fileSpecChan, playlistSpecChan, stop)
+		runWebsocket(fileSpecChan, playlistSpecChan, stop, trigger)
 		log.Println("Websocket failed, retry in 30 seconds")
 		time.Sleep(time.Second * time.Duration(30))
 	}
 }
 
-func runWebsocket(fileSpecChan chan []protocol.FileSpec, playlistSpecChan chan []protocol.PlaylistSpec, stop chan bool) error {
+// Used for everything fetched from the server, so that any client certificate and CA configured are used
+var httpClient = &http.Client{}
+
+func dialServer() (*websocket.Conn, error) {
+	wsConfig, err := websocket.NewConfig(config.WebsocketURL(), config.ServerURL)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := httpClient.Transport.(*http.Transport); ok {
+		wsConfig.TlsConfig = t.TLSClientConfig
+	}
+	return websocket.DialConfig(wsConfig)
+}
+
+func runWebsocket(fileSpecChan chan protocol.FilesMessage, playlistSpecChan chan []protocol.PlaylistSpec, stop chan bool, trigger chan protocol.PlaylistSpec) error {
 	log.Println("Establishing websocket connection to:", config.WebsocketURL())
-	ws, err := websocket.Dial(config.WebsocketURL(), "", config.ServerURL)
+	ws, err := dialServer()
 	if err != nil {
 		return err
 	}
 
 	auth := protocol.AuthenticateMessage{
-		T:     "authenticate",
-		Token: config.Token,
+		T:        "authenticate",
+		Token:    config.Token,
+		TimeZone: config.TimeZone,
 	}
 	msg, _ := json.Marshal(auth)
 
@@ -122,7 +156,7 @@ func runWebsocket(fileSpecChan chan []protocol.FileSpec, playlistSpecChan chan [
 
 		if t == protocol.FilesType {
 			filesMsg := msg.(protocol.FilesMessage)
-			fileSpecChan <- filesMsg.Files
+			fileSpecChan <- filesMsg
 		}
 
 		if t == protocol.PlaylistsType {
@@ -134,11 +168,17 @@ func runWebsocket(fileSpecChan chan []protocol.FileSpec, playlistSpecChan chan [
 			log.Println("Received stop transmission message from server")
 			stop <- true
 		}
+
+		if t == protocol.TriggerType {
+			triggerMsg := msg.(protocol.TriggerMessage)
+			log.Println("Received trigger message from server for playlist", triggerMsg.Playlist.Name)
+			trigger <- triggerMsg.Playlist
+		}
 	}
 }
 
-func filesWorker(cachePath string, ch chan []protocol.FileSpec) {
-	machine := NewFilesMachine(cachePath)
+func filesWorker(cachePath string, ch chan protocol.FilesMessage) {
+	machine := NewFilesMachine(cachePath, config.SyncMode, config.CacheQuotaMB)
 	isDownloading := false
 	downloadResult := make(chan error)
 	var timer *time.Timer
@@ -150,14 +190,17 @@ func filesWorker(cachePath string, ch chan []protocol.FileSpec) {
 		}
 		doNext := false
 		select {
-		case specs := <-ch:
-			log.Println("Received new file specs", specs)
-			machine.UpdateSpecs(specs)
+		case filesMsg := <-ch:
+			log.Println("Received new file specs", filesMsg.Files)
+			log.Println("Files needed for scheduled playlists", filesMsg.Scheduled)
+			machine.UpdateSpecs(filesMsg.Files, filesMsg.Scheduled)
+			readiness.UpdateFileSpecs(filesMsg.Files)
 			doNext = true
 			timer = nil
 		case err := <-downloadResult:
 			isDownloading = false
 			machine.RefreshMissing()
+			readiness.NotifyCacheChanged()
 			if err != nil {
 				log.Println(err)
 				if !machine.IsCacheComplete() {
@@ -181,7 +224,7 @@ func filesWorker(cachePath string, ch chan []protocol.FileSpec) {
 	}
 }
 
-func playlistWorker(ch <-chan []protocol.PlaylistSpec, stop <-chan bool) {
+func playlistWorker(ch <-chan []protocol.PlaylistSpec, stop <-chan bool, trigger <-chan protocol.PlaylistSpec) {
 	var specs []protocol.PlaylistSpec
 	isPlaying := false
 	playbackFinished := make(chan error)
@@ -198,6 +241,7 @@ func playlistWorker(ch <-chan []protocol.PlaylistSpec, stop <-chan bool) {
 		select {
 		case specs = <-ch:
 			log.Println("Received new playlist specs", specs)
+			readiness.UpdatePlaylistSpecs(specs)
 			doNext = true
 		case <-playbackFinished:
 			isPlaying = false
@@ -216,6 +260,15 @@ func playlistWorker(ch <-chan []protocol.PlaylistSpec, stop <-chan bool) {
 				log.Println("Cancelling playlist in progress")
 				cancel <- true
 			}
+		case playlist := <-trigger:
+			if isPlaying {
+				log.Println("Ignoring trigger for playlist", playlist.Name, "as another is already playing")
+				continue
+			}
+			// The schedule is worked out again once this playlist has finished
+			timer = nil
+			isPlaying = true
+			go playPlaylist(playlist, playbackFinished, cancel)
 		}
 
 		if doNext && !isPlaying {
@@ -227,10 +280,7 @@ func playlistWorker(ch <-chan []protocol.PlaylistSpec, stop <-chan bool) {
 			}
 			var soonestTime time.Time
 			for _, v := range specs {
-				t, err := time.ParseInLocation(protocol.StartTimeFormatSecs, v.StartTime, loc)
-				if err != nil {
-					t, err = time.ParseInLocation(protocol.StartTimeFormat, v.StartTime, loc)
-				}
+				t, err := protocol.ParseStartTime(v.StartTime, loc)
 				if err != nil {
 					log.Println("Error parsing start time", err)
 					continue
@@ -290,24 +340,10 @@ entries:
 			Playlist: playlist.Name,
 			Filename: p.Filename,
 		}
-		f, err := os.Open(filepath.Join(config.CachePath, p.Filename))
-		if err != nil {
-			log.Println("Couldn't open file for playlist", p.Filename)
-			continue
-		}
 		log.Println("Playing file", p.Filename)
-		l := strings.ToLower(p.Filename)
-		var streamer beep.StreamSeekCloser
-		var format beep.Format
-		if strings.HasSuffix(l, ".mp3") {
-			streamer, format, err = mp3.Decode(f)
-		} else if strings.HasSuffix(l, ".wav") {
-			streamer, format, err = wav.Decode(f)
-		} else {
-			log.Println("Unrecognised file extension (.wav and .mp3 supported), moving on")
-		}
+		streamer, format, err := decodeFile(filepath.Join(config.CachePath, p.Filename))
 		if err != nil {
-			log.Println("Could not decode media file", err)
+			log.Println("Couldn't play file for playlist", p.Filename, err)
 			continue
 		}
 		defer streamer.Close()
@@ -349,3 +385,27 @@ entries:
 	statusCollector.PlaylistBeginIdle <- true
 	playbackFinished <- nil
 }
+
+// Open an audio file and prepare to stream it, based on its file extension.
+func decodeFile(path string) (beep.StreamSeekCloser, beep.Format, error) {
+	l := strings.ToLower(path)
+	if !strings.HasSuffix(l, ".mp3") && !strings.HasSuffix(l, ".wav") {
+		return nil, beep.Format{}, errors.New("unrecognised file extension (.wav and .mp3 supported)")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, beep.Format{}, err
+	}
+	var streamer beep.StreamSeekCloser
+	var format beep.Format
+	if strings.HasSuffix(l, ".mp3") {
+		streamer, format, err = mp3.Decode(f)
+	} else {
+		streamer, format, err = wav.Decode(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, beep.Format{}, err
+	}
+	return streamer, format, nil
+}
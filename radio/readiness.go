@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"code.octet-stream.net/broadcaster/internal/protocol"
+)
+
+// Maximum number of upcoming playlists to report readiness for
+const maxReadinessReports = 10
+
+const readinessCheckInterval = time.Minute
+
+type ReadinessChecker struct {
+	FileSpecs     chan []protocol.FileSpec
+	PlaylistSpecs chan []protocol.PlaylistSpec
+	CacheChanged  chan bool
+}
+
+// Result of checking a cached file, which remains valid as long as the file's size and modification time don't change
+type cachedFileCheck struct {
+	size    int64
+	modTime time.Time
+	hash    string
+	err     error
+}
+
+var readiness = NewReadinessChecker()
+
+func NewReadinessChecker() ReadinessChecker {
+	return ReadinessChecker{
+		FileSpecs:     make(chan []protocol.FileSpec, 1),
+		PlaylistSpecs: make(chan []protocol.PlaylistSpec, 1),
+		CacheChanged:  make(chan bool, 1),
+	}
+}
+
+// Let the checker know that a file has been downloaded or removed without blocking the caller.
+func (c *ReadinessChecker) NotifyCacheChanged() {
+	select {
+	case c.CacheChanged <- true:
+	default:
+	}
+}
+
+// Hand the checker the latest files from the server without waiting for a check in progress to finish.
+// If the checker hasn't picked up the previous list yet, it is replaced.
+func (c *ReadinessChecker) UpdateFileSpecs(specs []protocol.FileSpec) {
+	for {
+		select {
+		case c.FileSpecs <- specs:
+			return
+		default:
+		}
+		select {
+		case <-c.FileSpecs:
+		default:
+		}
+	}
+}
+
+// Hand the checker the latest playlists without waiting for a check in progress to finish.
+// If the checker hasn't picked up the previous list yet, it is replaced.
+func (c *ReadinessChecker) UpdatePlaylistSpecs(specs []protocol.PlaylistSpec) {
+	for {
+		select {
+		case c.PlaylistSpecs <- specs:
+			return
+		default:
+		}
+		select {
+		case <-c.PlaylistSpecs:
+		default:
+		}
+	}
+}
+
+func (c *ReadinessChecker) Run() {
+	var fileSpecs []protocol.FileSpec
+	var playlistSpecs []protocol.PlaylistSpec
+	checked := make(map[string]cachedFileCheck)
+	ticker := time.NewTicker(readinessCheckInterval)
+
+	for {
+		select {
+		case fileSpecs = <-c.FileSpecs:
+		case playlistSpecs = <-c.PlaylistSpecs:
+		case <-c.CacheChanged:
+		case <-ticker.C:
+		}
+		statusCollector.Readiness <- checkReadiness(playlistSpecs, fileSpecs, checked)
+	}
+}
+
+func checkReadiness(playlistSpecs []protocol.PlaylistSpec, fileSpecs []protocol.FileSpec, checked map[string]cachedFileCheck) []protocol.PlaylistReadiness {
+	loc, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		log.Fatal(err)
+	}
+	type upcoming struct {
+		start time.Time
+		spec  protocol.PlaylistSpec
+	}
+	soon := make([]upcoming, 0)
+	for _, v := range playlistSpecs {
+		t, err := protocol.ParseStartTime(v.StartTime, loc)
+		if err != nil || t.Before(time.Now()) {
+			continue
+		}
+		soon = append(soon, upcoming{start: t, spec: v})
+	}
+	sort.SliceStable(soon, func(i, j int) bool {
+		return soon[i].start.Before(soon[j].start)
+	})
+	if len(soon) > maxReadinessReports {
+		soon = soon[:maxReadinessReports]
+	}
+
+	hardwareProblems := make([]string, 0)
+	if err := ptt.Check(); err != nil {
+		hardwareProblems = append(hardwareProblems, "PTT is not working: "+err.Error())
+	}
+	if err := cos.Check(); err != nil {
+		hardwareProblems = append(hardwareProblems, "COS is not working: "+err.Error())
+	}
+
+	ret := make([]protocol.PlaylistReadiness, 0)
+	for _, u := range soon {
+		problems := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, e := range u.spec.Entries {
+			if e.Filename == "" || seen[e.Filename] {
+				continue
+			}
+			seen[e.Filename] = true
+			if problem := checkFileReady(e.Filename, fileSpecs, checked); problem != "" {
+				problems = append(problems, problem)
+			}
+		}
+		problems = append(problems, hardwareProblems...)
+		ret = append(ret, protocol.PlaylistReadiness{
+			Id:        u.spec.Id,
+			Name:      u.spec.Name,
+			StartTime: u.start.Format(time.RFC3339),
+			Ready:     len(problems) == 0,
+			Problems:  problems,
+		})
+	}
+	return ret
+}
+
+// Returns a description of why this file can't be played, or an empty string if it's fine.
+func checkFileReady(filename string, fileSpecs []protocol.FileSpec, checked map[string]cachedFileCheck) string {
+	var spec *protocol.FileSpec
+	for i := range fileSpecs {
+		if fileSpecs[i].Name == filename {
+			spec = &fileSpecs[i]
+			break
+		}
+	}
+	if spec == nil {
+		return filename + " does not exist on the server"
+	}
+	path := filepath.Join(config.CachePath, filename)
+	info, err := os.Stat(path)
+	if err != nil {
+		delete(checked, filename)
+		return filename + " has not been downloaded"
+	}
+	check, ok := checked[filename]
+	if !ok || check.size != info.Size() || !check.modTime.Equal(info.ModTime()) {
+		check = cachedFileCheck{size: info.Size(), modTime: info.ModTime()}
+		check.hash, check.err = hashFile(path)
+		if check.err == nil {
+			var streamer interface{ Close() error }
+			streamer, _, check.err = decodeFile(path)
+			if check.err == nil {
+				streamer.Close()
+			}
+		}
+		checked[filename] = check
+	}
+	if check.hash != spec.Hash {
+		return filename + " does not match the server's copy"
+	}
+	if check.err != nil {
+		return filename + " could not be decoded: " + check.err.Error()
+	}
+	return ""
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -4,6 +4,7 @@ import (
 	"code.octet-stream.net/broadcaster/internal/protocol"
 	"encoding/json"
 	"golang.org/x/net/websocket"
+	"reflect"
 	"time"
 )
 
@@ -33,6 +34,7 @@ type StatusCollector struct {
 	COS                         chan bool
 	Config                      chan RadioConfig
 	FilesInSync                 chan bool
+	Readiness                   chan []protocol.PlaylistReadiness
 }
 
 var statusCollector = NewStatusCollector()
@@ -48,6 +50,7 @@ func NewStatusCollector() StatusCollector {
 		COS:                         make(chan bool),
 		Config:                      make(chan RadioConfig),
 		FilesInSync:                 make(chan bool),
+		Readiness:                   make(chan []protocol.PlaylistReadiness),
 	}
 	go runStatusCollector(sc)
 	return sc
@@ -121,11 +124,13 @@ func runStatusCollector(sc StatusCollector) {
 			msg.COS = cos
 		case inSync := <-sc.FilesInSync:
 			msg.FilesInSync = inSync
+		case r := <-sc.Readiness:
+			msg.Readiness = r
 		}
 		msg.LocalTime = time.Now().Format(protocol.LocalTimeFormat)
 		msg.COS = cos.COSValue()
 
-		if msg == lastSent {
+		if reflect.DeepEqual(msg, lastSent) {
 			continue
 		}
 		if ws != nil {
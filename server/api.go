@@ -0,0 +1,717 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.octet-stream.net/broadcaster/internal/protocol"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Body of every API response that isn't successful
+type ApiError struct {
+	Error    string
+	Problems []string `json:",omitempty"`
+}
+
+type ApiPlaylist struct {
+	Id        int
+	Enabled   bool
+	Name      string
+	StartTime string
+	Entries   []PlaylistEntry
+}
+
+// A radio as sent when registering or renaming it. Tokens are always generated by the server.
+type ApiRadio struct {
+	Name string
+}
+
+// A radio along with its token, which is only returned when the token is created.
+type RadioWithToken struct {
+	Radio
+	Token string
+}
+
+type ApiRotateRadioToken struct {
+	// How long the current token keeps working, in hours. Omit for the default of 24.
+	OverlapHours *int
+}
+
+type ApiRadioStatus struct {
+	Id        int
+	Name      string
+	Connected bool
+	Status    *protocol.StatusMessage
+	Warnings  []string
+}
+
+// A user as seen through the API. Password is only ever read from requests.
+type ApiUser struct {
+	Id       int
+	Username string
+	Roles    []string
+	Password string `json:",omitempty"`
+}
+
+// Like AuthMiddleware, but reports failures with a status code instead of redirecting to the login page.
+type ApiMiddleware struct {
+	handler authenticatedHandler
+}
+
+func (m ApiMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(w, r)
+	if errors.Is(err, ErrApiTokenScope) {
+		writeApiError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		writeApiError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	if needsTwoFactorEnrolment(user, r) {
+		writeApiError(w, http.StatusForbidden, "two-factor authentication must be set up first")
+		return
+	}
+	if err := checkCsrf(r, user); err != nil {
+		writeApiError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	m.handler(w, r, user)
+}
+
+func requireApiUser(handler authenticatedHandler) ApiMiddleware {
+	return ApiMiddleware{
+		handler: handler,
+	}
+}
+
+func writeJson(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Couldn't write API response:", err)
+	}
+}
+
+func writeApiError(w http.ResponseWriter, code int, message string) {
+	writeJson(w, code, ApiError{Error: message})
+}
+
+// Report a failure to read or change the database. The details are only logged.
+func writeApiDatabaseError(w http.ResponseWriter, err error) {
+	log.Println("Database error:", err)
+	writeApiError(w, http.StatusInternalServerError, "database error")
+}
+
+func writeApiProblems(w http.ResponseWriter, problems []string) {
+	writeJson(w, http.StatusUnprocessableEntity, ApiError{Error: "validation failed", Problems: problems})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeApiError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// Decode a JSON request body into v. Fields missing from the body keep whatever value v already has.
+// Requiring the JSON content type means a browser can't be tricked into sending a request cross-site.
+func readJson(w http.ResponseWriter, r *http.Request, v any) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		writeApiError(w, http.StatusUnsupportedMediaType, "request body must be application/json")
+		return false
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeApiError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// Split /api/v1/<resource>/<id>/<action> into its parts, any of which may be empty.
+func apiPath(r *http.Request) (string, string, string, bool) {
+	path := strings.Split(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/"), "/")
+	if len(path) > 3 {
+		return "", "", "", false
+	}
+	for len(path) < 3 {
+		path = append(path, "")
+	}
+	return path[0], path[1], path[2], true
+}
+
+func apiSection(w http.ResponseWriter, r *http.Request, user User) {
+	resource, id, action, ok := apiPath(r)
+	if !ok {
+		writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	var permission Permission
+	switch resource {
+	case "playlists":
+		permission = PermManagePlaylists
+	case "files":
+		permission = PermManageFiles
+		// Schedulers need to know which files they can put in playlists
+		if r.Method == "GET" && user.Can(PermManagePlaylists) {
+			permission = PermManagePlaylists
+		}
+	case "radios":
+		permission = PermManageRadios
+		if action == "stop" {
+			permission = PermControlRadios
+		}
+	case "users":
+		permission = PermManageUsers
+	}
+	if permission != "" && !user.Can(permission) {
+		writeApiError(w, http.StatusForbidden, "you do not have permission to do that")
+		return
+	}
+	switch resource {
+	case "playlists":
+		apiPlaylists(w, r, id, action, user)
+	case "files":
+		apiFiles(w, r, id, action, user)
+	case "radios":
+		apiRadios(w, r, id, action, user)
+	case "status":
+		apiStatus(w, r, id)
+	case "users":
+		apiUsers(w, r, id, action, user)
+	default:
+		writeApiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// Parse the id part of a path, writing a 404 if it isn't one.
+func apiId(w http.ResponseWriter, id string) (int, bool) {
+	n, err := strconv.Atoi(id)
+	if err != nil || n <= 0 {
+		writeApiError(w, http.StatusNotFound, "not found")
+		return 0, false
+	}
+	return n, true
+}
+
+func apiPlaylists(w http.ResponseWriter, r *http.Request, id string, action string, user User) {
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			list, err := db.GetPlaylists()
+			if err != nil {
+				writeApiDatabaseError(w, err)
+				return
+			}
+			ret := make([]ApiPlaylist, 0)
+			for _, p := range list {
+				ap, err := apiPlaylistFor(p)
+				if err != nil {
+					writeApiDatabaseError(w, err)
+					return
+				}
+				ret = append(ret, ap)
+			}
+			writeJson(w, http.StatusOK, ret)
+		case "POST":
+			p := ApiPlaylist{Enabled: true, Entries: make([]PlaylistEntry, 0)}
+			if !readJson(w, r, &p) {
+				return
+			}
+			p.Id = 0
+			saveApiPlaylist(w, r, user, p, "", http.StatusCreated)
+		default:
+			writeMethodNotAllowed(w, "GET", "POST")
+		}
+		return
+	}
+	if id == "export" && action == "" {
+		apiExportPlaylists(w, r, "")
+		return
+	}
+	if id == "import" && action == "" {
+		apiImportPlaylists(w, r, user)
+		return
+	}
+	playlistId, ok := apiId(w, id)
+	if !ok {
+		return
+	}
+	existing, err := db.GetPlaylist(playlistId)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeApiError(w, http.StatusNotFound, "playlist not found")
+		return
+	}
+	if err != nil {
+		writeApiDatabaseError(w, err)
+		return
+	}
+	if action == "export" {
+		apiExportPlaylists(w, r, id)
+		return
+	}
+	p, err := apiPlaylistFor(existing)
+	if err != nil {
+		writeApiDatabaseError(w, err)
+		return
+	}
+	if action == "entries" {
+		switch r.Method {
+		case "GET":
+			writeJson(w, http.StatusOK, p.Entries)
+		case "PUT":
+			p.Entries = make([]PlaylistEntry, 0)
+			if !readJson(w, r, &p.Entries) {
+				return
+			}
+			saveApiPlaylist(w, r, user, p, playlistSummary(existing, p.Entries), http.StatusOK)
+		default:
+			writeMethodNotAllowed(w, "GET", "PUT")
+		}
+		return
+	}
+	if action != "" {
+		writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJson(w, http.StatusOK, p)
+	case "PUT":
+		before := playlistSummary(existing, p.Entries)
+		if !readJson(w, r, &p) {
+			return
+		}
+		p.Id = playlistId
+		saveApiPlaylist(w, r, user, p, before, http.StatusOK)
+	case "DELETE":
+		if err := db.DeletePlaylist(playlistId); err != nil {
+			writeApiDatabaseError(w, err)
+			return
+		}
+		recordAudit(r, user, AuditPlaylistDelete, existing.Name, changeSummary(playlistSummary(existing, p.Entries), ""))
+		playlists.NotifyChanges()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, "GET", "PUT", "DELETE")
+	}
+}
+
+func apiPlaylistFor(p Playlist) (ApiPlaylist, error) {
+	entries, err := db.GetEntriesForPlaylist(p.Id)
+	return ApiPlaylist{
+		Id:        p.Id,
+		Enabled:   p.Enabled,
+		Name:      p.Name,
+		StartTime: p.StartTime,
+		Entries:   entries,
+	}, err
+}
+
+// Validate and store a playlist and its entries, then tell the radios about it. before summarises the
+// playlist as it was, for the audit log, and is empty for a new playlist.
+func saveApiPlaylist(w http.ResponseWriter, r *http.Request, user User, ap ApiPlaylist, before string, code int) {
+	p := Playlist{
+		Id:        ap.Id,
+		Enabled:   ap.Enabled,
+		Name:      ap.Name,
+		StartTime: ap.StartTime,
+	}
+	entries := make([]PlaylistEntry, 0)
+	for i, e := range ap.Entries {
+		e.Id = 0
+		e.Position = i
+		// Accept pinned versions either as a separate field or in the form radios see, e.g. "news@v3.mp3"
+		if e.FileVersion == 0 {
+			e.Filename, e.FileVersion = resolveFileRef(e.Filename)
+		}
+		entries = append(entries, e)
+	}
+	if problems := validatePlaylist(p, entries); len(problems) > 0 {
+		writeApiProblems(w, problems)
+		return
+	}
+	action := AuditPlaylistCreate
+	if p.Id != 0 {
+		action = AuditPlaylistUpdate
+	}
+	id, err := db.SavePlaylist(p, entries)
+	if err != nil {
+		writeApiDatabaseError(w, err)
+		return
+	}
+	p.Id = id
+	recordAudit(r, user, action, p.Name, changeSummary(before, playlistSummary(p, entries)))
+	playlists.NotifyChanges()
+	saved, err := apiPlaylistFor(p)
+	if err != nil {
+		writeApiDatabaseError(w, err)
+		return
+	}
+	writeJson(w, code, saved)
+}
+
+func apiFiles(w http.ResponseWriter, r *http.Request, name string, action string, user User) {
+	if action != "" {
+		writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if name == "" {
+		switch r.Method {
+		case "GET":
+			ret := files.Files()
+			if ret == nil {
+				ret = make([]FileSpec, 0)
+			}
+			writeJson(w, http.StatusOK, ret)
+		case "POST":
+			apiUploadFile(w, r, user)
+		default:
+			writeMethodNotAllowed(w, "GET", "POST")
+		}
+		return
+	}
+	if !isValidFilename(name) || !files.Exists(name) {
+		writeApiError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		for _, f := range files.Files() {
+			if f.Name == name {
+				writeJson(w, http.StatusOK, f)
+				return
+			}
+		}
+		writeApiError(w, http.StatusNotFound, "file not found")
+	case "DELETE":
+		if err := files.Delete(name); err != nil {
+			var inUse FileInUseError
+			if errors.Is(err, fs.ErrNotExist) {
+				writeApiError(w, http.StatusNotFound, "file not found")
+			} else if errors.Is(err, ErrInvalidFilename) {
+				writeApiProblems(w, []string{err.Error()})
+			} else if errors.As(err, &inUse) {
+				writeApiError(w, http.StatusConflict, err.Error())
+			} else {
+				writeApiError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+		recordAudit(r, user, AuditFileDelete, name, "")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, "GET", "DELETE")
+	}
+}
+
+// Upload a file in a multipart form field named "file", in the same way as the web interface.
+func apiUploadFile(w http.ResponseWriter, r *http.Request, user User) {
+	staged, original, err := stageUpload(w, r)
+	filename := original
+	replaced := false
+	if err == nil {
+		replaced = files.Exists(importedName(original))
+		filename, err = files.Import(staged, original, r.URL.Query().Get("overwrite") == "1", user.Username)
+	}
+	if err != nil {
+		code, message := uploadErrorStatus(filename, err)
+		writeApiError(w, code, message)
+		return
+	}
+	recordAudit(r, user, AuditFileUpload, filename, uploadSummary(original, filename, replaced))
+	for _, f := range files.Files() {
+		if f.Name == filename {
+			writeJson(w, http.StatusCreated, f)
+			return
+		}
+	}
+	writeApiError(w, http.StatusInternalServerError, "file was not found after upload")
+}
+
+func apiRadios(w http.ResponseWriter, r *http.Request, id string, action string, user User) {
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			radios, err := db.GetRadios()
+			if err != nil {
+				writeApiDatabaseError(w, err)
+				return
+			}
+			writeJson(w, http.StatusOK, radios)
+		case "POST":
+			var req ApiRadio
+			if !readJson(w, r, &req) {
+				return
+			}
+			if strings.TrimSpace(req.Name) == "" {
+				writeApiProblems(w, []string{"name must not be empty"})
+				return
+			}
+			created, token, err := createRadio(req.Name)
+			if err != nil {
+				writeApiDatabaseError(w, err)
+				return
+			}
+			recordAudit(r, user, AuditRadioCreate, created.Name, radioSummary(Radio{}, created))
+			writeJson(w, http.StatusCreated, RadioWithToken{Radio: created, Token: token})
+		default:
+			writeMethodNotAllowed(w, "GET", "POST")
+		}
+		return
+	}
+	radioId, ok := apiId(w, id)
+	if !ok {
+		return
+	}
+	radio, err := db.GetRadio(radioId)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeApiError(w, http.StatusNotFound, "radio not found")
+		return
+	}
+	if err != nil {
+		writeApiDatabaseError(w, err)
+		return
+	}
+	if action == "stop" {
+		if r.Method != "POST" {
+			writeMethodNotAllowed(w, "POST")
+			return
+		}
+		if _, connected := status.Statuses()[radioId]; !connected {
+			writeApiError(w, http.StatusConflict, "radio is not connected")
+			return
+		}
+		commandRouter.Stop(radioId)
+		recordAudit(r, user, AuditRadioStop, radio.Name, "")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if action == "rotate-token" || action == "revoke-token" {
+		if r.Method != "POST" {
+			writeMethodNotAllowed(w, "POST")
+			return
+		}
+		if action == "rotate-token" {
+			apiRotateRadioToken(w, r, radio, user)
+		} else {
+			apiRevokeRadioTokens(w, r, radio, user)
+		}
+		return
+	}
+	if action == "issue-certificate" || action == "revoke-certificate" {
+		if r.Method != "POST" {
+			writeMethodNotAllowed(w, "POST")
+			return
+		}
+		if action == "issue-certificate" {
+			apiIssueRadioCertificate(w, r, radio, user)
+		} else {
+			apiRevokeRadioCertificate(w, r, radio, user)
+		}
+		return
+	}
+	if action != "" {
+		writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJson(w, http.StatusOK, radio)
+	case "PUT":
+		old := radio
+		var req ApiRadio
+		if !readJson(w, r, &req) {
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			writeApiProblems(w, []string{"name must not be empty"})
+			return
+		}
+		radio.Name = req.Name
+		if err := db.UpdateRadio(radio); err != nil {
+			writeApiDatabaseError(w, err)
+			return
+		}
+		recordAudit(r, user, AuditRadioUpdate, radio.Name, radioSummary(old, radio))
+		writeJson(w, http.StatusOK, radio)
+	case "DELETE":
+		if err := db.DeleteRadio(radioId); err != nil {
+			writeApiDatabaseError(w, err)
+			return
+		}
+		commandRouter.DropInvalidConnection(radioId)
+		recordAudit(r, user, AuditRadioDelete, radio.Name, radioSummary(radio, Radio{}))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, "GET", "PUT", "DELETE")
+	}
+}
+
+// Live status of every radio, including ones that aren't currently connected.
+func apiStatus(w http.ResponseWriter, r *http.Request, id string) {
+	if id != "" {
+		writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+	radios, err := db.GetRadios()
+	if err != nil {
+		writeApiDatabaseError(w, err)
+		return
+	}
+	statuses := status.Statuses()
+	ret := make([]ApiRadioStatus, 0)
+	for _, radio := range radios {
+		s := ApiRadioStatus{Id: radio.Id, Name: radio.Name, Warnings: make([]string, 0)}
+		if v, ok := statuses[radio.Id]; ok {
+			s.Connected = true
+			s.Status = &v
+			s.Warnings = readinessWarnings(v.Readiness)
+		}
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	writeJson(w, http.StatusOK, ret)
+}
+
+func apiUsers(w http.ResponseWriter, r *http.Request, id string, action string, currentUser User) {
+	if action != "" {
+		writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			list, err := db.GetUsers()
+			if err != nil {
+				writeApiDatabaseError(w, err)
+				return
+			}
+			ret := make([]ApiUser, 0)
+			for _, u := range list {
+				ret = append(ret, apiUserFor(u))
+			}
+			writeJson(w, http.StatusOK, ret)
+		case "POST":
+			var u ApiUser
+			if !readJson(w, r, &u) {
+				return
+			}
+			if strings.TrimSpace(u.Username) == "" || u.Password == "" {
+				writeApiProblems(w, []string{"username and password must not be empty"})
+				return
+			}
+			if _, err := db.GetUser(u.Username); err == nil {
+				writeApiError(w, http.StatusConflict, "username is already in use")
+				return
+			}
+			if err := users.CreateUser(u.Username, u.Password, u.Roles); errors.Is(err, ErrInvalidRole) {
+				writeApiProblems(w, []string{"roles must be from: " + strings.Join(roleNames(), ", ")})
+				return
+			} else if err != nil {
+				log.Println("Couldn't create user", u.Username, err)
+				writeApiError(w, http.StatusInternalServerError, "could not create user")
+				return
+			}
+			created, err := db.GetUser(u.Username)
+			if err != nil {
+				writeApiError(w, http.StatusInternalServerError, "could not create user")
+				return
+			}
+			recordAudit(r, currentUser, AuditUserCreate, created.Username, rolesSummary(created.Roles))
+			writeJson(w, http.StatusCreated, apiUserFor(created))
+		default:
+			writeMethodNotAllowed(w, "GET", "POST")
+		}
+		return
+	}
+	userId, ok := apiId(w, id)
+	if !ok {
+		return
+	}
+	existing, err := db.GetUserById(userId)
+	if err != nil {
+		writeApiError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJson(w, http.StatusOK, apiUserFor(existing))
+	case "PUT":
+		u := apiUserFor(existing)
+		if !readJson(w, r, &u) {
+			return
+		}
+		if u.Username != existing.Username {
+			writeApiProblems(w, []string{"username cannot be changed"})
+			return
+		}
+		if existing.Username == currentUser.Username && !(User{Roles: u.Roles}).IsAdmin() {
+			writeApiProblems(w, []string{"you cannot remove your own admin role"})
+			return
+		}
+		if err := users.UpdateRoles(existing.Username, u.Roles); errors.Is(err, ErrInvalidRole) {
+			writeApiProblems(w, []string{"roles must be from: " + strings.Join(roleNames(), ", ")})
+			return
+		} else if err != nil {
+			writeApiError(w, http.StatusInternalServerError, "could not update user")
+			return
+		}
+		if u.Password != "" {
+			hashed, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+			if err != nil {
+				writeApiError(w, http.StatusInternalServerError, "could not set password")
+				return
+			}
+			if err := db.SetUserPassword(existing.Username, string(hashed)); err != nil {
+				writeApiDatabaseError(w, err)
+				return
+			}
+			recordAudit(r, currentUser, AuditUserResetPassword, existing.Username, "")
+		}
+		updated, err := db.GetUserById(userId)
+		if err != nil {
+			writeApiError(w, http.StatusInternalServerError, "could not update user")
+			return
+		}
+		recordAudit(r, currentUser, AuditUserUpdate, existing.Username, changeSummary(rolesSummary(existing.Roles), rolesSummary(updated.Roles)))
+		writeJson(w, http.StatusOK, apiUserFor(updated))
+	case "DELETE":
+		if existing.Username == currentUser.Username {
+			writeApiProblems(w, []string{"you cannot delete yourself"})
+			return
+		}
+		if err := db.DeleteUser(existing.Username); err != nil {
+			writeApiError(w, http.StatusInternalServerError, "could not delete user")
+			return
+		}
+		recordAudit(r, currentUser, AuditUserDelete, existing.Username, rolesSummary(existing.Roles))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, "GET", "PUT", "DELETE")
+	}
+}
+
+func apiUserFor(u User) ApiUser {
+	return ApiUser{
+		Id:       u.Id,
+		Username: u.Username,
+		Roles:    u.Roles,
+	}
+}
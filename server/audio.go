@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gopxl/beep/v2"
+	"github.com/gopxl/beep/v2/effects"
+	"github.com/gopxl/beep/v2/mp3"
+	"github.com/gopxl/beep/v2/wav"
+)
+
+var ErrUnsupportedType = errors.New("only .wav and .mp3 files are supported")
+var ErrInvalidAudio = errors.New("file is not valid audio")
+
+func isSupportedAudio(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".wav" || ext == ".mp3"
+}
+
+// Open an audio file for streaming, choosing a decoder based on the extension of filename.
+// The path may differ from filename, for example while the file is still in the staging area.
+func decodeAudio(path string, filename string) (beep.StreamSeekCloser, beep.Format, error) {
+	if !isSupportedAudio(filename) {
+		return nil, beep.Format{}, ErrUnsupportedType
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, beep.Format{}, err
+	}
+	var s beep.StreamSeekCloser
+	var format beep.Format
+	if strings.ToLower(filepath.Ext(filename)) == ".mp3" {
+		s, format, err = mp3.Decode(f)
+	} else {
+		s, format, err = wav.Decode(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, beep.Format{}, fmt.Errorf("%w: %v", ErrInvalidAudio, err)
+	}
+	return s, format, nil
+}
+
+// Decode the entire file to make sure that a radio will be able to play all of it.
+func validateAudio(path string, filename string) error {
+	s, _, err := decodeAudio(path, filename)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	samples := make([][2]float64, 4096)
+	total := 0
+	for {
+		n, ok := s.Stream(samples)
+		total += n
+		if !ok {
+			break
+		}
+	}
+	if s.Err() != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAudio, s.Err())
+	}
+	if total == 0 {
+		return fmt.Errorf("%w: file contains no audio", ErrInvalidAudio)
+	}
+	return nil
+}
+
+// Convert an audio file to the house format: mono 16-bit WAV at the given sample rate.
+func transcodeAudio(src string, filename string, dst string, sampleRate int) error {
+	s, format, err := decodeAudio(src, filename)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	var stream beep.Streamer = effects.Mono(s)
+	if format.SampleRate != beep.SampleRate(sampleRate) {
+		stream = beep.Resample(4, format.SampleRate, beep.SampleRate(sampleRate), stream)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return wav.Encode(out, stream, beep.Format{SampleRate: beep.SampleRate(sampleRate), NumChannels: 1, Precision: 2})
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Things that are recorded in the audit log. The part before the dot is the kind of thing that was changed.
+const (
+	AuditPlaylistCreate         = "playlist.create"
+	AuditPlaylistUpdate         = "playlist.update"
+	AuditPlaylistDelete         = "playlist.delete"
+	AuditFileUpload             = "file.upload"
+	AuditFileDelete             = "file.delete"
+	AuditFileRestore            = "file.restore"
+	AuditRadioCreate            = "radio.create"
+	AuditRadioUpdate            = "radio.update"
+	AuditRadioDelete            = "radio.delete"
+	AuditRadioStop              = "radio.stop"
+	AuditRadioTrigger           = "radio.trigger"
+	AuditRadioRotateToken       = "radio.rotate-token"
+	AuditRadioRevokeToken       = "radio.revoke-token"
+	AuditRadioEnroll            = "radio.enroll"
+	AuditRadioRejectEnroll      = "radio.reject-enrollment"
+	AuditRadioIssueCertificate  = "radio.issue-certificate"
+	AuditRadioRevokeCertificate = "radio.revoke-certificate"
+	AuditUserCreate             = "user.create"
+	AuditUserUpdate             = "user.update"
+	AuditUserDelete             = "user.delete"
+	AuditUserProvision          = "user.provision"
+	AuditUserResetPassword      = "user.reset-password"
+	AuditUserResetTwoFA         = "user.reset-two-factor"
+	AuditUserUnlock             = "user.unlock"
+	AuditUserLogOut             = "user.revoke-sessions"
+	AuditAddressUnblock         = "login.unblock-address"
+	AuditPasswordChange         = "account.change-password"
+	AuditPasswordReset          = "account.reset-password"
+	AuditEmailChange            = "account.change-email"
+	AuditTwoFactorEnable        = "account.enable-two-factor"
+	AuditTwoFactorDisable       = "account.disable-two-factor"
+	AuditRecoveryCodes          = "account.new-recovery-codes"
+	AuditSessionRevoke          = "account.revoke-session"
+	AuditTokenCreate            = "token.create"
+	AuditTokenRevoke            = "token.revoke"
+	AuditBackupDownload         = "backup.download"
+)
+
+// Categories offered in the audit log page's filter
+var auditCategories = []string{"playlist", "file", "radio", "user", "login", "account", "token", "backup"}
+
+// The audit log page shows at most this many entries. Exports include everything that matches.
+const auditPageLimit = 500
+
+// Record that a user changed something. A failure to record it is logged but doesn't undo the change.
+func recordAudit(r *http.Request, user User, action string, target string, details string) {
+	insertAuditEntry(AuditEntry{
+		Time:     time.Now(),
+		Username: user.Username,
+		Action:   action,
+		Target:   target,
+		Details:  details,
+		IP:       clientIP(r),
+	})
+}
+
+// Record a change made on the command line. There is no logged-in user, so it is attributed to the
+// operating system account that ran the command.
+func recordCliAudit(action string, target string, details string) {
+	insertAuditEntry(AuditEntry{
+		Time:     time.Now(),
+		Username: cliUsername(),
+		Action:   action,
+		Target:   target,
+		Details:  details,
+	})
+}
+
+func insertAuditEntry(entry AuditEntry) {
+	if err := db.InsertAuditEntry(entry); err != nil {
+		log.Println("Couldn't record audit entry", entry.Action, entry.Target, err)
+	}
+}
+
+// Describe a change as the state before and after, leaving out whichever doesn't exist.
+func changeSummary(before string, after string) string {
+	if before == "" {
+		return after
+	}
+	if after == "" {
+		return "was: " + before
+	}
+	if before == after {
+		return "unchanged: " + after
+	}
+	return "was: " + before + "; now: " + after
+}
+
+// Summarise a playlist as it is currently saved.
+func storedPlaylistSummary(id int) (string, error) {
+	p, err := db.GetPlaylist(id)
+	if err != nil {
+		return "", err
+	}
+	entries, err := db.GetEntriesForPlaylist(id)
+	if err != nil {
+		return "", err
+	}
+	return playlistSummary(p, entries), nil
+}
+
+func playlistSummary(p Playlist, entries []PlaylistEntry) string {
+	state := "disabled"
+	if p.Enabled {
+		state = "enabled"
+	}
+	files := make([]string, 0)
+	for _, e := range entries {
+		name := e.Filename
+		if e.FileVersion != 0 {
+			name += " v" + strconv.Itoa(e.FileVersion)
+		}
+		if e.IsRelative {
+			files = append(files, fmt.Sprintf("+%ds %s", e.DelaySeconds, name))
+		} else {
+			files = append(files, fmt.Sprintf("@%ds %s", e.DelaySeconds, name))
+		}
+	}
+	return fmt.Sprintf("%q %s, starts %s, entries [%s]", p.Name, state, p.StartTime, strings.Join(files, ", "))
+}
+
+// Radio tokens are secrets, so only record whether the token changed.
+func radioSummary(before Radio, after Radio) string {
+	if before.Id == 0 {
+		return fmt.Sprintf("%q", after.Name)
+	}
+	if after.Id == 0 {
+		return fmt.Sprintf("was: %q", before.Name)
+	}
+	return changeSummary(fmt.Sprintf("%q", before.Name), fmt.Sprintf("%q", after.Name))
+}
+
+func uploadSummary(original string, imported string, replaced bool) string {
+	parts := make([]string, 0)
+	if replaced {
+		parts = append(parts, "replaced the previous version")
+	}
+	if original != imported {
+		parts = append(parts, "converted from "+original)
+	}
+	return strings.Join(parts, "; ")
+}
+
+func rolesSummary(roles []string) string {
+	return "roles " + strings.Join(roles, ",")
+}
+
+// Meant to be appended to another summary, so it starts with a separator.
+func emailSummary(email string) string {
+	if email == "" {
+		return ""
+	}
+	return ", email " + email
+}
+
+func auditSection(w http.ResponseWriter, r *http.Request, user User) {
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	if path[2] == "export.csv" {
+		exportAuditLog(w, r)
+	} else if path[2] == "" {
+		auditPage(w, r, user)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// Read the filters from the query string, so that the page and the export link can share them.
+func auditFilterFrom(r *http.Request) (AuditFilter, string) {
+	q := r.URL.Query()
+	filter := AuditFilter{
+		Username: strings.TrimSpace(q.Get("user")),
+		Action:   strings.TrimSpace(q.Get("action")),
+		Target:   strings.TrimSpace(q.Get("target")),
+	}
+	errText := ""
+	if from := q.Get("from"); from != "" {
+		day, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			errText = "Invalid start date"
+		}
+		filter.From = day
+	}
+	if to := q.Get("to"); to != "" {
+		day, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			errText = "Invalid end date"
+		}
+		// Include the whole of the last day
+		filter.To = day.AddDate(0, 0, 1)
+	}
+	return filter, errText
+}
+
+type AuditPageData struct {
+	Entries    []AuditEntry
+	Categories []string
+	Users      []User
+	User       string
+	Action     string
+	Target     string
+	From       string
+	To         string
+	ExportURL  template.URL
+	Limited    bool
+	Error      string
+}
+
+func auditPage(w http.ResponseWriter, r *http.Request, user User) {
+	filter, errText := auditFilterFrom(r)
+	filter.Limit = auditPageLimit + 1
+	q := r.URL.Query()
+	auditUsers, err := db.GetUsers()
+	if err != nil {
+		databaseError(w, err)
+		return
+	}
+	data := AuditPageData{
+		Categories: auditCategories,
+		Users:      auditUsers,
+		User:       filter.Username,
+		Action:     filter.Action,
+		Target:     filter.Target,
+		From:       q.Get("from"),
+		To:         q.Get("to"),
+		ExportURL:  template.URL("/audit/export.csv?" + q.Encode()),
+		Error:      errText,
+	}
+	if errText == "" {
+		data.Entries, err = db.GetAuditEntries(filter)
+		if err != nil {
+			log.Println("Couldn't load audit log", err)
+			data.Error = "Could not load the audit log"
+		}
+		if len(data.Entries) > auditPageLimit {
+			data.Entries = data.Entries[:auditPageLimit]
+			data.Limited = true
+		}
+	}
+	renderHeader(w, "audit", user)
+	tmpl := parseTemplate(user, "templates/audit.html")
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	renderFooter(w)
+}
+
+// Stop spreadsheets from treating names that users chose as formulas when the export is opened.
+func csvText(s string) string {
+	if s != "" && strings.ContainsAny(s[:1], "=+-@\t\r") {
+		return "'" + s
+	}
+	return s
+}
+
+func exportAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, errText := auditFilterFrom(r)
+	if errText != "" {
+		http.Error(w, errText, http.StatusBadRequest)
+		return
+	}
+	entries, err := db.GetAuditEntries(filter)
+	if err != nil {
+		log.Println("Couldn't load audit log", err)
+		http.Error(w, "Could not load the audit log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"audit-log-"+time.Now().Format("2006-01-02")+".csv\"")
+	out := csv.NewWriter(w)
+	out.Write([]string{"Time", "User", "Action", "Target", "Details", "Address"})
+	for _, e := range entries {
+		out.Write([]string{e.Time.UTC().Format(time.RFC3339), csvText(e.Username), e.Action, csvText(e.Target), csvText(e.Details), e.IP})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Println("Couldn't write audit log export", err)
+	}
+}
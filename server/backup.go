@@ -0,0 +1,448 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Layout of backup archives. Increase this if the layout changes so that older servers refuse to restore them.
+const backupFormat = 1
+
+// Names inside a backup archive. The manifest always comes first.
+const (
+	backupManifestName = "manifest.json"
+	backupDatabaseName = "database.sqlite"
+	backupAudioDir     = "audio"
+)
+
+var ErrInvalidBackup = errors.New("invalid backup archive")
+
+// Describes a backup archive, so that it can be checked before anything is overwritten.
+type BackupManifest struct {
+	Format        int
+	ServerVersion string
+	Created       time.Time
+	SchemaVersion int
+	Files         []BackupFile
+}
+
+type BackupFile struct {
+	Path string
+	Size int64
+	Hash string
+}
+
+// Hard link the database and every audio file into a directory in the staging area, so that the archive
+// can be written at leisure without stopping uploads. Files are only ever replaced by renaming a new file
+// over the top, so the links keep the contents they had at this moment.
+func takeBackupSnapshot() (string, BackupManifest, error) {
+	manifest := BackupManifest{
+		Format:        backupFormat,
+		ServerVersion: version,
+		Created:       time.Now().UTC(),
+		Files:         make([]BackupFile, 0),
+	}
+	dir := filepath.Join(config.AudioFilesPath, stagingDir, "backup-"+generateSession()[:16])
+	if err := os.MkdirAll(filepath.Join(dir, backupAudioDir), 0750); err != nil {
+		return "", manifest, err
+	}
+	err := linkBackupFiles(dir, &manifest)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", manifest, err
+	}
+	for i, f := range manifest.Files {
+		hash, size, err := hashFile(filepath.Join(dir, filepath.FromSlash(f.Path)))
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", manifest, err
+		}
+		manifest.Files[i].Hash = hash
+		manifest.Files[i].Size = size
+	}
+	return dir, manifest, nil
+}
+
+// Uploads, restores and deletions wait while this runs, so the database and files match.
+func linkBackupFiles(dir string, manifest *BackupManifest) error {
+	files.importMutex.Lock()
+	defer files.importMutex.Unlock()
+	var err error
+	manifest.SchemaVersion, err = db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if err := db.Backup(filepath.Join(dir, backupDatabaseName)); err != nil {
+		return err
+	}
+	manifest.Files = append(manifest.Files, BackupFile{Path: backupDatabaseName})
+	return filepath.WalkDir(config.AudioFilesPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(config.AudioFilesPath, p)
+		if err != nil {
+			return err
+		}
+		// Only the audio files and their version history, not uploads in progress
+		if d.IsDir() {
+			if rel != "." && rel != versionsDir && !strings.HasPrefix(rel, versionsDir+string(filepath.Separator)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || (filepath.Dir(rel) == "." && strings.HasPrefix(rel, ".")) {
+			return nil
+		}
+		dest := filepath.Join(dir, backupAudioDir, rel)
+		if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+			return err
+		}
+		if err := linkOrCopy(p, dest); err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{Path: path.Join(backupAudioDir, filepath.ToSlash(rel))})
+		return nil
+	})
+}
+
+// Write a gzipped tar archive of the whole server state.
+func writeBackup(w io.Writer) (BackupManifest, error) {
+	dir, manifest, err := takeBackupSnapshot()
+	if err != nil {
+		return manifest, err
+	}
+	defer os.RemoveAll(dir)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifestJson, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: backupManifestName, Mode: 0644, Size: int64(len(manifestJson)), ModTime: manifest.Created, Typeflag: tar.TypeReg})
+	if err != nil {
+		return manifest, err
+	}
+	if _, err := tw.Write(manifestJson); err != nil {
+		return manifest, err
+	}
+	for _, f := range manifest.Files {
+		if err := addFileToBackup(tw, filepath.Join(dir, filepath.FromSlash(f.Path)), f, manifest.Created); err != nil {
+			return manifest, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gz.Close()
+}
+
+func addFileToBackup(tw *tar.Writer, src string, f BackupFile, modTime time.Time) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	err = tw.WriteHeader(&tar.Header{Name: f.Path, Mode: 0644, Size: f.Size, ModTime: modTime, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, in)
+	return err
+}
+
+// Only the database and files under the audio directory may appear in an archive, and never outside them.
+func validBackupPath(p string) bool {
+	if p == backupDatabaseName {
+		return true
+	}
+	return path.Clean(p) == p && strings.HasPrefix(p, backupAudioDir+"/") && !strings.Contains(p, "..")
+}
+
+// Unpack and check a backup next to the live data, then swap it into place. The previous database and
+// audio files are kept alongside, renamed with a .before-restore suffix. The server must not be running,
+// which the caller ensures with lockServer.
+func restoreBackup(archive string) (BackupManifest, error) {
+	var manifest BackupManifest
+	f, err := os.Open(archive)
+	if err != nil {
+		return manifest, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return manifest, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupManifestName {
+		return manifest, fmt.Errorf("%w: manifest missing", ErrInvalidBackup)
+	}
+	if err := json.NewDecoder(io.LimitReader(tr, 64<<20)).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("%w: unreadable manifest: %v", ErrInvalidBackup, err)
+	}
+	if manifest.Format != backupFormat {
+		return manifest, fmt.Errorf("%w: unsupported format %d", ErrInvalidBackup, manifest.Format)
+	}
+	latest := migrations[len(migrations)-1].version
+	if manifest.SchemaVersion > latest {
+		return manifest, fmt.Errorf("backup is from a newer broadcaster-server (schema version %d, this server supports %d)", manifest.SchemaVersion, latest)
+	}
+	expected := make(map[string]BackupFile)
+	for _, bf := range manifest.Files {
+		if !validBackupPath(bf.Path) {
+			return manifest, fmt.Errorf("%w: bad path %q in manifest", ErrInvalidBackup, bf.Path)
+		}
+		expected[bf.Path] = bf
+	}
+	if _, ok := expected[backupDatabaseName]; !ok {
+		return manifest, fmt.Errorf("%w: no database", ErrInvalidBackup)
+	}
+
+	stamp := time.Now().Format("20060102-150405")
+	audioTmp := filepath.Clean(config.AudioFilesPath) + ".restore-" + stamp
+	dbTmp := config.SqliteDB + ".restore-" + stamp
+	restored := false
+	defer func() {
+		if !restored {
+			os.RemoveAll(audioTmp)
+			os.Remove(dbTmp)
+		}
+	}()
+	if err := os.MkdirAll(audioTmp, 0750); err != nil {
+		return manifest, err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		bf, ok := expected[hdr.Name]
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			return manifest, fmt.Errorf("%w: unexpected entry %q", ErrInvalidBackup, hdr.Name)
+		}
+		delete(expected, hdr.Name)
+		dest := dbTmp
+		if hdr.Name != backupDatabaseName {
+			dest = filepath.Join(audioTmp, filepath.FromSlash(strings.TrimPrefix(hdr.Name, backupAudioDir+"/")))
+		}
+		if err := extractBackupFile(tr, dest, bf); err != nil {
+			return manifest, err
+		}
+	}
+	for p := range expected {
+		return manifest, fmt.Errorf("%w: %q is missing", ErrInvalidBackup, p)
+	}
+	if err := checkRestoredDatabase(dbTmp); err != nil {
+		return manifest, fmt.Errorf("%w: database: %v", ErrInvalidBackup, err)
+	}
+
+	// Everything checks out, so move the old data aside and the new data in. The database and audio files
+	// must change together, so if any step fails the earlier ones are undone.
+	if err := os.MkdirAll(filepath.Join(audioTmp, stagingDir), 0750); err != nil {
+		return manifest, err
+	}
+	if err := os.MkdirAll(filepath.Join(audioTmp, versionsDir), 0750); err != nil {
+		return manifest, err
+	}
+	var undo []func()
+	defer func() {
+		if !restored {
+			for i := len(undo) - 1; i >= 0; i-- {
+				undo[i]()
+			}
+		}
+	}()
+	dbAside := config.SqliteDB + ".before-restore-" + stamp
+	if err := setAsideDatabase(dbAside); err != nil {
+		return manifest, err
+	}
+	if _, err := os.Stat(dbAside); err == nil {
+		undo = append(undo, func() { os.Rename(dbAside, config.SqliteDB) })
+	}
+	audioAside := filepath.Clean(config.AudioFilesPath) + ".before-restore-" + stamp
+	if _, err := os.Stat(config.AudioFilesPath); err == nil {
+		if err := os.Rename(config.AudioFilesPath, audioAside); err != nil {
+			return manifest, err
+		}
+		undo = append(undo, func() { os.Rename(audioAside, config.AudioFilesPath) })
+	}
+	if err := os.Rename(dbTmp, config.SqliteDB); err != nil {
+		return manifest, err
+	}
+	undo = append(undo, func() { os.Remove(config.SqliteDB) })
+	if err := os.Rename(audioTmp, config.AudioFilesPath); err != nil {
+		return manifest, err
+	}
+	restored = true
+	return manifest, nil
+}
+
+func extractBackupFile(r io.Reader, dest string, bf BackupFile) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if size != bf.Size || hex.EncodeToString(hash.Sum(nil)) != bf.Hash {
+		return fmt.Errorf("%w: %q does not match the manifest", ErrInvalidBackup, bf.Path)
+	}
+	return nil
+}
+
+func checkRestoredDatabase(path string) error {
+	sqldb, err := sqliteDialect{path: path}.open()
+	if err != nil {
+		return err
+	}
+	defer sqldb.Close()
+	var result string
+	if err := sqldb.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return errors.New(result)
+	}
+	// Leave a single file behind rather than a WAL
+	_, err = sqldb.Exec("PRAGMA journal_mode = DELETE")
+	return err
+}
+
+// Keep a copy of the current database, if there is one, then remove it along with its WAL files.
+func setAsideDatabase(dest string) error {
+	if _, err := os.Stat(config.SqliteDB); err != nil {
+		return nil
+	}
+	sqldb, err := sqliteDialect{path: config.SqliteDB}.open()
+	if err != nil {
+		return err
+	}
+	_, err = sqldb.Exec("VACUUM INTO ?", dest)
+	sqldb.Close()
+	if err != nil {
+		return err
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(config.SqliteDB + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func runBackupCommand(dest string) {
+	if dest == "" {
+		log.Fatal("usage: broadcaster-server -c <config> backup <file.tar.gz | ->")
+	}
+	var out io.Writer = os.Stdout
+	if dest != "-" {
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	manifest, err := writeBackup(out)
+	if err != nil {
+		if dest != "-" {
+			os.Remove(dest)
+		}
+		log.Fatal("Backup failed: ", err)
+	}
+	log.Println("Backed up database and", len(manifest.Files)-1, "audio files")
+}
+
+func runRestoreCommand(archive string) {
+	if archive == "" {
+		log.Fatal("usage: broadcaster-server -c <config> restore <file.tar.gz>")
+	}
+	if config.DatabaseType != "sqlite" {
+		log.Fatal("Restoring is only supported for SQLite databases")
+	}
+	// The running server holds this lock, and holding it here stops the server starting mid-restore
+	unlock, err := lockServer()
+	if err != nil {
+		log.Fatal("Restore failed: ", err)
+	}
+	defer unlock()
+	manifest, err := restoreBackup(archive)
+	if err != nil {
+		log.Fatal("Restore failed: ", err)
+	}
+	log.Println("Restored backup made by broadcaster-server", manifest.ServerVersion, "at", manifest.Created.Local().Format("2006-01-02 15:04:05"))
+	log.Println("The previous database and audio files have been kept with a .before-restore suffix")
+}
+
+func backupSection(w http.ResponseWriter, r *http.Request, user User) {
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	if path[2] == "download" {
+		downloadBackup(w, r, user)
+	} else if path[2] == "" {
+		backupPage(w, user)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+type BackupPageData struct {
+	Supported bool
+}
+
+func backupPage(w http.ResponseWriter, user User) {
+	renderHeader(w, "backup", user)
+	tmpl := parseTemplate(user, "templates/backup.html")
+	err := tmpl.Execute(w, BackupPageData{Supported: config.DatabaseType == "sqlite"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	renderFooter(w)
+}
+
+func downloadBackup(w http.ResponseWriter, r *http.Request, user User) {
+	if config.DatabaseType != "sqlite" {
+		http.Error(w, "Backups are only supported for SQLite databases", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"broadcaster-backup-"+time.Now().Format("20060102-150405")+".tar.gz\"")
+	manifest, err := writeBackup(w)
+	if err != nil {
+		// Too late to change the status, but the archive will be truncated and fail to restore
+		log.Println("Backup download failed:", err)
+		return
+	}
+	recordAudit(r, user, AuditBackupDownload, "", fmt.Sprintf("%d audio files", len(manifest.Files)-1))
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest single chunk the server will accept
+const maxChunkBytes = 16 << 20
+
+// Uploads that haven't been finished within this time are removed from the staging area
+const staleUploadAge = 48 * time.Hour
+
+// A large upload that is sent in a series of chunks. While in progress it is kept in the staging area
+// as two files: the data received so far and this metadata.
+type ChunkedUpload struct {
+	Id        string
+	Filename  string
+	Size      int64
+	Hash      string
+	Username  string
+	Overwrite bool
+	Started   time.Time
+}
+
+// Reply to the browser describing how much of the upload the server has.
+type ChunkedUploadResponse struct {
+	Id     string
+	Offset int64
+}
+
+var chunkedUploadMutex sync.Mutex
+
+func (u ChunkedUpload) partPath() string {
+	return filepath.Join(files.StagingPath(), "chunked-"+u.Id+".part")
+}
+
+// Where the data is moved once the upload is being finished, so that no more chunks can be added to it
+func (u ChunkedUpload) finalizingPath() string {
+	return filepath.Join(files.StagingPath(), "chunked-"+u.Id+".finalizing")
+}
+
+func (u ChunkedUpload) metaPath() string {
+	return filepath.Join(files.StagingPath(), "chunked-"+u.Id+".json")
+}
+
+func (u ChunkedUpload) received() int64 {
+	info, err := os.Stat(u.partPath())
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (u ChunkedUpload) save() error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(u.metaPath(), data, 0640)
+}
+
+func (u ChunkedUpload) remove() {
+	os.Remove(u.partPath())
+	os.Remove(u.metaPath())
+}
+
+func loadChunkedUpload(id string, username string) (ChunkedUpload, error) {
+	var u ChunkedUpload
+	if id == "" || strings.ContainsAny(id, "/\\.") {
+		return u, errors.New("invalid upload id")
+	}
+	data, err := os.ReadFile(ChunkedUpload{Id: id}.metaPath())
+	if err != nil {
+		return u, err
+	}
+	if err := json.Unmarshal(data, &u); err != nil {
+		return u, err
+	}
+	if u.Username != username {
+		return u, errors.New("upload belongs to another user")
+	}
+	return u, nil
+}
+
+// Find an unfinished upload of the same file by the same user, so that it can carry on where it left off.
+func findChunkedUpload(filename string, size int64, hash string, username string) (ChunkedUpload, bool) {
+	matches, _ := filepath.Glob(filepath.Join(files.StagingPath(), "chunked-*.json"))
+	for _, m := range matches {
+		id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), "chunked-"), ".json")
+		u, err := loadChunkedUpload(id, username)
+		if err == nil && u.Filename == filename && u.Size == size && u.Hash == hash {
+			return u, true
+		}
+	}
+	return ChunkedUpload{}, false
+}
+
+// Remove anything in the staging area that has been abandoned. The files belonging to a chunked upload
+// are only removed together, once none of them has changed for a while.
+func cleanStagingArea() {
+	entries, err := os.ReadDir(files.StagingPath())
+	if err != nil {
+		return
+	}
+	lastActive := make(map[string]time.Time)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		upload := stagedUpload(e.Name())
+		if info.ModTime().After(lastActive[upload]) {
+			lastActive[upload] = info.ModTime()
+		}
+	}
+	for _, e := range entries {
+		active, ok := lastActive[stagedUpload(e.Name())]
+		if ok && time.Since(active) > staleUploadAge {
+			log.Println("Removing abandoned upload from staging area:", e.Name())
+			os.RemoveAll(filepath.Join(files.StagingPath(), e.Name()))
+		}
+	}
+}
+
+// Which upload a file in the staging area belongs to: the id for the files of a chunked upload,
+// otherwise the file itself.
+func stagedUpload(name string) string {
+	if strings.HasPrefix(name, "chunked-") {
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name
+}
+
+func writeChunkedUploadResponse(w http.ResponseWriter, status int, u ChunkedUpload) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ChunkedUploadResponse{Id: u.Id, Offset: u.received()})
+}
+
+// Begin a chunked upload, or find the existing one if this file was partially uploaded before.
+func initChunkedUpload(w http.ResponseWriter, r *http.Request, user User) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	filename := filepath.Base(r.Form.Get("filename"))
+	size, err := strconv.ParseInt(r.Form.Get("size"), 10, 64)
+	if err != nil || size <= 0 {
+		http.Error(w, "Invalid file size", http.StatusBadRequest)
+		return
+	}
+	hash := strings.ToLower(r.Form.Get("hash"))
+	if len(hash) != 64 {
+		http.Error(w, "Invalid file hash", http.StatusBadRequest)
+		return
+	}
+	overwrite := r.Form.Get("overwrite") == "1"
+	if !isValidFilename(filename) {
+		writeUploadError(w, filename, ErrInvalidFilename)
+		return
+	}
+	if !isSupportedAudio(filename) {
+		writeUploadError(w, filename, ErrUnsupportedType)
+		return
+	}
+	if size > int64(config.MaxChunkedUploadMB)<<20 {
+		http.Error(w, fmt.Sprintf("File is larger than the %d MB limit", config.MaxChunkedUploadMB), http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Check now rather than after the whole file has been sent
+	if !overwrite && files.Exists(importedName(filename)) {
+		writeUploadError(w, importedName(filename), ErrFileExists)
+		return
+	}
+
+	chunkedUploadMutex.Lock()
+	defer chunkedUploadMutex.Unlock()
+	cleanStagingArea()
+	if u, ok := findChunkedUpload(filename, size, hash, user.Username); ok {
+		u.Overwrite = overwrite
+		if err := u.save(); err != nil {
+			http.Error(w, "Could not save upload", http.StatusInternalServerError)
+			return
+		}
+		log.Println("Resuming upload of", filename, "at offset", u.received())
+		writeChunkedUploadResponse(w, http.StatusOK, u)
+		return
+	}
+	u := ChunkedUpload{
+		Id:        generateSession()[:32],
+		Filename:  filename,
+		Size:      size,
+		Hash:      hash,
+		Username:  user.Username,
+		Overwrite: overwrite,
+		Started:   time.Now(),
+	}
+	if err := u.save(); err != nil {
+		http.Error(w, "Could not save upload", http.StatusInternalServerError)
+		return
+	}
+	log.Println("Beginning chunked upload of", filename, "size", size)
+	writeChunkedUploadResponse(w, http.StatusOK, u)
+}
+
+// Append a chunk to an upload. The offset must match the amount received so far, otherwise the
+// current offset is returned with a conflict status so the browser knows where to resume from.
+func uploadChunk(w http.ResponseWriter, r *http.Request, user User) {
+	u, err := loadChunkedUpload(r.URL.Query().Get("id"), user.Username)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	chunk, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxChunkBytes))
+	if err != nil {
+		http.Error(w, "Could not read chunk", http.StatusBadRequest)
+		return
+	}
+
+	chunkedUploadMutex.Lock()
+	defer chunkedUploadMutex.Unlock()
+	received := u.received()
+	if offset != received {
+		writeChunkedUploadResponse(w, http.StatusConflict, u)
+		return
+	}
+	if received+int64(len(chunk)) > u.Size {
+		http.Error(w, "Chunk extends past the end of the file", http.StatusBadRequest)
+		return
+	}
+	f, err := os.OpenFile(u.partPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		http.Error(w, "Could not save chunk", http.StatusInternalServerError)
+		return
+	}
+	_, err = f.Write(chunk)
+	f.Close()
+	if err != nil {
+		// Discard any partial write so the offset stays consistent
+		os.Truncate(u.partPath(), received)
+		http.Error(w, "Could not save chunk", http.StatusInternalServerError)
+		return
+	}
+	// So that a slow upload still in progress never looks abandoned
+	now := time.Now()
+	os.Chtimes(u.metaPath(), now, now)
+	writeChunkedUploadResponse(w, http.StatusOK, u)
+}
+
+// Check that the whole file arrived intact, then validate and import it like any other upload.
+func finalizeChunkedUpload(w http.ResponseWriter, r *http.Request, user User) {
+	u, err := loadChunkedUpload(r.URL.Query().Get("id"), user.Username)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	// Only claim the upload while holding the lock. Hashing and importing a large file takes a while
+	// and mustn't hold up everybody else's uploads.
+	chunkedUploadMutex.Lock()
+	if u.received() != u.Size {
+		chunkedUploadMutex.Unlock()
+		writeChunkedUploadResponse(w, http.StatusConflict, u)
+		return
+	}
+	err = os.Rename(u.partPath(), u.finalizingPath())
+	if err == nil {
+		os.Remove(u.metaPath())
+		// Keep the staging area cleanup away from it for as long as it takes to finish
+		now := time.Now()
+		os.Chtimes(u.finalizingPath(), now, now)
+	}
+	chunkedUploadMutex.Unlock()
+	if err != nil {
+		http.Error(w, "Could not finish upload", http.StatusInternalServerError)
+		return
+	}
+
+	hash, _, err := hashFile(u.finalizingPath())
+	if err != nil || hash != u.Hash {
+		log.Println("Hash mismatch for chunked upload of", u.Filename)
+		os.Remove(u.finalizingPath())
+		http.Error(w, "File was corrupted during upload, please try again", http.StatusBadRequest)
+		return
+	}
+	replaced := files.Exists(importedName(u.Filename))
+	// Import removes the staged file whether or not it succeeds
+	imported, err := files.Import(u.finalizingPath(), u.Filename, u.Overwrite, u.Username)
+	if err != nil {
+		writeUploadError(w, u.Filename, err)
+		return
+	}
+	recordAudit(r, user, AuditFileUpload, imported, uploadSummary(u.Filename, imported, replaced))
+	log.Println("Finished chunked upload of", u.Filename)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "OK")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanStagingAreaKeepsActiveChunkedUploads(t *testing.T) {
+	setupTestServer(t)
+	old := time.Now().Add(-staleUploadAge - time.Hour)
+	stage := func(name string, modified time.Time) {
+		path := filepath.Join(files.StagingPath(), name)
+		if err := os.WriteFile(path, []byte("x"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Started long ago but still receiving chunks
+	stage("chunked-active.json", old)
+	stage("chunked-active.part", time.Now())
+	// Nothing has arrived for a long time
+	stage("chunked-abandoned.json", old)
+	stage("chunked-abandoned.part", old)
+	stage("upload-123.wav", old)
+	stage("upload-456.wav", time.Now())
+
+	cleanStagingArea()
+
+	for name, kept := range map[string]bool{
+		"chunked-active.json":    true,
+		"chunked-active.part":    true,
+		"chunked-abandoned.json": false,
+		"chunked-abandoned.part": false,
+		"upload-123.wav":         false,
+		"upload-456.wav":         true,
+	} {
+		_, err := os.Stat(filepath.Join(files.StagingPath(), name))
+		if kept && err != nil {
+			t.Errorf("%s was removed", name)
+		} else if !kept && err == nil {
+			t.Errorf("%s was kept", name)
+		}
+	}
+}
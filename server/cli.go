@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+const cliCommands = `Commands:
+  (none)                                   run the server
+  backup <file.tar.gz | ->                 back up the database and audio files
+  restore <file.tar.gz>                    replace the database and audio files with a backup
+  users list
+  users create [-roles r1,r2] [-email address] <username>
+  users delete <username>
+  users reset-password <username>
+  radios list
+  radios create <name>                     register a radio and print its token
+  radios rotate [-overlap hours] <radio>   give a radio a new token and print it
+  radios revoke <radio>                    stop a radio's tokens working and disconnect it
+  radios issue-certificate [-out dir] <radio>
+                                           write a new client certificate, key and CA certificate
+  radios revoke-certificate <radio>        stop a radio's client certificate working
+  radios delete <radio>
+  radios stop <radio>                      stop whatever the radio is playing
+  radios trigger <radio> <playlist>        play a playlist on the radio straight away
+  playlists list
+  files upload [-overwrite] <file>...
+
+Radios and playlists may be given by name or id. Passwords are prompted for without
+echoing, or read from the first line of standard input if it isn't a terminal.
+Stopping and triggering radios is carried out by the running server within a few seconds.
+`
+
+// Shared so that successive prompts don't lose input buffered by an earlier one
+var stdin = bufio.NewReader(os.Stdin)
+
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: broadcaster-server -c <config> [flags] [command]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Flags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(out)
+	fmt.Fprint(out, cliCommands)
+}
+
+// Run one of the management commands against the configured database, then exit.
+func runAdminCommand(args []string) {
+	var sub string
+	if len(args) > 1 {
+		sub = args[1]
+	}
+	switch args[0] + " " + sub {
+	case "users list":
+		listUsersCommand()
+	case "users create":
+		createUserCommand(args[2:])
+	case "users delete":
+		deleteUserCommand(oneArg(args))
+	case "users reset-password":
+		resetPasswordCommand(oneArg(args))
+	case "radios list":
+		listRadiosCommand()
+	case "radios create":
+		createRadioCommand(oneArg(args))
+	case "radios rotate":
+		rotateRadioCommand(args[2:])
+	case "radios revoke":
+		revokeRadioCommand(oneArg(args))
+	case "radios issue-certificate":
+		issueCertificateCommand(args[2:])
+	case "radios revoke-certificate":
+		revokeCertificateCommand(oneArg(args))
+	case "radios delete":
+		deleteRadioCommand(oneArg(args))
+	case "radios stop":
+		stopRadioCommand(oneArg(args))
+	case "radios trigger":
+		if len(args) != 4 {
+			log.Fatal("usage: broadcaster-server -c <config> radios trigger <radio> <playlist>")
+		}
+		triggerRadioCommand(args[2], args[3])
+	case "playlists list":
+		listPlaylistsCommand()
+	case "files upload":
+		uploadFilesCommand(args[2:])
+	default:
+		fmt.Fprintln(os.Stderr, "unknown command:", strings.Join(args, " "))
+		fmt.Fprint(os.Stderr, cliCommands)
+		os.Exit(2)
+	}
+}
+
+// The single argument following a two-word command, e.g. the username in "users delete alice".
+func oneArg(args []string) string {
+	if len(args) != 3 || args[2] == "" {
+		log.Fatalf("usage: broadcaster-server -c <config> %s %s <%s>", args[0], args[1], strings.TrimSuffix(args[0], "s"))
+	}
+	return args[2]
+}
+
+// How changes made on the command line are attributed in the audit log and file history.
+func cliUsername() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return "cli:" + name
+}
+
+// Read a line of input with the line ending removed.
+func readLine() (string, error) {
+	line, err := stdin.ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Ask for a new password without echoing it. If standard input isn't a terminal, e.g. in a
+// provisioning script, the password is read from the next line instead.
+func readNewPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return readLine()
+	}
+	fmt.Fprint(os.Stderr, "New password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat new password: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(repeated) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func listUsersCommand() {
+	list, err := users.Users()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "ID\tUSERNAME\tROLES\tEMAIL\tTWO-FACTOR\tLOCKED")
+	for _, u := range list {
+		roles := strings.Join(u.Roles, ",")
+		if roles == "" {
+			roles = RoleViewer
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", u.Id, u.Username, roles, u.Email, yesNo(u.HasTwoFactor()), yesNo(u.IsLocked()))
+	}
+	tw.Flush()
+}
+
+func createUserCommand(args []string) {
+	fs := flag.NewFlagSet("users create", flag.ExitOnError)
+	rolesFlag := fs.String("roles", "", "comma-separated roles, e.g. admin or scheduler,producer (default viewer)")
+	emailFlag := fs.String("email", "", "email address for password resets")
+	fs.Parse(args)
+	if fs.NArg() != 1 || fs.Arg(0) == "" {
+		log.Fatal("usage: broadcaster-server -c <config> users create [-roles r1,r2] [-email address] <username>")
+	}
+	username := fs.Arg(0)
+	var roles []string
+	if *rolesFlag != "" {
+		roles = strings.Split(*rolesFlag, ",")
+	}
+	roles, err := normalizeRoles(roles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	email := strings.TrimSpace(*emailFlag)
+	if err := validateEmail(email); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := db.GetUser(username); err == nil {
+		log.Fatal("a user called ", username, " already exists")
+	}
+	password, err := readNewPassword()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := users.CreateUser(username, password, roles); err != nil {
+		log.Fatal(err)
+	}
+	if err := db.SetUserEmail(username, email); err != nil {
+		log.Fatal(err)
+	}
+	recordCliAudit(AuditUserCreate, username, rolesSummary(roles)+emailSummary(email))
+	fmt.Println("Created user", username)
+}
+
+func deleteUserCommand(username string) {
+	u, err := db.GetUser(username)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := users.DeleteUser(username); err != nil {
+		log.Fatal(err)
+	}
+	recordCliAudit(AuditUserDelete, username, rolesSummary(u.Roles))
+	fmt.Println("Deleted user", username)
+}
+
+func resetPasswordCommand(username string) {
+	if _, err := db.GetUser(username); err != nil {
+		log.Fatal(err)
+	}
+	password, err := readNewPassword()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if password == "" {
+		log.Fatal("password cannot be empty")
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.SetUserPassword(username, string(hashed)); err != nil {
+		log.Fatal(err)
+	}
+	recordCliAudit(AuditUserResetPassword, username, "")
+	fmt.Println("Reset password for", username)
+}
+
+// Find a radio by its id or name.
+func findRadio(ref string) Radio {
+	radios, err := db.GetRadios()
+	if err != nil {
+		log.Fatal(err)
+	}
+	matches := make([]Radio, 0)
+	for _, r := range radios {
+		if r.Name == ref || strconv.Itoa(r.Id) == ref {
+			matches = append(matches, r)
+		}
+	}
+	if len(matches) == 0 {
+		log.Fatalf("no radio has the name or id %q", ref)
+	}
+	if len(matches) > 1 {
+		log.Fatalf("more than one radio matches %q; use its id instead", ref)
+	}
+	return matches[0]
+}
+
+// Find a playlist by its id or name.
+func findPlaylist(ref string) Playlist {
+	list, err := db.GetPlaylists()
+	if err != nil {
+		log.Fatal(err)
+	}
+	matches := make([]Playlist, 0)
+	for _, p := range list {
+		if p.Name == ref || strconv.Itoa(p.Id) == ref {
+			matches = append(matches, p)
+		}
+	}
+	if len(matches) == 0 {
+		log.Fatalf("no playlist has the name or id %q", ref)
+	}
+	if len(matches) > 1 {
+		log.Fatalf("more than one playlist matches %q; use its id instead", ref)
+	}
+	return matches[0]
+}
+
+// How a radio's tokens stand, for listing.
+func radioTokenState(r Radio) string {
+	if !r.HasToken {
+		return "revoked"
+	}
+	if !r.PreviousTokenExpiry.IsZero() {
+		return "rotating until " + r.PreviousTokenExpiry.Local().Format("2006-01-02 15:04")
+	}
+	return "active"
+}
+
+func listRadiosCommand() {
+	radios, err := db.GetRadios()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "ID\tNAME\tTOKEN\tCERTIFICATE\tLAST SEEN\tADDRESS")
+	for _, r := range radios {
+		lastSeen := "never"
+		if !r.LastSeen.IsZero() {
+			lastSeen = r.LastSeen.Local().Format("2006-01-02 15:04")
+		}
+		cert := "none"
+		if r.CertFingerprint != "" {
+			cert = "expires " + r.CertExpiry.Local().Format("2006-01-02")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", r.Id, r.Name, radioTokenState(r), cert, lastSeen, r.LastSeenIP)
+	}
+	tw.Flush()
+}
+
+func createRadioCommand(name string) {
+	radio, token, err := createRadio(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	recordCliAudit(AuditRadioCreate, radio.Name, radioSummary(Radio{}, radio))
+	fmt.Println("Registered radio", radio.Name, "with token:")
+	fmt.Println(token)
+}
+
+func rotateRadioCommand(args []string) {
+	fs := flag.NewFlagSet("radios rotate", flag.ExitOnError)
+	overlapFlag := fs.String("overlap", "", "hours that the current token keeps working (default 24)")
+	fs.Parse(args)
+	if fs.NArg() != 1 || fs.Arg(0) == "" {
+		log.Fatal("usage: broadcaster-server -c <config> radios rotate [-overlap hours] <radio>")
+	}
+	overlap, err := parseRadioTokenOverlap(*overlapFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	radio := findRadio(fs.Arg(0))
+	token, previousExpiry, err := rotateRadioToken(radio, overlap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	queueCommand(QueuedCommand{Action: CommandCheckToken, RadioId: radio.Id})
+	recordCliAudit(AuditRadioRotateToken, radio.Name, rotationSummary(previousExpiry))
+	fmt.Println("New token for radio", radio.Name+":")
+	fmt.Println(token)
+	if previousExpiry.IsZero() {
+		fmt.Println("The previous token has stopped working.")
+	} else {
+		fmt.Println("The previous token works until", previousExpiry.Format("2006-01-02 15:04"))
+	}
+}
+
+func revokeRadioCommand(ref string) {
+	radio := findRadio(ref)
+	if err := revokeRadioTokens(radio); err != nil {
+		log.Fatal(err)
+	}
+	queueCommand(QueuedCommand{Action: CommandCheckToken, RadioId: radio.Id})
+	recordCliAudit(AuditRadioRevokeToken, radio.Name, "")
+	fmt.Println("Revoked tokens for radio", radio.Name+"; use radios rotate to give it a new one")
+}
+
+func issueCertificateCommand(args []string) {
+	fs := flag.NewFlagSet("radios issue-certificate", flag.ExitOnError)
+	outFlag := fs.String("out", ".", "directory to write radio.crt, radio.key and ca.crt to")
+	fs.Parse(args)
+	if fs.NArg() != 1 || fs.Arg(0) == "" {
+		log.Fatal("usage: broadcaster-server -c <config> radios issue-certificate [-out dir] <radio>")
+	}
+	radio := findRadio(fs.Arg(0))
+	files := []string{"radio.crt", "radio.key", "ca.crt"}
+	for _, f := range files {
+		if _, err := os.Stat(filepath.Join(*outFlag, f)); err == nil {
+			log.Fatalf("%s already exists in %s", f, *outFlag)
+		}
+	}
+	issued, err := issueRadioCertificate(radio)
+	if err != nil {
+		log.Fatal(err)
+	}
+	queueCommand(QueuedCommand{Action: CommandCheckToken, RadioId: radio.Id})
+	recordCliAudit(AuditRadioIssueCertificate, radio.Name, certificateSummary(issued))
+	contents := []string{issued.Certificate, issued.Key, issued.CACertificate}
+	for i, f := range files {
+		mode := os.FileMode(0644)
+		if f == "radio.key" {
+			mode = 0600
+		}
+		if err := os.WriteFile(filepath.Join(*outFlag, f), []byte(contents[i]), mode); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Println("Issued certificate for radio", radio.Name, "expiring", issued.Expiry.Format("2006-01-02"))
+	fmt.Println("Wrote radio.crt, radio.key and ca.crt to", *outFlag)
+}
+
+func revokeCertificateCommand(ref string) {
+	radio := findRadio(ref)
+	if err := revokeRadioCertificate(radio); err != nil {
+		log.Fatal(err)
+	}
+	queueCommand(QueuedCommand{Action: CommandCheckToken, RadioId: radio.Id})
+	recordCliAudit(AuditRadioRevokeCertificate, radio.Name, "")
+	fmt.Println("Revoked client certificate for radio", radio.Name)
+}
+
+func deleteRadioCommand(ref string) {
+	radio := findRadio(ref)
+	if err := db.DeleteRadio(radio.Id); err != nil {
+		log.Fatal(err)
+	}
+	queueCommand(QueuedCommand{Action: CommandCheckToken, RadioId: radio.Id})
+	recordCliAudit(AuditRadioDelete, radio.Name, radioSummary(radio, Radio{}))
+	fmt.Println("Deleted radio", radio.Name)
+}
+
+func queueCommand(c QueuedCommand) {
+	c.Created = time.Now()
+	c.Username = cliUsername()
+	if err := db.QueueCommand(c); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func stopRadioCommand(ref string) {
+	radio := findRadio(ref)
+	queueCommand(QueuedCommand{Action: CommandStop, RadioId: radio.Id})
+	recordCliAudit(AuditRadioStop, radio.Name, "")
+	fmt.Println("Asked the server to stop", radio.Name)
+}
+
+func triggerRadioCommand(radioRef string, playlistRef string) {
+	radio := findRadio(radioRef)
+	playlist := findPlaylist(playlistRef)
+	queueCommand(QueuedCommand{Action: CommandTrigger, RadioId: radio.Id, PlaylistId: playlist.Id})
+	recordCliAudit(AuditRadioTrigger, radio.Name, fmt.Sprintf("playlist %q", playlist.Name))
+	fmt.Println("Asked the server to play", playlist.Name, "on", radio.Name)
+}
+
+func listPlaylistsCommand() {
+	list, err := db.GetPlaylists()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "ID\tNAME\tENABLED\tSTART TIME\tENTRIES")
+	for _, p := range list {
+		entries, err := db.GetEntriesForPlaylist(p.Id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\n", p.Id, p.Name, yesNo(p.Enabled), p.StartTime, len(entries))
+	}
+	tw.Flush()
+}
+
+func uploadFilesCommand(args []string) {
+	fs := flag.NewFlagSet("files upload", flag.ExitOnError)
+	overwrite := fs.Bool("overwrite", false, "replace existing files with the same name, keeping the old one in its history")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Fatal("usage: broadcaster-server -c <config> files upload [-overwrite] <file>...")
+	}
+	InitAudioFiles(config.AudioFilesPath)
+	failed := false
+	uploaded := false
+	for _, path := range fs.Args() {
+		filename := filepath.Base(path)
+		replaced := files.Exists(importedName(filename))
+		imported, err := uploadFileFromPath(path, *overwrite)
+		if err != nil {
+			log.Println("Couldn't upload", path+":", err)
+			failed = true
+			continue
+		}
+		recordCliAudit(AuditFileUpload, imported, uploadSummary(filename, imported, replaced))
+		fmt.Println("Uploaded", imported)
+		uploaded = true
+	}
+	if uploaded {
+		// The running server only rescans the audio files when it uploads one itself
+		queueCommand(QueuedCommand{Action: CommandRefreshFiles})
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Copy a local file into the staging area then import it in the same way as a web upload.
+func uploadFileFromPath(path string, overwrite bool) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	staged, err := os.CreateTemp(files.StagingPath(), "upload-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(staged, src)
+	staged.Close()
+	if err != nil {
+		os.Remove(staged.Name())
+		return "", err
+	}
+	return files.Import(staged.Name(), filepath.Base(path), overwrite, cliUsername())
+}
@@ -2,52 +2,187 @@ package main
 
 import (
 	"code.octet-stream.net/broadcaster/internal/protocol"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"golang.org/x/net/websocket"
+	"log"
 	"sync"
+	"time"
 )
 
+// Actions that the command line can queue for the running server
+const (
+	CommandStop         = "stop"
+	CommandTrigger      = "trigger"
+	CommandRefreshFiles = "refresh-files"
+	CommandCheckToken   = "check-token"
+)
+
+// How often the running server checks for queued commands
+const queuedCommandInterval = 2 * time.Second
+
+// Queued commands older than this are dropped, so that a radio doesn't start playing long after it was asked to
+// because the server wasn't running at the time.
+const queuedCommandExpiry = time.Minute
+
 type CommandRouter struct {
 	connsMutex sync.Mutex
-	conns      map[int]*websocket.Conn
+	conns      map[*websocket.Conn]radioConn
+}
+
+// Which radio a websocket belongs to and the credential it authenticated with: the hash of its token, or the
+// fingerprint of its client certificate. A radio may briefly have more than one websocket, e.g. if it
+// reconnects before the old one times out.
+type radioConn struct {
+	radioId         int
+	tokenHash       string
+	certFingerprint string
 }
 
 var commandRouter CommandRouter
 
 func InitCommandRouter() {
-	commandRouter.conns = make(map[int]*websocket.Conn)
+	commandRouter.conns = make(map[*websocket.Conn]radioConn)
 }
 
-func (c *CommandRouter) AddWebsocket(radioId int, ws *websocket.Conn) {
+func (c *CommandRouter) AddWebsocket(ws *websocket.Conn, conn radioConn) {
 	c.connsMutex.Lock()
 	defer c.connsMutex.Unlock()
-	c.conns[radioId] = ws
+	c.conns[ws] = conn
 }
 
 func (c *CommandRouter) RemoveWebsocket(ws *websocket.Conn) {
 	c.connsMutex.Lock()
 	defer c.connsMutex.Unlock()
-	key := -1
-	for k, v := range c.conns {
-		if v == ws {
-			key = k
+	delete(c.conns, ws)
+}
+
+// Close a radio's websockets if the credential they connected with no longer works, e.g. because a token was
+// revoked, rotated without an overlap or the overlap has ended, or a certificate was revoked or reissued.
+func (c *CommandRouter) DropInvalidConnection(radioId int) {
+	c.connsMutex.Lock()
+	conns := make(map[*websocket.Conn]radioConn)
+	for ws, conn := range c.conns {
+		if conn.radioId == radioId {
+			conns[ws] = conn
 		}
 	}
-	if key != -1 {
-		delete(c.conns, key)
+	c.connsMutex.Unlock()
+	recheck := false
+	for ws, conn := range conns {
+		valid, overlapEnds, err := conn.stillValid()
+		if err != nil {
+			log.Println("Couldn't check credentials for radio", radioId, err)
+		} else if !valid {
+			log.Println("Disconnecting radio", radioId, "as its credentials no longer work")
+			ws.Close()
+		} else if !overlapEnds.IsZero() && !recheck {
+			// The radio may be using a previous token, which will stop working at the end of the overlap.
+			// This covers rotations from the command line too, which reach here through a queued command.
+			recheck = true
+			time.AfterFunc(time.Until(overlapEnds), func() {
+				c.DropInvalidConnection(radioId)
+			})
+		}
 	}
+}
 
+// Whether the connection's credential still works, and if it authenticated with a token while a previous
+// token is still allowed, when that allowance ends.
+func (conn radioConn) stillValid() (bool, time.Time, error) {
+	var radio Radio
+	var err error
+	if conn.certFingerprint != "" {
+		radio, err = db.GetRadioByCertificate(conn.certFingerprint)
+	} else {
+		radio, err = db.GetRadioByTokenHash(conn.tokenHash)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, time.Time{}, nil
+	}
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if conn.certFingerprint != "" {
+		return radio.Id == conn.radioId && radio.CertExpiry.After(time.Now()), time.Time{}, nil
+	}
+	return radio.Id == conn.radioId, radio.PreviousTokenExpiry, nil
 }
 
-func (c *CommandRouter) Stop(radioId int) {
+// Send a message to a radio. Returns false if the radio isn't connected.
+func (c *CommandRouter) send(radioId int, msg any) bool {
 	c.connsMutex.Lock()
 	defer c.connsMutex.Unlock()
-	ws := c.conns[radioId]
-	if ws != nil {
-		stop := protocol.StopMessage{
-			T: protocol.StopType,
+	b, _ := json.Marshal(msg)
+	sent := false
+	for ws, conn := range c.conns {
+		if conn.radioId == radioId {
+			ws.Write(b)
+			sent = true
+		}
+	}
+	return sent
+}
+
+func (c *CommandRouter) Stop(radioId int) bool {
+	return c.send(radioId, protocol.StopMessage{
+		T: protocol.StopType,
+	})
+}
+
+// Ask a radio to play a playlist straight away.
+func (c *CommandRouter) Trigger(radioId int, playlist protocol.PlaylistSpec) bool {
+	return c.send(radioId, protocol.TriggerMessage{
+		T:        protocol.TriggerType,
+		Playlist: playlist,
+	})
+}
+
+// Carry out commands queued from the command line, for as long as the server is running.
+func (c *CommandRouter) RunQueuedCommands() {
+	for {
+		time.Sleep(queuedCommandInterval)
+		commands, err := db.TakeQueuedCommands()
+		if err != nil {
+			log.Println("Couldn't load queued commands:", err)
+			continue
+		}
+		for _, cmd := range commands {
+			if time.Since(cmd.Created) > queuedCommandExpiry {
+				log.Println("Dropping queued command", cmd.Action, "from", cmd.Username, "as it is too old")
+				continue
+			}
+			c.runQueuedCommand(cmd)
+		}
+	}
+}
+
+func (c *CommandRouter) runQueuedCommand(cmd QueuedCommand) {
+	switch cmd.Action {
+	case CommandStop:
+		if !c.Stop(cmd.RadioId) {
+			log.Println("Couldn't stop radio", cmd.RadioId, "as it isn't connected")
+		}
+	case CommandTrigger:
+		playlist, err := db.GetPlaylist(cmd.PlaylistId)
+		if err != nil {
+			log.Println("Couldn't load playlist", cmd.PlaylistId, "to trigger:", err)
+			return
+		}
+		spec, err := playlistSpecForRadio(playlist)
+		if err != nil {
+			log.Println("Couldn't load playlist", cmd.PlaylistId, "to trigger:", err)
+			return
+		}
+		if !c.Trigger(cmd.RadioId, spec) {
+			log.Println("Couldn't trigger radio", cmd.RadioId, "as it isn't connected")
 		}
-		msg, _ := json.Marshal(stop)
-		ws.Write(msg)
+	case CommandRefreshFiles:
+		files.Refresh()
+	case CommandCheckToken:
+		c.DropInvalidConnection(cmd.RadioId)
+	default:
+		log.Println("Ignoring unknown queued command", cmd.Action)
 	}
 }
@@ -3,23 +3,73 @@ package main
 import (
 	"errors"
 	"log"
+	"net/url"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
 type ServerConfig struct {
-	BindAddress    string
-	Port           int
-	SqliteDB       string
-	AudioFilesPath string
+	BindAddress           string
+	Port                  int
+	TLSCertFile           string
+	TLSKeyFile            string
+	HTTPRedirectPort      int
+	DatabaseType          string
+	SqliteDB              string
+	PostgresURL           string
+	AudioFilesPath        string
+	SyncHorizonHours      int
+	ReadinessWarningHours int
+	MaxUploadMB           int
+	MaxChunkedUploadMB    int
+	TranscodeUploads      bool
+	TranscodeSampleRate   int
+	RequireTwoFactorRoles []string
+	LoginLockoutThreshold int
+	LoginLockoutMinutes   int
+	TrustForwardedFor     bool
+	SessionLifetimeDays   int
+	SessionIdleHours      int
+	BaseURL               string
+	RadioEnrollment       bool
+	RadioTLSPort          int
+	RadioTLSHosts         []string
+	RadioCAPath           string
+	SMTP                  SMTPConfig
+	OIDC                  OIDCConfig
 }
 
 func NewServerConfig() ServerConfig {
 	return ServerConfig{
-		BindAddress:    "0.0.0.0",
-		Port:           55134,
-		SqliteDB:       "",
-		AudioFilesPath: "",
+		BindAddress:           "0.0.0.0",
+		Port:                  55134,
+		TLSCertFile:           "",
+		TLSKeyFile:            "",
+		HTTPRedirectPort:      0,
+		DatabaseType:          "sqlite",
+		SqliteDB:              "",
+		PostgresURL:           "",
+		AudioFilesPath:        "",
+		SyncHorizonHours:      168,
+		ReadinessWarningHours: 24,
+		MaxUploadMB:           100,
+		MaxChunkedUploadMB:    1024,
+		TranscodeUploads:      false,
+		TranscodeSampleRate:   44100,
+		RequireTwoFactorRoles: []string{},
+		LoginLockoutThreshold: 10,
+		LoginLockoutMinutes:   15,
+		TrustForwardedFor:     false,
+		SessionLifetimeDays:   365,
+		SessionIdleHours:      0,
+		BaseURL:               "",
+		RadioEnrollment:       true,
+		RadioTLSPort:          0,
+		RadioTLSHosts:         []string{"localhost", "127.0.0.1", "::1"},
+		RadioCAPath:           "",
+		SMTP:                  NewSMTPConfig(),
+		OIDC:                  NewOIDCConfig(),
 	}
 }
 
@@ -35,11 +85,85 @@ func (c *ServerConfig) LoadFromFile(path string) {
 }
 
 func (c *ServerConfig) Validate() error {
-	if c.SqliteDB == "" {
-		return errors.New("Configuration must provide SqliteDB")
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("TLSCertFile and TLSKeyFile must be provided together")
+	}
+	if c.HTTPRedirectPort != 0 && c.TLSCertFile == "" {
+		return errors.New("HTTPRedirectPort can only be used when TLSCertFile and TLSKeyFile are set")
+	}
+	if c.HTTPRedirectPort < 0 || c.HTTPRedirectPort > 65535 || (c.HTTPRedirectPort != 0 && c.HTTPRedirectPort == c.Port) {
+		return errors.New("HTTPRedirectPort must be a valid port number different from Port, or 0 to turn it off")
+	}
+	switch c.DatabaseType {
+	case "sqlite":
+		if c.SqliteDB == "" {
+			return errors.New("Configuration must provide SqliteDB")
+		}
+	case "postgres":
+		if c.PostgresURL == "" {
+			return errors.New("Configuration must provide PostgresURL when DatabaseType is postgres")
+		}
+	default:
+		return errors.New("DatabaseType must be sqlite or postgres")
 	}
 	if c.AudioFilesPath == "" {
 		return errors.New("Configuration must provide AudioFilesPath")
 	}
+	if c.SyncHorizonHours <= 0 {
+		return errors.New("SyncHorizonHours must be greater than zero")
+	}
+	if c.ReadinessWarningHours < 0 {
+		return errors.New("ReadinessWarningHours cannot be negative")
+	}
+	if c.MaxUploadMB <= 0 {
+		return errors.New("MaxUploadMB must be greater than zero")
+	}
+	if c.MaxChunkedUploadMB <= 0 {
+		return errors.New("MaxChunkedUploadMB must be greater than zero")
+	}
+	if c.TranscodeSampleRate <= 0 {
+		return errors.New("TranscodeSampleRate must be greater than zero")
+	}
+	if _, err := normalizeRoles(c.RequireTwoFactorRoles); err != nil {
+		return errors.New("RequireTwoFactorRoles must only contain: " + strings.Join(roleNames(), ", "))
+	}
+	if c.LoginLockoutThreshold < 0 {
+		return errors.New("LoginLockoutThreshold cannot be negative")
+	}
+	if c.LoginLockoutMinutes <= 0 {
+		return errors.New("LoginLockoutMinutes must be greater than zero")
+	}
+	if c.SessionLifetimeDays <= 0 {
+		return errors.New("SessionLifetimeDays must be greater than zero")
+	}
+	if c.SessionIdleHours < 0 {
+		return errors.New("SessionIdleHours cannot be negative")
+	}
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("BaseURL must be a full http or https URL")
+		}
+		c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+	}
+	if c.RadioTLSPort < 0 || c.RadioTLSPort > 65535 {
+		return errors.New("RadioTLSPort must be a valid port number, or 0 to turn it off")
+	}
+	if c.RadioTLSPort != 0 && c.RadioCAPath == "" {
+		return errors.New("RadioCAPath must be set when RadioTLSPort is configured")
+	}
+	if c.RadioTLSPort != 0 && len(c.RadioTLSHosts) == 0 {
+		return errors.New("RadioTLSHosts must list at least one host name or address")
+	}
+	if err := c.SMTP.Validate(); err != nil {
+		return err
+	}
+	// Links in emails can't be based on the request, since anybody can send a misleading Host header
+	if c.SMTP.Enabled() && c.BaseURL == "" {
+		return errors.New("BaseURL must be set when SMTP is configured")
+	}
+	if err := c.OIDC.Validate(); err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Forms carry the CSRF token in this field. Scripts can use the header instead.
+const csrfFormField = "csrf_token"
+const csrfHeader = "X-CSRF-Token"
+
+var ErrCsrfToken = errors.New("invalid or missing CSRF token")
+
+// Each session has its own CSRF token. It is derived from the session token so that nothing extra needs to be
+// stored, and knowing it doesn't reveal the session token.
+func csrfTokenForSession(session string) string {
+	hash := sha256.Sum256([]byte("csrf:" + session))
+	return hex.EncodeToString(hash[:])
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// Make sure that a request which changes something came from one of our own pages. Requests using an API
+// token are exempt since a browser will never add the Authorization header by itself.
+func checkCsrf(r *http.Request, user User) error {
+	if isSafeMethod(r.Method) {
+		return nil
+	}
+	if _, isScript := bearerToken(r); isScript {
+		return nil
+	}
+	if user.csrfToken == "" {
+		return ErrCsrfToken
+	}
+	offered := r.Header.Get(csrfHeader)
+	// Multipart bodies are uploads that are streamed to disk, so they must use the header
+	if offered == "" && !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		offered = r.PostFormValue(csrfFormField)
+	}
+	if subtle.ConstantTimeCompare([]byte(offered), []byte(user.csrfToken)) != 1 {
+		return ErrCsrfToken
+	}
+	return nil
+}
+
+func csrfFuncs(user User) template.FuncMap {
+	return template.FuncMap{
+		"csrfToken": func() string {
+			return user.csrfToken
+		},
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfFormField + `" value="` + template.HTMLEscapeString(user.csrfToken) + `">`)
+		},
+	}
+}
+
+// Parse a template containing forms, which need the user's CSRF token.
+func parseTemplate(user User, name string) *template.Template {
+	return template.Must(template.New(path.Base(name)).Funcs(csrfFuncs(user)).ParseFS(content, name))
+}
+
+// Only send the session cookie over HTTPS if that's how the user reached us.
+func isSecureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return config.TrustForwardedFor && r.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -4,259 +4,900 @@ import (
 	"database/sql"
 	"errors"
 	"log"
-	_ "modernc.org/sqlite"
+	"strings"
 	"time"
 )
 
-type Database struct {
-	sqldb *sql.DB
+// Storage for everything except the audio files themselves.
+type Database interface {
+	SchemaVersion() (int, error)
+	DescribeMigrations() error
+	MigrateDatabase() error
+	Backup(path string) error
+	DeleteExpired() error
+	CloseDatabase() error
+
+	InsertSession(session Session, token string) error
+	GetSessionByToken(token string) (Session, error)
+	GetSession(id int) (Session, error)
+	GetSessions(username string) ([]Session, error)
+	SetSessionLastSeen(id int, lastSeen time.Time, ip string) error
+	DeleteSession(id int) error
+	DeleteSessions(username string) error
+	GetUser(username string) (User, error)
+	GetUserById(id int) (User, error)
+	GetUsers() ([]User, error)
+	GetUsersByEmail(email string) ([]User, error)
+	SetUserEmail(username string, email string) error
+	InsertPasswordReset(reset PasswordReset, tokenHash string) error
+	GetPasswordReset(tokenHash string) (PasswordReset, error)
+	GetLastPasswordReset(username string) (time.Time, error)
+	UsePasswordReset(reset PasswordReset, passwordHash string) (bool, error)
+	SetUserPassword(username string, passwordHash string) error
+	ClearOtherSessions(username string, token string) error
+	ClearSession(username string, token string) error
+	SetUserRoles(username string, roles []string) error
+	GetUserByOidcSubject(subject string) (User, error)
+	SetUserOidcSubject(username string, subject string) error
+	SetLoginFailures(username string, count int, lockedUntil time.Time) error
+	CreateUser(user User) error
+	DeleteUser(username string) error
+	SavePlaylist(playlist Playlist, entries []PlaylistEntry) (int, error)
+	SavePlaylists(p []PlaylistWithEntries) ([]int, error)
+	DeletePlaylist(playlistId int) error
+	GetPlaylists() ([]Playlist, error)
+	GetPlaylist(playlistId int) (Playlist, error)
+	GetEntriesForPlaylist(playlistId int) ([]PlaylistEntry, error)
+	GetPlaylistsPinningFile(filename string) ([]string, error)
+	GetRadio(radioId int) (Radio, error)
+	GetRadioByTokenHash(tokenHash string) (Radio, error)
+	GetRadioByCertificate(fingerprint string) (Radio, error)
+	GetRadios() ([]Radio, error)
+	DeleteRadio(radioId int) error
+	CreateRadio(radio Radio, tokenHash string) (int, error)
+	UpdateRadio(radio Radio) error
+	RotateRadioToken(radioId int, tokenHash string, previousExpiry time.Time) error
+	RevokeRadioTokens(radioId int) error
+	SetRadioLastSeen(radioId int, lastSeen time.Time, ip string) error
+	SetRadioCertificate(radioId int, fingerprint string, expiry time.Time) error
+	CreateFileVersion(v FileVersion) error
+	GetFileVersions(filename string) ([]FileVersion, error)
+	GetFileVersion(filename string, version int) (FileVersion, error)
+	DeleteFileVersions(filename string) error
+	CreateApiToken(t ApiToken, tokenHash string) error
+	GetApiTokenByHash(tokenHash string) (ApiToken, error)
+	GetApiToken(id int) (ApiToken, error)
+	GetApiTokens(username string) ([]ApiToken, error)
+	SetApiTokenLastUsed(id int, lastUsed time.Time) error
+	DeleteApiToken(id int) error
+	QueueCommand(c QueuedCommand) error
+	TakeQueuedCommands() ([]QueuedCommand, error)
+	InsertAuditEntry(e AuditEntry) error
+	GetAuditEntries(f AuditFilter) ([]AuditEntry, error)
+	EnableTwoFactor(username string, secret string, recoveryCodeHashes []string) error
+	DisableTwoFactor(username string) error
+	SetRecoveryCodes(username string, codeHashes []string) error
+	UseRecoveryCode(username string, codeHash string) (bool, error)
+	CountRecoveryCodes(username string) (int, error)
+	UseTotpStep(username string, step int64) (bool, error)
+}
+
+// A Database in SQLite or Postgres. The same queries and migrations are used for both, with the
+// differences handled by the dialect.
+type sqlDatabase struct {
+	sqldb   *sql.DB
+	dialect dialect
 }
 
 var db Database
 
 func InitDatabase() {
-	sqldb, err := sql.Open("sqlite", config.SqliteDB)
+	d := newDialect(config)
+	sqldb, err := d.open()
 	if err != nil {
 		log.Fatal(err)
 	}
-	db.sqldb = sqldb
+	db = &sqlDatabase{sqldb: sqldb, dialect: d}
+}
 
-	_, err = db.sqldb.Exec("PRAGMA journal_mode = WAL")
-	if err != nil {
-		log.Fatal(err)
-	}
+func (d *sqlDatabase) exec(query string, args ...any) (sql.Result, error) {
+	return d.sqldb.Exec(d.dialect.rebind(query), d.dialect.convertArgs(args)...)
+}
 
-	_, err = db.sqldb.Exec("PRAGMA foreign_keys = ON")
-	if err != nil {
-		log.Fatal(err)
-	}
+func (d *sqlDatabase) query(query string, args ...any) (*sql.Rows, error) {
+	return d.sqldb.Query(d.dialect.rebind(query), d.dialect.convertArgs(args)...)
+}
 
-	_, err = db.sqldb.Exec("PRAGMA busy_timeout = 5000")
+func (d *sqlDatabase) queryRow(query string, args ...any) *sql.Row {
+	return d.sqldb.QueryRow(d.dialect.rebind(query), d.dialect.convertArgs(args)...)
+}
+
+// A transaction that rewrites its queries for the dialect in the same way.
+type dbTx struct {
+	tx      *sql.Tx
+	dialect dialect
+}
+
+func (d *sqlDatabase) begin() (*dbTx, error) {
+	tx, err := d.sqldb.Begin()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return &dbTx{tx: tx, dialect: d.dialect}, nil
+}
+
+func (t *dbTx) Exec(query string, args ...any) (sql.Result, error) {
+	return t.tx.Exec(t.dialect.rebind(query), t.dialect.convertArgs(args)...)
+}
+
+func (t *dbTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.tx.Query(t.dialect.rebind(query), t.dialect.convertArgs(args)...)
+}
+
+func (t *dbTx) QueryRow(query string, args ...any) *sql.Row {
+	return t.tx.QueryRow(t.dialect.rebind(query), t.dialect.convertArgs(args)...)
+}
+
+// Run statements that create or change tables, written with SQLite's types.
+func (t *dbTx) ExecSchema(stmt string) error {
+	_, err := t.tx.Exec(t.dialect.translateSchema(stmt))
+	return err
+}
+
+func (t *dbTx) Commit() error {
+	return t.tx.Commit()
+}
 
-	sqlStmt := `
-	CREATE TABLE IF NOT EXISTS sessions (id INTEGER PRIMARY KEY AUTOINCREMENT, token TEXT, username TEXT, created TIMESTAMP, expiry TIMESTAMP);
-	CREATE TABLE IF NOT EXISTS playlists (id INTEGER PRIMARY KEY AUTOINCREMENT, enabled INTEGER, name TEXT, start_time TEXT);
-	CREATE TABLE IF NOT EXISTS playlist_entries (id INTEGER PRIMARY KEY AUTOINCREMENT, playlist_id INTEGER, position INTEGER, filename TEXT, delay_seconds INTEGER, is_relative INTEGER, CONSTRAINT fk_playlists FOREIGN KEY (playlist_id) REFERENCES playlists(id) ON DELETE CASCADE);
-	CREATE TABLE IF NOT EXISTS radios (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, token TEXT);
-	CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT UNIQUE, password_hash TEXT, is_admin INTEGER);
+func (t *dbTx) Rollback() error {
+	return t.tx.Rollback()
+}
 
-	DELETE FROM sessions WHERE expiry < CURRENT_TIMESTAMP;
-	`
-	_, err = db.sqldb.Exec(sqlStmt)
+// Write a consistent copy of the database to a new file, even while it is in use.
+func (d *sqlDatabase) Backup(path string) error {
+	return d.dialect.backup(d, path)
+}
+
+// Remove logins that can no longer be used.
+func (d *sqlDatabase) DeleteExpired() error {
+	_, err := d.exec("DELETE FROM sessions WHERE expiry < ?", time.Now().UTC())
 	if err != nil {
-		log.Printf("%q: %s\n", err, sqlStmt)
-		return
+		return err
 	}
+	_, err = d.exec("DELETE FROM password_resets WHERE expiry < ?", time.Now().UTC())
+	return err
 }
 
-func (d *Database) CloseDatabase() {
-	d.sqldb.Close()
+func (d *sqlDatabase) CloseDatabase() error {
+	return d.sqldb.Close()
 }
 
-func (d *Database) InsertSession(user string, token string, expiry time.Time) {
-	_, err := d.sqldb.Exec("INSERT INTO sessions (token, username, created, expiry) values (?, ?, CURRENT_TIMESTAMP, ?)", token, user, expiry)
+func (d *sqlDatabase) InsertSession(session Session, token string) error {
+	_, err := d.exec("INSERT INTO sessions (token, username, created, expiry, last_seen, user_agent, ip) values (?, ?, ?, ?, ?, ?, ?)",
+		token, session.Username, session.Created.UTC(), session.Expiry.UTC(), nullTime(session.LastSeen), session.UserAgent, session.IP)
+	return err
+}
+
+const sessionColumns = "id, username, created, expiry, last_seen, user_agent, ip"
+
+func scanSession(row interface{ Scan(...any) error }) (Session, error) {
+	var s Session
+	var lastSeen sql.NullTime
+	err := row.Scan(&s.Id, &s.Username, &s.Created, &s.Expiry, &lastSeen, &s.UserAgent, &s.IP)
+	s.LastSeen = lastSeen.Time
+	return s, err
+}
+
+func (d *sqlDatabase) GetSessionByToken(token string) (Session, error) {
+	s, err := scanSession(d.queryRow("SELECT "+sessionColumns+" FROM sessions WHERE token = ?", token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, errors.New("no matching token")
+	}
 	if err != nil {
-		log.Fatal(err)
+		return Session{}, err
 	}
+	return s, nil
 }
 
-func (d *Database) GetUserNameForSession(token string) (string, error) {
-	var username string
-	err := d.sqldb.QueryRow("SELECT username FROM sessions WHERE token = ? AND expiry > CURRENT_TIMESTAMP", token).Scan(&username)
+func (d *sqlDatabase) GetSession(id int) (Session, error) {
+	return scanSession(d.queryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+}
+
+// Sessions belonging to a user, or to everybody if username is empty. The most recently used come first.
+func (d *sqlDatabase) GetSessions(username string) ([]Session, error) {
+	ret := make([]Session, 0)
+	rows, err := d.query("SELECT "+sessionColumns+" FROM sessions WHERE ? = '' OR username = ? ORDER BY username ASC, COALESCE(last_seen, created) DESC", username, username)
 	if err != nil {
-		return "", errors.New("no matching token")
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, s)
 	}
-	return username, nil
+	return ret, rows.Err()
+}
+
+func (d *sqlDatabase) SetSessionLastSeen(id int, lastSeen time.Time, ip string) error {
+	_, err := d.exec("UPDATE sessions SET last_seen = ?, ip = ? WHERE id = ?", lastSeen.UTC(), ip, id)
+	return err
 }
 
-func (d *Database) GetUser(username string) (User, error) {
+func (d *sqlDatabase) DeleteSession(id int) error {
+	_, err := d.exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+func (d *sqlDatabase) DeleteSessions(username string) error {
+	_, err := d.exec("DELETE FROM sessions WHERE username = ?", username)
+	return err
+}
+
+const userColumns = "id, username, password_hash, roles, totp_secret, failed_logins, locked_until, oidc_subject, email"
+
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
 	var user User
-	err := d.sqldb.QueryRow("SELECT id, username, password_hash, is_admin FROM users WHERE username = ?", username).Scan(&user.Id, &user.Username, &user.PasswordHash, &user.IsAdmin)
-	if err != nil {
+	var roles string
+	var lockedUntil sql.NullTime
+	err := row.Scan(&user.Id, &user.Username, &user.PasswordHash, &roles, &user.TotpSecret, &user.FailedLogins, &lockedUntil, &user.OidcSubject, &user.Email)
+	user.Roles = parseRoles(roles)
+	user.LockedUntil = lockedUntil.Time
+	return user, err
+}
+
+func (d *sqlDatabase) GetUser(username string) (User, error) {
+	user, err := scanUser(d.queryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+	if errors.Is(err, sql.ErrNoRows) {
 		return User{}, errors.New("no user with that username")
 	}
+	if err != nil {
+		return User{}, err
+	}
 	return user, nil
 }
 
-func (d *Database) GetUserById(id int) (User, error) {
-	var user User
-	err := d.sqldb.QueryRow("SELECT id, username, password_hash, is_admin FROM users WHERE id = ?", id).Scan(&user.Id, &user.Username, &user.PasswordHash, &user.IsAdmin)
-	if err != nil {
+func (d *sqlDatabase) GetUserById(id int) (User, error) {
+	user, err := scanUser(d.queryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
 		return User{}, errors.New("no user with that id")
 	}
+	if err != nil {
+		return User{}, err
+	}
 	return user, nil
 }
 
-func (d *Database) GetUsers() []User {
+func (d *sqlDatabase) GetUsers() ([]User, error) {
 	ret := make([]User, 0)
-	rows, err := d.sqldb.Query("SELECT id, username, password_hash, is_admin FROM users ORDER BY username ASC")
+	rows, err := d.query("SELECT " + userColumns + " FROM users ORDER BY username ASC")
 	if err != nil {
-		return ret
+		return ret, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.Id, &u.Username, &u.PasswordHash, &u.IsAdmin); err != nil {
-			return ret
+		u, err := scanUser(rows)
+		if err != nil {
+			return ret, err
 		}
 		ret = append(ret, u)
 	}
-	return ret
+	return ret, rows.Err()
 }
 
-func (d *Database) SetUserPassword(username string, passwordHash string) {
-	d.sqldb.Exec("UPDATE users SET password_hash = ? WHERE username = ?", passwordHash, username)
+// Users whose email address matches, ignoring case. Several users may share an address.
+func (d *sqlDatabase) GetUsersByEmail(email string) ([]User, error) {
+	ret := make([]User, 0)
+	if email == "" {
+		return ret, nil
+	}
+	rows, err := d.query("SELECT "+userColumns+" FROM users WHERE lower(email) = ? ORDER BY username ASC", strings.ToLower(email))
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, u)
+	}
+	return ret, rows.Err()
+}
+
+func (d *sqlDatabase) SetUserEmail(username string, email string) error {
+	_, err := d.exec("UPDATE users SET email = ? WHERE username = ?", email, username)
+	return err
 }
 
-func (d *Database) ClearOtherSessions(username string, token string) {
-	d.sqldb.Exec("DELETE FROM sessions WHERE username = ? AND token != ?", username, token)
+func (d *sqlDatabase) InsertPasswordReset(reset PasswordReset, tokenHash string) error {
+	_, err := d.exec("INSERT INTO password_resets (username, token_hash, created, expiry) values (?, ?, ?, ?)", reset.Username, tokenHash, reset.Created.UTC(), reset.Expiry.UTC())
+	return err
 }
 
-func (d *Database) ClearSession(username string, token string) {
-	d.sqldb.Exec("DELETE FROM sessions WHERE username = ? AND token = ?", username, token)
+func (d *sqlDatabase) GetPasswordReset(tokenHash string) (PasswordReset, error) {
+	var reset PasswordReset
+	err := d.queryRow("SELECT id, username, created, expiry FROM password_resets WHERE token_hash = ?", tokenHash).Scan(&reset.Id, &reset.Username, &reset.Created, &reset.Expiry)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PasswordReset{}, errors.New("no password reset with that token")
+	}
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return reset, nil
 }
 
-func (d *Database) SetUserIsAdmin(username string, isAdmin bool) {
-	d.sqldb.Exec("UPDATE users SET is_admin = ? WHERE username = ?", isAdmin, username)
+// When the most recent reset link was sent to a user, or zero if there are none outstanding.
+func (d *sqlDatabase) GetLastPasswordReset(username string) (time.Time, error) {
+	var created sql.NullTime
+	err := d.queryRow("SELECT created FROM password_resets WHERE username = ? ORDER BY created DESC LIMIT 1", username).Scan(&created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return created.Time, err
 }
 
-func (d *Database) CreateUser(user User) error {
-	_, err := d.sqldb.Exec("INSERT INTO users (username, password_hash, is_admin) values (?, ?, ?)", user.Username, user.PasswordHash, user.IsAdmin)
+// Set a new password using a reset, then remove every reset and login the user has so that neither an old
+// link nor an old session still works. Returns false, changing nothing, if the reset was already used.
+func (d *sqlDatabase) UsePasswordReset(reset PasswordReset, passwordHash string) (bool, error) {
+	tx, err := d.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	// Whoever deletes the reset gets to use it, so the same link can't be used twice at once
+	res, err := tx.Exec("DELETE FROM password_resets WHERE id = ?", reset.Id)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE username = ?", passwordHash, reset.Username); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM password_resets WHERE username = ?", reset.Username); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE username = ?", reset.Username); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (d *sqlDatabase) SetUserPassword(username string, passwordHash string) error {
+	_, err := d.exec("UPDATE users SET password_hash = ? WHERE username = ?", passwordHash, username)
 	return err
 }
 
-func (d *Database) DeleteUser(username string) error {
-	_, err := d.sqldb.Exec("DELETE FROM users WHERE username = ?", username)
+func (d *sqlDatabase) ClearOtherSessions(username string, token string) error {
+	_, err := d.exec("DELETE FROM sessions WHERE username = ? AND token != ?", username, token)
 	return err
 }
 
-func (d *Database) CreatePlaylist(playlist Playlist) int {
-	var id int
-	tx, _ := d.sqldb.Begin()
-	_, err := tx.Exec("INSERT INTO playlists (enabled, name, start_time) values (?, ?, ?)", playlist.Enabled, playlist.Name, playlist.StartTime)
+func (d *sqlDatabase) ClearSession(username string, token string) error {
+	_, err := d.exec("DELETE FROM sessions WHERE username = ? AND token = ?", username, token)
+	return err
+}
+
+// The is_admin column is kept up to date so that the database still works with older versions.
+func (d *sqlDatabase) SetUserRoles(username string, roles []string) error {
+	_, err := d.exec("UPDATE users SET roles = ?, is_admin = ? WHERE username = ?", strings.Join(roles, ","), User{Roles: roles}.IsAdmin(), username)
+	return err
+}
+
+func (d *sqlDatabase) GetUserByOidcSubject(subject string) (User, error) {
+	if subject == "" {
+		return User{}, errors.New("no user with that subject")
+	}
+	user, err := scanUser(d.queryRow("SELECT "+userColumns+" FROM users WHERE oidc_subject = ?", subject))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("no user with that subject")
+	}
 	if err != nil {
-		log.Fatal(err)
+		return User{}, err
 	}
-	err = tx.QueryRow("SELECT last_insert_rowid()").Scan(&id)
+	return user, nil
+}
+
+func (d *sqlDatabase) SetUserOidcSubject(username string, subject string) error {
+	_, err := d.exec("UPDATE users SET oidc_subject = ? WHERE username = ?", subject, username)
+	return err
+}
+
+// Record the number of consecutive failed logins for a user and when any lockout ends.
+func (d *sqlDatabase) SetLoginFailures(username string, count int, lockedUntil time.Time) error {
+	_, err := d.exec("UPDATE users SET failed_logins = ?, locked_until = ? WHERE username = ?", count, nullTime(lockedUntil), username)
+	return err
+}
+
+func (d *sqlDatabase) CreateUser(user User) error {
+	_, err := d.exec("INSERT INTO users (username, password_hash, is_admin, roles) values (?, ?, ?, ?)", user.Username, user.PasswordHash, user.IsAdmin(), strings.Join(user.Roles, ","))
+	return err
+}
+
+func (d *sqlDatabase) DeleteUser(username string) error {
+	_, err := d.exec("DELETE FROM users WHERE username = ?", username)
+	return err
+}
+
+// Create a playlist, or update it if it has an Id, and replace its entries. Returns the playlist's Id.
+func (d *sqlDatabase) SavePlaylist(playlist Playlist, entries []PlaylistEntry) (int, error) {
+	ids, err := d.SavePlaylists([]PlaylistWithEntries{{Playlist: playlist, Entries: entries}})
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	err = tx.Commit()
+	return ids[0], nil
+}
+
+// Save several playlists in one transaction, so that either all of them change or none do.
+func (d *sqlDatabase) SavePlaylists(p []PlaylistWithEntries) ([]int, error) {
+	tx, err := d.begin()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return id
+	defer tx.Rollback()
+	ids := make([]int, 0)
+	for _, v := range p {
+		id, err := savePlaylist(tx, v.Playlist, v.Entries)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, tx.Commit()
 }
 
-func (d *Database) DeletePlaylist(playlistId int) {
-	d.sqldb.Exec("DELETE FROM playlists WHERE id = ?", playlistId)
+func savePlaylist(tx *dbTx, playlist Playlist, entries []PlaylistEntry) (int, error) {
+	id := playlist.Id
+	if id == 0 {
+		err := tx.QueryRow("INSERT INTO playlists (enabled, name, start_time) values (?, ?, ?) RETURNING id", playlist.Enabled, playlist.Name, playlist.StartTime).Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		res, err := tx.Exec("UPDATE playlists SET enabled = ?, name = ?, start_time = ? WHERE id = ?", playlist.Enabled, playlist.Name, playlist.StartTime, id)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return 0, sql.ErrNoRows
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM playlist_entries WHERE playlist_id = ?", id); err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		_, err := tx.Exec("INSERT INTO playlist_entries (playlist_id, position, filename, file_version, delay_seconds, is_relative) values (?, ?, ?, ?, ?, ?)", id, e.Position, e.Filename, e.FileVersion, e.DelaySeconds, e.IsRelative)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+func (d *sqlDatabase) DeletePlaylist(playlistId int) error {
+	_, err := d.exec("DELETE FROM playlists WHERE id = ?", playlistId)
+	return err
 }
 
-func (d *Database) GetPlaylists() []Playlist {
+func (d *sqlDatabase) GetPlaylists() ([]Playlist, error) {
 	ret := make([]Playlist, 0)
-	rows, err := d.sqldb.Query("SELECT id, enabled, name, start_time FROM playlists ORDER BY start_time DESC")
+	rows, err := d.query("SELECT id, enabled, name, start_time FROM playlists ORDER BY start_time DESC")
 	if err != nil {
-		return ret
+		return ret, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var p Playlist
 		if err := rows.Scan(&p.Id, &p.Enabled, &p.Name, &p.StartTime); err != nil {
-			return ret
+			return ret, err
 		}
 		ret = append(ret, p)
 	}
-	return ret
+	return ret, rows.Err()
 }
 
-func (d *Database) GetPlaylist(playlistId int) (Playlist, error) {
+func (d *sqlDatabase) GetPlaylist(playlistId int) (Playlist, error) {
 	var p Playlist
-	err := d.sqldb.QueryRow("SELECT id, enabled, name, start_time FROM playlists WHERE id = ?", playlistId).Scan(&p.Id, &p.Enabled, &p.Name, &p.StartTime)
+	err := d.queryRow("SELECT id, enabled, name, start_time FROM playlists WHERE id = ?", playlistId).Scan(&p.Id, &p.Enabled, &p.Name, &p.StartTime)
 	if err != nil {
 		return p, err
 	}
 	return p, nil
 }
 
-func (d *Database) UpdatePlaylist(playlist Playlist) {
-	d.sqldb.Exec("UPDATE playlists SET enabled = ?, name = ?, start_time = ? WHERE id = ?", playlist.Enabled, playlist.Name, playlist.StartTime, playlist.Id)
+func (d *sqlDatabase) GetEntriesForPlaylist(playlistId int) ([]PlaylistEntry, error) {
+	ret := make([]PlaylistEntry, 0)
+	rows, err := d.query("SELECT id, position, filename, file_version, delay_seconds, is_relative FROM playlist_entries WHERE playlist_id = ? ORDER by position ASC", playlistId)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry PlaylistEntry
+		if err := rows.Scan(&entry.Id, &entry.Position, &entry.Filename, &entry.FileVersion, &entry.DelaySeconds, &entry.IsRelative); err != nil {
+			return ret, err
+		}
+		ret = append(ret, entry)
+	}
+	return ret, rows.Err()
 }
 
-func (d *Database) SetEntriesForPlaylist(entries []PlaylistEntry, playlistId int) {
-	tx, _ := d.sqldb.Begin()
-	_, err := tx.Exec("DELETE FROM playlist_entries WHERE playlist_id = ?", playlistId)
-	for _, e := range entries {
-		_, err = tx.Exec("INSERT INTO playlist_entries (playlist_id, position, filename, delay_seconds, is_relative) values (?, ?, ?, ?, ?)", playlistId, e.Position, e.Filename, e.DelaySeconds, e.IsRelative)
+// Names of the playlists with an entry pinned to an earlier version of the file.
+func (d *sqlDatabase) GetPlaylistsPinningFile(filename string) ([]string, error) {
+	ret := make([]string, 0)
+	rows, err := d.query("SELECT DISTINCT p.name FROM playlists p JOIN playlist_entries e ON e.playlist_id = p.id WHERE e.filename = ? AND e.file_version > 0 ORDER BY p.name", filename)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return ret, err
+		}
+		ret = append(ret, name)
+	}
+	return ret, rows.Err()
+}
+
+const radioColumns = "id, name, token_hash, previous_token_expiry, last_seen, last_seen_ip, cert_fingerprint, cert_expiry"
+
+func scanRadio(row interface{ Scan(...any) error }) (Radio, error) {
+	var r Radio
+	var tokenHash string
+	var previousExpiry, lastSeen, certExpiry sql.NullTime
+	err := row.Scan(&r.Id, &r.Name, &tokenHash, &previousExpiry, &lastSeen, &r.LastSeenIP, &r.CertFingerprint, &certExpiry)
+	r.HasToken = tokenHash != ""
+	r.CertExpiry = certExpiry.Time
+	// Once the overlap is over the previous token is as good as gone
+	if previousExpiry.Valid && previousExpiry.Time.After(time.Now()) {
+		r.PreviousTokenExpiry = previousExpiry.Time
+	}
+	r.LastSeen = lastSeen.Time
+	return r, err
+}
+
+func (d *sqlDatabase) GetRadio(radioId int) (Radio, error) {
+	return scanRadio(d.queryRow("SELECT "+radioColumns+" FROM radios WHERE id = ?", radioId))
+}
+
+// The radio that a token belongs to, whether it is the radio's current token or a previous one that still works.
+func (d *sqlDatabase) GetRadioByTokenHash(tokenHash string) (Radio, error) {
+	return scanRadio(d.queryRow("SELECT "+radioColumns+" FROM radios WHERE token_hash = ? OR (previous_token_hash = ? AND previous_token_expiry > ?)",
+		tokenHash, tokenHash, time.Now().UTC()))
+}
+
+// The radio that was issued the client certificate with this fingerprint.
+func (d *sqlDatabase) GetRadioByCertificate(fingerprint string) (Radio, error) {
+	return scanRadio(d.queryRow("SELECT "+radioColumns+" FROM radios WHERE cert_fingerprint = ?", fingerprint))
+}
+
+func (d *sqlDatabase) GetRadios() ([]Radio, error) {
+	ret := make([]Radio, 0)
+	rows, err := d.query("SELECT " + radioColumns + " FROM radios ORDER BY id ASC")
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r, err := scanRadio(rows)
 		if err != nil {
-			log.Fatal(err)
+			return ret, err
 		}
+		ret = append(ret, r)
 	}
-	tx.Commit() // ignore errors
+	return ret, rows.Err()
 }
 
-func (d *Database) GetEntriesForPlaylist(playlistId int) []PlaylistEntry {
-	ret := make([]PlaylistEntry, 0)
-	rows, err := d.sqldb.Query("SELECT id, position, filename, delay_seconds, is_relative FROM playlist_entries WHERE playlist_id = ? ORDER by position ASC", playlistId)
+func (d *sqlDatabase) DeleteRadio(radioId int) error {
+	_, err := d.exec("DELETE FROM radios WHERE id = ?", radioId)
+	return err
+}
+
+// Store a new radio along with the hash of its token. Returns the new radio's id.
+func (d *sqlDatabase) CreateRadio(radio Radio, tokenHash string) (int, error) {
+	var id int
+	err := d.queryRow("INSERT INTO radios (name, token, token_hash) values (?, '', ?) RETURNING id", radio.Name, tokenHash).Scan(&id)
+	return id, err
+}
+
+// Change a radio's name. Its token is changed with RotateRadioToken.
+func (d *sqlDatabase) UpdateRadio(radio Radio) error {
+	_, err := d.exec("UPDATE radios SET name = ? WHERE id = ?", radio.Name, radio.Id)
+	return err
+}
+
+// Give a radio a new token. Its current token keeps working until previousExpiry, or stops working
+// straight away if previousExpiry is zero.
+func (d *sqlDatabase) RotateRadioToken(radioId int, tokenHash string, previousExpiry time.Time) error {
+	if previousExpiry.IsZero() {
+		_, err := d.exec("UPDATE radios SET token_hash = ?, previous_token_hash = '', previous_token_expiry = NULL WHERE id = ?", tokenHash, radioId)
+		return err
+	}
+	_, err := d.exec("UPDATE radios SET previous_token_hash = token_hash, previous_token_expiry = ?, token_hash = ? WHERE id = ?", previousExpiry.UTC(), tokenHash, radioId)
+	return err
+}
+
+// Stop all of a radio's tokens from working. It can't connect again until it is given a new one.
+func (d *sqlDatabase) RevokeRadioTokens(radioId int) error {
+	_, err := d.exec("UPDATE radios SET token_hash = '', previous_token_hash = '', previous_token_expiry = NULL WHERE id = ?", radioId)
+	return err
+}
+
+func (d *sqlDatabase) SetRadioLastSeen(radioId int, lastSeen time.Time, ip string) error {
+	_, err := d.exec("UPDATE radios SET last_seen = ?, last_seen_ip = ? WHERE id = ?", lastSeen.UTC(), ip, radioId)
+	return err
+}
+
+// Record the client certificate a radio was issued, replacing any earlier one. An empty fingerprint
+// means the radio has no certificate.
+func (d *sqlDatabase) SetRadioCertificate(radioId int, fingerprint string, expiry time.Time) error {
+	if fingerprint == "" {
+		_, err := d.exec("UPDATE radios SET cert_fingerprint = '', cert_expiry = NULL WHERE id = ?", radioId)
+		return err
+	}
+	_, err := d.exec("UPDATE radios SET cert_fingerprint = ?, cert_expiry = ? WHERE id = ?", fingerprint, expiry.UTC(), radioId)
+	return err
+}
+
+func (d *sqlDatabase) CreateFileVersion(v FileVersion) error {
+	_, err := d.exec("INSERT INTO file_versions (filename, version, hash, size, uploaded, uploaded_by, restored_from) values (?, ?, ?, ?, ?, ?, ?)", v.Filename, v.Version, v.Hash, v.Size, v.Uploaded.UTC(), v.UploadedBy, v.RestoredFrom)
+	return err
+}
+
+// All stored versions of a file, newest first.
+func (d *sqlDatabase) GetFileVersions(filename string) ([]FileVersion, error) {
+	ret := make([]FileVersion, 0)
+	rows, err := d.query("SELECT id, filename, version, hash, size, uploaded, uploaded_by, restored_from FROM file_versions WHERE filename = ? ORDER BY version DESC", filename)
 	if err != nil {
-		return ret
+		return ret, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var entry PlaylistEntry
-		if err := rows.Scan(&entry.Id, &entry.Position, &entry.Filename, &entry.DelaySeconds, &entry.IsRelative); err != nil {
-			return ret
+		var v FileVersion
+		if err := rows.Scan(&v.Id, &v.Filename, &v.Version, &v.Hash, &v.Size, &v.Uploaded, &v.UploadedBy, &v.RestoredFrom); err != nil {
+			return ret, err
 		}
-		ret = append(ret, entry)
+		ret = append(ret, v)
 	}
-	return ret
+	return ret, rows.Err()
 }
 
-func (d *Database) GetRadio(radioId int) (Radio, error) {
-	var r Radio
-	err := d.sqldb.QueryRow("SELECT id, name, token FROM radios WHERE id = ?", radioId).Scan(&r.Id, &r.Name, &r.Token)
+func (d *sqlDatabase) GetFileVersion(filename string, version int) (FileVersion, error) {
+	var v FileVersion
+	err := d.queryRow("SELECT id, filename, version, hash, size, uploaded, uploaded_by, restored_from FROM file_versions WHERE filename = ? AND version = ?", filename, version).Scan(&v.Id, &v.Filename, &v.Version, &v.Hash, &v.Size, &v.Uploaded, &v.UploadedBy, &v.RestoredFrom)
+	return v, err
+}
+
+func (d *sqlDatabase) DeleteFileVersions(filename string) error {
+	_, err := d.exec("DELETE FROM file_versions WHERE filename = ?", filename)
+	return err
+}
+
+func (d *sqlDatabase) CreateApiToken(t ApiToken, tokenHash string) error {
+	_, err := d.exec("INSERT INTO api_tokens (username, name, token_hash, scope, created, expiry) values (?, ?, ?, ?, ?, ?)", t.Username, t.Name, tokenHash, t.Scope, t.Created.UTC(), nullTime(t.Expiry))
+	return err
+}
+
+const apiTokenColumns = "id, username, name, scope, created, expiry, last_used"
+
+func scanApiToken(row interface{ Scan(...any) error }) (ApiToken, error) {
+	var t ApiToken
+	var expiry, lastUsed sql.NullTime
+	err := row.Scan(&t.Id, &t.Username, &t.Name, &t.Scope, &t.Created, &expiry, &lastUsed)
+	t.Expiry = expiry.Time
+	t.LastUsed = lastUsed.Time
+	return t, err
+}
+
+func (d *sqlDatabase) GetApiTokenByHash(tokenHash string) (ApiToken, error) {
+	return scanApiToken(d.queryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_hash = ?", tokenHash))
+}
+
+func (d *sqlDatabase) GetApiToken(id int) (ApiToken, error) {
+	return scanApiToken(d.queryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE id = ?", id))
+}
+
+// API tokens belonging to a user, or to everybody if username is empty.
+func (d *sqlDatabase) GetApiTokens(username string) ([]ApiToken, error) {
+	ret := make([]ApiToken, 0)
+	rows, err := d.query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE ? = '' OR username = ? ORDER BY username ASC, created ASC", username, username)
 	if err != nil {
-		return r, err
+		return ret, err
 	}
-	return r, nil
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanApiToken(rows)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, t)
+	}
+	return ret, rows.Err()
 }
 
-func (d *Database) GetRadioByToken(token string) (Radio, error) {
-	var r Radio
-	err := d.sqldb.QueryRow("SELECT id, name, token FROM radios WHERE token = ?", token).Scan(&r.Id, &r.Name, &r.Token)
+func (d *sqlDatabase) SetApiTokenLastUsed(id int, lastUsed time.Time) error {
+	_, err := d.exec("UPDATE api_tokens SET last_used = ? WHERE id = ?", lastUsed.UTC(), id)
+	return err
+}
+
+func (d *sqlDatabase) DeleteApiToken(id int) error {
+	_, err := d.exec("DELETE FROM api_tokens WHERE id = ?", id)
+	return err
+}
+
+func (d *sqlDatabase) QueueCommand(c QueuedCommand) error {
+	_, err := d.exec("INSERT INTO queued_commands (action, radio_id, playlist_id, created, username) values (?, ?, ?, ?, ?)",
+		c.Action, c.RadioId, c.PlaylistId, c.Created.UTC(), c.Username)
+	return err
+}
+
+// Remove and return all queued commands, oldest first.
+func (d *sqlDatabase) TakeQueuedCommands() ([]QueuedCommand, error) {
+	ret := make([]QueuedCommand, 0)
+	rows, err := d.query("SELECT id, action, radio_id, playlist_id, created, username FROM queued_commands ORDER BY id ASC")
 	if err != nil {
-		return r, err
+		return ret, err
 	}
-	return r, nil
+	defer rows.Close()
+	for rows.Next() {
+		var c QueuedCommand
+		if err := rows.Scan(&c.Id, &c.Action, &c.RadioId, &c.PlaylistId, &c.Created, &c.Username); err != nil {
+			return ret, err
+		}
+		ret = append(ret, c)
+	}
+	if err := rows.Err(); err != nil || len(ret) == 0 {
+		return ret, err
+	}
+	// Commands queued since the select have higher ids, so they are left for next time
+	_, err = d.exec("DELETE FROM queued_commands WHERE id <= ?", ret[len(ret)-1].Id)
+	return ret, err
 }
 
-func (d *Database) GetRadios() []Radio {
-	ret := make([]Radio, 0)
-	rows, err := d.sqldb.Query("SELECT id, name, token FROM radios ORDER BY id ASC")
+func (d *sqlDatabase) InsertAuditEntry(e AuditEntry) error {
+	_, err := d.exec("INSERT INTO audit_log (time, username, action, target, details, ip) values (?, ?, ?, ?, ?, ?)",
+		e.Time.UTC(), e.Username, e.Action, e.Target, e.Details, e.IP)
+	return err
+}
+
+// Audit entries matching the filter, newest first.
+func (d *sqlDatabase) GetAuditEntries(f AuditFilter) ([]AuditEntry, error) {
+	ret := make([]AuditEntry, 0)
+	query := "SELECT id, time, username, action, target, details, ip FROM audit_log WHERE 1 = 1"
+	args := make([]any, 0)
+	if f.Username != "" {
+		query += " AND username = ?"
+		args = append(args, f.Username)
+	}
+	if f.Action != "" {
+		query += " AND (action = ? OR substr(action, 1, ?) = ?)"
+		args = append(args, f.Action, len(f.Action)+1, f.Action+".")
+	}
+	if f.Target != "" {
+		query += " AND lower(target) LIKE ? ESCAPE '\\'"
+		args = append(args, "%"+escapeLike(strings.ToLower(f.Target))+"%")
+	}
+	if !f.From.IsZero() {
+		query += " AND time >= ?"
+		args = append(args, f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		query += " AND time < ?"
+		args = append(args, f.To.UTC())
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	rows, err := d.query(query, args...)
 	if err != nil {
-		return ret
+		return ret, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var r Radio
-		if err := rows.Scan(&r.Id, &r.Name, &r.Token); err != nil {
-			return ret
+		var e AuditEntry
+		if err := rows.Scan(&e.Id, &e.Time, &e.Username, &e.Action, &e.Target, &e.Details, &e.IP); err != nil {
+			return ret, err
 		}
-		ret = append(ret, r)
+		ret = append(ret, e)
 	}
-	return ret
+	return ret, rows.Err()
+}
+
+// Match special characters in a LIKE pattern literally, using \ as the escape character.
+func escapeLike(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(s)
+}
+
+// Store the zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
 }
 
-func (d *Database) DeleteRadio(radioId int) {
-	d.sqldb.Exec("DELETE FROM radios WHERE id = ?", radioId)
+// Turn on two-factor authentication for a user, replacing any recovery codes they had.
+func (d *sqlDatabase) EnableTwoFactor(username string, secret string, recoveryCodeHashes []string) error {
+	tx, err := d.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE username = ?", secret, username); err != nil {
+		return err
+	}
+	if err := setRecoveryCodes(tx, username, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (d *Database) CreateRadio(radio Radio) {
-	d.sqldb.Exec("INSERT INTO radios (name, token) values (?, ?)", radio.Name, radio.Token)
+func (d *sqlDatabase) DisableTwoFactor(username string) error {
+	tx, err := d.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE users SET totp_secret = '', totp_last_step = 0 WHERE username = ?", username); err != nil {
+		return err
+	}
+	if err := setRecoveryCodes(tx, username, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (d *Database) UpdateRadio(radio Radio) {
-	d.sqldb.Exec("UPDATE radios SET name = ?, token = ? WHERE id = ?", radio.Name, radio.Token, radio.Id)
+func (d *sqlDatabase) SetRecoveryCodes(username string, codeHashes []string) error {
+	tx, err := d.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := setRecoveryCodes(tx, username, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func setRecoveryCodes(tx *dbTx, username string, codeHashes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE username = ?", username); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (username, code_hash) values (?, ?)", username, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete a recovery code so it can't be used again, reporting whether it existed.
+func (d *sqlDatabase) UseRecoveryCode(username string, codeHash string) (bool, error) {
+	res, err := d.exec("DELETE FROM recovery_codes WHERE username = ? AND code_hash = ?", username, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (d *sqlDatabase) CountRecoveryCodes(username string) (int, error) {
+	var count int
+	err := d.queryRow("SELECT COUNT(*) FROM recovery_codes WHERE username = ?", username).Scan(&count)
+	return count, err
+}
+
+// Record the time step of a TOTP code that has been accepted. Fails if that step or a later one was
+// already used, so that each code only works once.
+func (d *sqlDatabase) UseTotpStep(username string, step int64) (bool, error) {
+	res, err := d.exec("UPDATE users SET totp_last_step = ? WHERE username = ? AND totp_last_step < ?", step, username, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+var ErrBackupNotSupported = errors.New("backups are not supported for this database")
+
+// The differences between the database servers that broadcaster-server can use. Queries are written with
+// ? placeholders and in SQL that both understand; the dialect handles everything else.
+type dialect interface {
+	open() (*sql.DB, error)
+	// Rewrite a query written with ? placeholders for this database
+	rebind(query string) string
+	// Rewrite the arguments of a query for this database
+	convertArgs(args []any) []any
+	// Rewrite CREATE TABLE and ALTER TABLE statements written for SQLite
+	translateSchema(stmt string) string
+	// Query taking a table name that counts how many such tables exist, or all tables if the name is empty
+	countTablesQuery() string
+	// Query taking a table and column name that counts how many such columns exist
+	countColumnsQuery() string
+	// Write a consistent copy of the database to a file
+	backup(d *sqlDatabase, path string) error
+}
+
+func newDialect(c ServerConfig) dialect {
+	if c.DatabaseType == "postgres" {
+		return postgresDialect{url: c.PostgresURL}
+	}
+	return sqliteDialect{path: c.SqliteDB}
+}
+
+type sqliteDialect struct {
+	path string
+}
+
+func (s sqliteDialect) open() (*sql.DB, error) {
+	// Store times in a format SQLite itself understands so that they can be compared in queries
+	sqldb, err := sql.Open("sqlite", "file:"+s.path+"?_time_format=sqlite")
+	if err != nil {
+		return nil, err
+	}
+	for _, pragma := range []string{"PRAGMA journal_mode = WAL", "PRAGMA foreign_keys = ON", "PRAGMA busy_timeout = 5000"} {
+		if _, err := sqldb.Exec(pragma); err != nil {
+			return nil, err
+		}
+	}
+	return sqldb, nil
+}
+
+func (s sqliteDialect) rebind(query string) string {
+	return query
+}
+
+func (s sqliteDialect) convertArgs(args []any) []any {
+	return args
+}
+
+func (s sqliteDialect) translateSchema(stmt string) string {
+	return stmt
+}
+
+func (s sqliteDialect) countTablesQuery() string {
+	return "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'sqlite_sequence' AND (? = '' OR name = ?)"
+}
+
+func (s sqliteDialect) countColumnsQuery() string {
+	return "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+}
+
+func (s sqliteDialect) backup(d *sqlDatabase, path string) error {
+	_, err := d.exec("VACUUM INTO ?", path)
+	return err
+}
+
+type postgresDialect struct {
+	url string
+}
+
+func (p postgresDialect) open() (*sql.DB, error) {
+	sqldb, err := sql.Open("postgres", p.url)
+	if err != nil {
+		return nil, err
+	}
+	return sqldb, sqldb.Ping()
+}
+
+// Replace each ? outside a string literal with $1, $2 and so on.
+func (p postgresDialect) rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	inString := false
+	for _, c := range query {
+		if c == '\'' {
+			inString = !inString
+		}
+		if c == '?' && !inString {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// Flags are stored in INTEGER columns, which Postgres won't accept a boolean for.
+func (p postgresDialect) convertArgs(args []any) []any {
+	ret := make([]any, len(args))
+	for i, a := range args {
+		if b, ok := a.(bool); ok {
+			if b {
+				a = 1
+			} else {
+				a = 0
+			}
+		}
+		ret[i] = a
+	}
+	return ret
+}
+
+var (
+	autoIncrementPattern = regexp.MustCompile(`\bINTEGER PRIMARY KEY AUTOINCREMENT\b`)
+	integerPattern       = regexp.MustCompile(`\bINTEGER\b`)
+	timestampPattern     = regexp.MustCompile(`\bTIMESTAMP\b`)
+)
+
+// SQLite integers are 64 bits and its timestamps are stored in UTC, so use the Postgres types that match.
+func (p postgresDialect) translateSchema(stmt string) string {
+	stmt = autoIncrementPattern.ReplaceAllString(stmt, "BIGSERIAL PRIMARY KEY")
+	stmt = integerPattern.ReplaceAllString(stmt, "BIGINT")
+	return timestampPattern.ReplaceAllString(stmt, "TIMESTAMPTZ")
+}
+
+func (p postgresDialect) countTablesQuery() string {
+	return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND (? = '' OR table_name = ?)"
+}
+
+func (p postgresDialect) countColumnsQuery() string {
+	return "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?"
+}
+
+// Use pg_dump instead.
+func (p postgresDialect) backup(d *sqlDatabase, path string) error {
+	return ErrBackupNotSupported
+}
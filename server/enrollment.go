@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.octet-stream.net/broadcaster/internal/protocol"
+	"golang.org/x/net/websocket"
+)
+
+// Letters and digits that can't be mistaken for each other when read off a screen or log
+const pairingCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const pairingCodeLength = 8
+
+// A radio waiting for approval is sent away after this long. It will ask again with a new pairing code.
+const enrollmentTimeout = time.Hour
+
+// Limits how many unapproved radios can be waiting at once, since anybody can ask to be enrolled
+const maxPendingEnrollments = 20
+
+var ErrTooManyEnrollments = errors.New("too many radios are already waiting to be enrolled")
+var ErrUnknownPairingCode = errors.New("no radio is waiting with that pairing code")
+var ErrEnrollmentGone = errors.New("the radio stopped waiting before it could be enrolled")
+
+// A radio without a token that has connected and is waiting for an operator to approve it.
+// Nothing is stored in the database until it is approved.
+type PendingEnrollment struct {
+	Id        int
+	Hostname  string
+	IP        string
+	Requested time.Time
+	code      string
+	approved  chan enrollmentApproval
+	rejected  chan bool
+	done      chan bool
+}
+
+// Passed from the operator approving a radio to the connection it is waiting on, which registers the radio
+// only once it knows the radio is still there and reports back how that went.
+type enrollmentApproval struct {
+	name   string
+	result chan enrollmentResult
+}
+
+type enrollmentResult struct {
+	radio Radio
+	err   error
+}
+
+type Enrollments struct {
+	mutex   sync.Mutex
+	nextId  int
+	pending map[int]*PendingEnrollment
+}
+
+var enrollments Enrollments
+
+func InitEnrollments() {
+	enrollments.pending = make(map[int]*PendingEnrollment)
+}
+
+func generatePairingCode() (string, error) {
+	code := make([]byte, pairingCodeLength)
+	max := big.NewInt(int64(len(pairingCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = pairingCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// Show a pairing code in two halves so it's easier to read out and type.
+func formatPairingCode(code string) string {
+	return code[:pairingCodeLength/2] + "-" + code[pairingCodeLength/2:]
+}
+
+// Accept a pairing code however the operator typed it.
+func normalizePairingCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(strings.TrimSpace(code)))
+}
+
+func (e *Enrollments) Add(hostname string, ip string) (*PendingEnrollment, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if len(e.pending) >= maxPendingEnrollments {
+		return nil, ErrTooManyEnrollments
+	}
+	var code string
+	for {
+		c, err := generatePairingCode()
+		if err != nil {
+			return nil, err
+		}
+		if e.findLocked(c) == nil {
+			code = c
+			break
+		}
+	}
+	e.nextId++
+	p := &PendingEnrollment{
+		Id:        e.nextId,
+		Hostname:  hostname,
+		IP:        ip,
+		Requested: time.Now(),
+		code:      code,
+		approved:  make(chan enrollmentApproval),
+		rejected:  make(chan bool),
+		done:      make(chan bool),
+	}
+	e.pending[p.Id] = p
+	return p, nil
+}
+
+func (e *Enrollments) findLocked(code string) *PendingEnrollment {
+	for _, p := range e.pending {
+		if p.code == code {
+			return p
+		}
+	}
+	return nil
+}
+
+func (e *Enrollments) Remove(p *PendingEnrollment) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.pending, p.Id)
+}
+
+// Radios waiting to be approved, oldest first.
+func (e *Enrollments) Pending() []PendingEnrollment {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	ret := make([]PendingEnrollment, 0)
+	for _, p := range e.pending {
+		ret = append(ret, *p)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	return ret
+}
+
+// Register the radio waiting with the pairing code and hand it a token. The radio is named after
+// its host name if no name is given. Nothing is registered if the radio has gone away in the meantime.
+// The radio stays in the pending list until its connection has dealt with the approval.
+func (e *Enrollments) Approve(code string, name string) (Radio, PendingEnrollment, error) {
+	e.mutex.Lock()
+	p := e.findLocked(normalizePairingCode(code))
+	if p == nil {
+		e.mutex.Unlock()
+		return Radio{}, PendingEnrollment{}, ErrUnknownPairingCode
+	}
+	e.mutex.Unlock()
+	if strings.TrimSpace(name) == "" {
+		name = p.Hostname
+	}
+	approval := enrollmentApproval{name: name, result: make(chan enrollmentResult, 1)}
+	select {
+	case p.approved <- approval:
+	case <-p.done:
+		return Radio{}, PendingEnrollment{}, ErrEnrollmentGone
+	}
+	result := <-approval.result
+	return result.radio, *p, result.err
+}
+
+func (e *Enrollments) Reject(id int) (PendingEnrollment, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	p, ok := e.pending[id]
+	if !ok {
+		return PendingEnrollment{}, false
+	}
+	delete(e.pending, p.Id)
+	close(p.rejected)
+	return *p, true
+}
+
+// Handle a radio that connected without a token: give it a pairing code and wait until it is approved,
+// rejected, gives up or times out. Once approved it must reconnect and authenticate with its new token.
+func enrollRadio(ws *websocket.Conn, msg protocol.EnrollMessage) {
+	ip := clientIP(ws.Request())
+	if !config.RadioEnrollment {
+		log.Println("Rejecting enrollment request from", ip, "as enrollment is turned off")
+		return
+	}
+	p, err := enrollments.Add(msg.Hostname, ip)
+	if err != nil {
+		log.Println("Rejecting enrollment request from", ip+":", err)
+		return
+	}
+	defer enrollments.Remove(p)
+	defer close(p.done)
+	log.Println("Radio", msg.Hostname, "at", ip, "is waiting to be enrolled")
+	codeMsg, _ := json.Marshal(protocol.PairingCodeMessage{
+		T:    protocol.PairingCodeType,
+		Code: formatPairingCode(p.code),
+	})
+	if _, err := ws.Write(codeMsg); err != nil {
+		return
+	}
+
+	// Nothing more is expected from the radio, but reading is how we find out that it has gone away
+	closed := make(chan bool)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := ws.Read(buf); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	timeout := time.After(enrollmentTimeout)
+	for {
+		select {
+		case approval := <-p.approved:
+			radio, err := completeEnrollment(ws, approval.name, closed)
+			approval.result <- enrollmentResult{radio: radio, err: err}
+			// If the radio couldn't be registered, e.g. because of the name, it can be approved again
+			if err == nil || errors.Is(err, ErrEnrollmentGone) {
+				return
+			}
+		case <-p.rejected:
+			return
+		case <-closed:
+			return
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// Register an approved radio and send it its token. If the radio can't be given the token it is removed
+// again, so that an operator never sees a radio that will never connect.
+func completeEnrollment(ws *websocket.Conn, name string, closed chan bool) (Radio, error) {
+	select {
+	case <-closed:
+		return Radio{}, ErrEnrollmentGone
+	default:
+	}
+	radio, token, err := createRadio(name)
+	if err != nil {
+		return Radio{}, err
+	}
+	enrolledMsg, _ := json.Marshal(protocol.EnrolledMessage{
+		T:     protocol.EnrolledType,
+		Name:  radio.Name,
+		Token: token,
+	})
+	if _, err := ws.Write(enrolledMsg); err != nil {
+		log.Println("Couldn't send token to newly enrolled radio", radio.Name, err)
+		if err := db.DeleteRadio(radio.Id); err != nil {
+			log.Println("Couldn't remove radio", radio.Name, "after failed enrollment:", err)
+		}
+		return Radio{}, ErrEnrollmentGone
+	}
+	return radio, nil
+}
+
+func approveEnrollment(w http.ResponseWriter, r *http.Request, user User) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	radio, p, err := enrollments.Approve(r.Form.Get("code"), r.Form.Get("name"))
+	if err != nil {
+		renderRadiosPage(w, user, "Could not enroll radio: "+err.Error())
+		return
+	}
+	recordAudit(r, user, AuditRadioEnroll, radio.Name, fmt.Sprintf("host %q at %s", p.Hostname, p.IP))
+	http.Redirect(w, r, "/radios/"+strconv.Itoa(radio.Id), http.StatusFound)
+}
+
+func rejectEnrollment(w http.ResponseWriter, r *http.Request, user User) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(r.Form.Get("enrollmentId"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if p, ok := enrollments.Reject(id); ok {
+		recordAudit(r, user, AuditRadioRejectEnroll, p.Hostname, "at "+p.IP)
+	}
+	http.Redirect(w, r, "/radios/", http.StatusFound)
+}
@@ -3,23 +3,37 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
+// Directory inside the audio files path where uploads are kept until they have been validated
+const stagingDir = ".staging"
+
+var ErrFileExists = errors.New("a file with that name already exists")
+var ErrInvalidFilename = errors.New("invalid filename")
+
 type FileSpec struct {
 	Name string
 	Hash string
+	Size int64
 }
 
 type AudioFiles struct {
-	path       string
-	list       []FileSpec
-	changeWait chan bool
-	filesMutex sync.Mutex
+	path        string
+	list        []FileSpec
+	changeWait  chan bool
+	filesMutex  sync.Mutex
+	importMutex sync.Mutex
 }
 
 var files AudioFiles
@@ -27,6 +41,12 @@ var files AudioFiles
 func InitAudioFiles(path string) {
 	files.changeWait = make(chan bool)
 	files.path = path
+	if err := os.MkdirAll(files.StagingPath(), 0750); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(path, versionsDir), 0750); err != nil {
+		log.Fatal(err)
+	}
 	files.Refresh()
 }
 
@@ -40,36 +60,150 @@ func (r *AudioFiles) Refresh() {
 	defer r.filesMutex.Unlock()
 	r.list = nil
 	for _, file := range entries {
-		f, err := os.Open(filepath.Join(r.path, file.Name()))
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		hash, size, err := hashFile(filepath.Join(r.path, file.Name()))
 		if err != nil {
 			log.Println("Couldn't open", file.Name())
 			return
 		}
-		hash := sha256.New()
-		io.Copy(hash, f)
-		r.list = append(r.list, FileSpec{Name: file.Name(), Hash: hex.EncodeToString(hash.Sum(nil))})
+		r.list = append(r.list, FileSpec{Name: file.Name(), Hash: hash, Size: size})
 	}
 	log.Println("Files updated", r.list)
 	close(files.changeWait)
 	files.changeWait = make(chan bool)
 }
 
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	return hex.EncodeToString(hash.Sum(nil)), size, err
+}
+
 func (r *AudioFiles) Path() string {
 	return r.path
 }
 
+func (r *AudioFiles) StagingPath() string {
+	return filepath.Join(r.path, stagingDir)
+}
+
+func isValidFilename(name string) bool {
+	return name != "." && name != string(filepath.Separator) && !strings.HasPrefix(name, ".")
+}
+
+// The name an uploaded file will have once it has been imported, which changes if it is transcoded.
+func importedName(filename string) string {
+	name := filepath.Base(filename)
+	if config.TranscodeUploads {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ".wav"
+	}
+	return name
+}
+
+func (r *AudioFiles) Exists(filename string) bool {
+	_, err := os.Stat(filepath.Join(r.path, filepath.Base(filename)))
+	return err == nil
+}
+
+// Validate a file uploaded to the staging area and move it into place under the given filename.
+// If transcoding is enabled the file is converted first, which changes its extension to .wav.
+// The staged file is always removed. Returns the final filename.
+func (r *AudioFiles) Import(stagedPath string, filename string, overwrite bool, uploadedBy string) (string, error) {
+	defer os.Remove(stagedPath)
+	name := filepath.Base(filename)
+	if !isValidFilename(name) {
+		return "", ErrInvalidFilename
+	}
+	if err := validateAudio(stagedPath, name); err != nil {
+		return name, err
+	}
+	if config.TranscodeUploads {
+		transcoded := stagedPath + ".wav"
+		defer os.Remove(transcoded)
+		if err := transcodeAudio(stagedPath, name, transcoded, config.TranscodeSampleRate); err != nil {
+			return name, fmt.Errorf("transcoding failed: %w", err)
+		}
+		stagedPath = transcoded
+	}
+	name = importedName(name)
+	dest := filepath.Join(r.path, name)
+	if err := os.Chmod(stagedPath, 0644); err != nil {
+		return name, err
+	}
+	r.importMutex.Lock()
+	defer r.importMutex.Unlock()
+	if overwrite {
+		if err := r.snapshotUnversioned(name); err != nil {
+			return name, err
+		}
+		if err := os.Rename(stagedPath, dest); err != nil {
+			return name, err
+		}
+	} else {
+		// Linking fails if the destination exists, so there is no window for two uploads to clobber each other
+		if err := os.Link(stagedPath, dest); err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				return name, ErrFileExists
+			}
+			return name, err
+		}
+	}
+	log.Println("Uploaded file to", dest)
+	if err := r.recordVersion(name, uploadedBy, 0, time.Now()); err != nil {
+		log.Println("Couldn't add upload to version history:", err)
+	}
+	r.Refresh()
+	return name, nil
+}
+
 func (r *AudioFiles) Files() []FileSpec {
 	r.filesMutex.Lock()
 	defer r.filesMutex.Unlock()
 	return r.list
 }
 
-func (r *AudioFiles) Delete(filename string) {
-	path := filepath.Join(r.path, filepath.Base(filename))
-	if filepath.Clean(r.path) != filepath.Clean(path) {
-		os.Remove(path)
-		r.Refresh()
+// Returned when deleting a file that playlists have pinned to one of its earlier versions, since deleting
+// the file deletes those versions too.
+type FileInUseError struct {
+	Playlists []string
+}
+
+func (e FileInUseError) Error() string {
+	return "the file's earlier versions are pinned by playlists: " + strings.Join(e.Playlists, ", ")
+}
+
+// Delete a file along with its version history. Refuses if a playlist is pinned to one of its versions.
+func (r *AudioFiles) Delete(filename string) error {
+	name := filepath.Base(filename)
+	path := filepath.Join(r.path, name)
+	if filepath.Clean(r.path) == filepath.Clean(path) || strings.HasPrefix(name, ".") {
+		return ErrInvalidFilename
+	}
+	// Wait for any backup in progress so that it sees the file and its history together
+	r.importMutex.Lock()
+	defer r.importMutex.Unlock()
+	pinned, err := db.GetPlaylistsPinningFile(name)
+	if err != nil {
+		return err
+	}
+	if len(pinned) > 0 {
+		return FileInUseError{Playlists: pinned}
 	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	defer r.Refresh()
+	if err := os.RemoveAll(filepath.Join(r.path, versionsDir, name)); err != nil {
+		return err
+	}
+	return db.DeleteFileVersions(name)
 }
 
 func (r *AudioFiles) WatchForChanges() ([]FileSpec, chan bool) {
@@ -77,3 +211,50 @@ func (r *AudioFiles) WatchForChanges() ([]FileSpec, chan bool) {
 	defer r.filesMutex.Unlock()
 	return r.list, r.changeWait
 }
+
+// Serves the audio files publicly, hiding the staging area and any other dotfiles.
+type publicAudioFileSystem struct {
+	http.FileSystem
+}
+
+type publicAudioFile struct {
+	http.File
+}
+
+func hasDotComponent(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p publicAudioFileSystem) Open(name string) (http.File, error) {
+	if hasDotComponent(name) {
+		return nil, fs.ErrNotExist
+	}
+	f, err := p.FileSystem.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Perhaps it's a pinned version of a file
+		filename, version := resolveFileRef(strings.TrimPrefix(name, "/"))
+		if version != 0 {
+			return os.Open(files.VersionPath(filename, version))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return publicAudioFile{f}, nil
+}
+
+func (f publicAudioFile) Readdir(n int) ([]fs.FileInfo, error) {
+	entries, err := f.File.Readdir(n)
+	visible := make([]fs.FileInfo, 0)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") {
+			visible = append(visible, e)
+		}
+	}
+	return visible, err
+}
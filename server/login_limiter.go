@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed logins allowed from one address or for one username before attempts are slowed down
+const freeLoginFailures = 3
+
+const loginBackoffBase = time.Second
+
+const maxLoginBackoff = 15 * time.Minute
+
+// Failures are forgotten once there have been none for this long
+const loginFailureMemory = time.Hour
+
+type loginFailures struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+// Slows down password guessing by making each address and username wait longer after every failed login.
+// This is kept in memory; lockouts that survive a restart are recorded against the user in the database.
+type LoginLimiter struct {
+	mutex    sync.Mutex
+	failures map[string]*loginFailures
+}
+
+// An address that is currently waiting before it may try to log in again.
+type BlockedAddress struct {
+	Address      string
+	Failures     int
+	BlockedUntil time.Time
+}
+
+var loginLimiter = LoginLimiter{failures: make(map[string]*loginFailures)}
+
+func loginBackoff(failures int) time.Duration {
+	if failures <= freeLoginFailures {
+		return 0
+	}
+	delay := loginBackoffBase
+	for i := freeLoginFailures + 1; i < failures && delay < maxLoginBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxLoginBackoff)
+}
+
+func limiterKeys(ip string, username string) []string {
+	return []string{"ip:" + ip, "user:" + strings.ToLower(username)}
+}
+
+func (l *LoginLimiter) forgetStale() {
+	for k, f := range l.failures {
+		if time.Since(f.last) > loginFailureMemory && time.Now().After(f.blockedUntil) {
+			delete(l.failures, k)
+		}
+	}
+}
+
+// How long this address or username must wait before another login attempt will be considered.
+func (l *LoginLimiter) Wait(ip string, username string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.forgetStale()
+	var wait time.Duration
+	for _, k := range limiterKeys(ip, username) {
+		if f, ok := l.failures[k]; ok {
+			wait = max(wait, time.Until(f.blockedUntil))
+		}
+	}
+	return wait
+}
+
+func (l *LoginLimiter) RecordFailure(ip string, username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, k := range limiterKeys(ip, username) {
+		f, ok := l.failures[k]
+		if !ok {
+			f = &loginFailures{}
+			l.failures[k] = f
+		}
+		f.count++
+		f.last = time.Now()
+		f.blockedUntil = f.last.Add(loginBackoff(f.count))
+	}
+}
+
+// A successful login clears the username's failures but not the address's, so that an attacker
+// who knows one password can't use it to keep guessing others.
+func (l *LoginLimiter) RecordSuccess(username string) {
+	l.Forget("user:" + strings.ToLower(username))
+}
+
+func (l *LoginLimiter) Forget(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.failures, key)
+}
+
+func (l *LoginLimiter) BlockedAddresses() []BlockedAddress {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	ret := make([]BlockedAddress, 0)
+	for k, f := range l.failures {
+		if addr, ok := strings.CutPrefix(k, "ip:"); ok && time.Now().Before(f.blockedUntil) {
+			ret = append(ret, BlockedAddress{Address: addr, Failures: f.count, BlockedUntil: f.blockedUntil})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Address < ret[j].Address
+	})
+	return ret
+}
+
+// The address a request came from. Behind a reverse proxy this is only meaningful if the proxy
+// adds X-Forwarded-For and TrustForwardedFor is enabled.
+func clientIP(r *http.Request) string {
+	if config.TrustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			// The proxy appends the address it saw, so the last entry is the one that can be trusted
+			parts := strings.Split(fwd, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func unlockUser(w http.ResponseWriter, r *http.Request, currentUser User) {
+	r.ParseForm()
+	id, err := strconv.Atoi(r.Form.Get("userId"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	user, err := db.GetUserById(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := users.Unlock(user.Username); err != nil {
+		log.Println("Couldn't unlock", user.Username, err)
+		http.Error(w, "Could not unlock account", http.StatusInternalServerError)
+		return
+	}
+	loginLimiter.RecordSuccess(user.Username)
+	log.Println("Account unlocked:", user.Username)
+	recordAudit(r, currentUser, AuditUserUnlock, user.Username, "")
+	http.Redirect(w, r, "/users/", http.StatusFound)
+}
+
+func unblockAddress(w http.ResponseWriter, r *http.Request, user User) {
+	r.ParseForm()
+	address := r.Form.Get("address")
+	loginLimiter.Forget("ip:" + address)
+	log.Println("Login address unblocked:", address)
+	recordAudit(r, user, AuditAddressUnblock, address, "")
+	http.Redirect(w, r, "/users/", http.StatusFound)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings for the mail server used to send password reset emails.
+type SMTPConfig struct {
+	// Sending email is turned on by setting a host
+	Host string
+	Port int
+	// Leave empty if the mail server doesn't need a login. A password is only sent over an encrypted
+	// connection, unless the mail server is on the same host.
+	Username string
+	Password string
+	// Address that emails are sent from, e.g. "Broadcaster <broadcaster@example.com>"
+	From string
+}
+
+func NewSMTPConfig() SMTPConfig {
+	return SMTPConfig{
+		Port: 587,
+	}
+}
+
+func (c SMTPConfig) Enabled() bool {
+	return c.Host != ""
+}
+
+func (c SMTPConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Port <= 0 {
+		return errors.New("SMTP Port must be greater than zero")
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return errors.New("SMTP configuration must provide a valid From address")
+	}
+	return nil
+}
+
+// Check that an email address entered by a user is a single plain address.
+func validateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("invalid email address")
+	}
+	return nil
+}
+
+// Send a plain text email. STARTTLS is used whenever the mail server offers it.
+func sendMail(to string, subject string, body string) error {
+	from, err := mail.ParseAddress(config.SMTP.From)
+	if err != nil {
+		return err
+	}
+	if err := validateEmail(to); err != nil || to == "" {
+		return errors.New("invalid recipient address")
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if config.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", config.SMTP.Username, config.SMTP.Password, config.SMTP.Host)
+	}
+	addr := net.JoinHostPort(config.SMTP.Host, strconv.Itoa(config.SMTP.Port))
+	return smtp.SendMail(addr, auth, from.Address, []string{to}, []byte(msg.String()))
+}
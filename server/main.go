@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"embed"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -10,9 +10,10 @@ import (
 	"io/fs"
 	"log"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -38,6 +39,9 @@ func main() {
 	configFlag := flag.String("c", "", "path to configuration file")
 	addUserFlag := flag.Bool("a", false, "interactively add an admin user then exit")
 	versionFlag := flag.Bool("v", false, "print version then exit")
+	migrateOnlyFlag := flag.Bool("migrate-only", false, "apply any database migrations then exit")
+	dryRunFlag := flag.Bool("dry-run", false, "print the database migrations that would be applied then exit")
+	flag.Usage = printUsage
 	flag.Parse()
 
 	if *versionFlag {
@@ -49,42 +53,90 @@ func main() {
 	}
 	config.LoadFromFile(*configFlag)
 
+	// Restoring replaces the database, so it happens before anything opens it
+	if flag.Arg(0) == "restore" {
+		runRestoreCommand(flag.Arg(1))
+		os.Exit(0)
+	}
+
 	InitDatabase()
 	defer db.CloseDatabase()
+	if *dryRunFlag {
+		if err := db.DescribeMigrations(); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if err := db.MigrateDatabase(); err != nil {
+		log.Fatal(err)
+	}
+	if *migrateOnlyFlag {
+		os.Exit(0)
+	}
+	// Startup carries on regardless, since expired logins can't be used anyway
+	if err := db.DeleteExpired(); err != nil {
+		log.Println("Couldn't delete expired sessions:", err)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "backup":
+		runBackupCommand(flag.Arg(1))
+		os.Exit(0)
+	default:
+		runAdminCommand(flag.Args())
+		os.Exit(0)
+	}
 
 	if *addUserFlag {
-		scanner := bufio.NewScanner(os.Stdin)
 		fmt.Println("Enter new admin username:")
-		if !scanner.Scan() {
+		username, err := readLine()
+		if err != nil {
 			os.Exit(1)
 		}
-		username := scanner.Text()
-		fmt.Println("Enter new admin password (will be printed in the clear):")
-		if !scanner.Scan() {
-			os.Exit(1)
+		password, err := readNewPassword()
+		if err != nil {
+			log.Fatal(err)
 		}
-		password := scanner.Text()
 		if username == "" || password == "" {
 			fmt.Println("Both username and password must be specified")
 			os.Exit(1)
 		}
-		if err := users.CreateUser(username, password, true); err != nil {
+		if err := users.CreateUser(username, password, []string{RoleAdmin}); err != nil {
 			log.Fatal(err)
 		}
 		os.Exit(0)
 	}
 
 	log.Println("Broadcaster Server", version, "starting up")
+	unlock, err := lockServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer unlock()
 	mime.AddExtensionType(".js", "application/javascript")
 	InitCommandRouter()
 	InitPlaylists()
 	InitAudioFiles(config.AudioFilesPath)
 	InitServerStatus()
+	InitEnrollments()
+	if config.RadioTLSPort != 0 {
+		if err := InitRadioCA(); err != nil {
+			log.Fatal("could not load radio certificate authority: ", err)
+		}
+	}
+	go commandRouter.RunQueuedCommands()
 
 	// Public routes
 
 	http.HandleFunc("/login", logInPage)
-	http.Handle("/file-downloads/", applyDisposition(http.StripPrefix("/file-downloads/", http.FileServer(http.Dir(config.AudioFilesPath)))))
+	http.HandleFunc("/login/two-factor", twoFactorLogInPage)
+	http.HandleFunc("/login/oidc", oidcLogInPage)
+	http.HandleFunc("/login/oidc/callback", oidcCallbackPage)
+	http.HandleFunc("/forgot-password", forgotPasswordPage)
+	http.HandleFunc("/reset-password", resetPasswordPage)
+	fileDownloads := applyDisposition(http.StripPrefix("/file-downloads/", http.FileServer(publicAudioFileSystem{http.Dir(config.AudioFilesPath)})))
+	http.Handle("/file-downloads/", fileDownloads)
 	staticSub, _ := fs.Sub(staticFiles, "static")
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticSub))))
 
@@ -93,23 +145,39 @@ func main() {
 	http.Handle("/", requireUser(homePage))
 	http.Handle("/logout", requireUser(logOutPage))
 	http.Handle("/change-password", requireUser(changePasswordPage))
+	http.Handle("/change-email", requireUser(changeEmailPage))
+	http.Handle("/tokens/", requireUser(tokenSection))
+	http.Handle("/sessions/", requireUser(sessionSection))
+	http.Handle("/two-factor/", requireUser(twoFactorSection))
 
-	http.Handle("/playlists/", requireUser(playlistSection))
-	http.Handle("/files/", requireUser(fileSection))
-	http.Handle("/radios/", requireUser(radioSection))
+	http.Handle("/playlists/", requirePermission(PermManagePlaylists, playlistSection))
+	http.Handle("/files/", requirePermission(PermManageFiles, fileSection))
+	http.Handle("/radios/", requirePermission(PermManageRadios, radioSection))
+	http.Handle("/users/", requirePermission(PermManageUsers, userSection))
+	http.Handle("/audit/", requirePermission(PermViewAuditLog, auditSection))
+	http.Handle("/backup/", requirePermission(PermManageBackups, backupSection))
 
-	http.Handle("/stop", requireUser(stopPage))
+	http.Handle("/stop", requirePermission(PermControlRadios, stopPage))
 
-	// Admin routes
+	// JSON API, which reports auth failures with a status code rather than redirecting
 
-	http.Handle("/users/", requireAdmin(userSection))
+	http.Handle("/api/v1/", requireApiUser(apiSection))
 
 	// Websocket routes, which perform their own auth
 
 	http.Handle("/radio-ws", websocket.Handler(RadioSync))
-	http.Handle("/web-ws", websocket.Handler(WebSync))
+	http.Handle("/web-ws", websocket.Server{Handler: WebSync, Handshake: checkWebSyncOrigin})
+
+	if config.RadioTLSPort != 0 {
+		go serveRadioTLS(fileDownloads)
+	}
 
-	err := http.ListenAndServe(config.BindAddress+":"+strconv.Itoa(config.Port), nil)
+	addr := config.BindAddress + ":" + strconv.Itoa(config.Port)
+	if config.TLSCertFile != "" {
+		err = serveTLS(addr)
+	} else {
+		err = http.ListenAndServe(addr, nil)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -136,14 +204,39 @@ func applyDisposition(handler http.Handler) DispositionMiddleware {
 type authenticatedHandler func(http.ResponseWriter, *http.Request, User)
 
 type AuthMiddleware struct {
-	handler     authenticatedHandler
-	mustBeAdmin bool
+	handler    authenticatedHandler
+	permission Permission // empty if any logged-in user is allowed
 }
 
 func (m AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	user, err := currentUser(w, r)
-	if err != nil || (m.mustBeAdmin && !user.IsAdmin) {
-		http.Redirect(w, r, "/login", http.StatusFound)
+	if errors.Is(err, ErrApiTokenScope) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		if _, isScript := bearerToken(r); isScript {
+			// Scripts can't follow a redirect to the login page, so tell them what went wrong
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		} else {
+			http.Redirect(w, r, "/login", http.StatusFound)
+		}
+		return
+	}
+	if needsTwoFactorEnrolment(user, r) {
+		if _, isScript := bearerToken(r); isScript {
+			http.Error(w, "Two-factor authentication must be set up first", http.StatusForbidden)
+		} else {
+			http.Redirect(w, r, "/two-factor/", http.StatusFound)
+		}
+		return
+	}
+	if m.permission != "" && !user.Can(m.permission) {
+		http.Error(w, "You do not have permission to do that", http.StatusForbidden)
+		return
+	}
+	if err := checkCsrf(r, user); err != nil {
+		http.Error(w, "Invalid or missing CSRF token. Reload the page and try again.", http.StatusForbidden)
 		return
 	}
 	m.handler(w, r, user)
@@ -151,15 +244,14 @@ func (m AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func requireUser(handler authenticatedHandler) AuthMiddleware {
 	return AuthMiddleware{
-		handler:     handler,
-		mustBeAdmin: false,
+		handler: handler,
 	}
 }
 
-func requireAdmin(handler authenticatedHandler) AuthMiddleware {
+func requirePermission(permission Permission, handler authenticatedHandler) AuthMiddleware {
 	return AuthMiddleware{
-		handler:     handler,
-		mustBeAdmin: true,
+		handler:    handler,
+		permission: permission,
 	}
 }
 
@@ -170,7 +262,7 @@ type HeaderData struct {
 }
 
 func renderHeader(w http.ResponseWriter, selectedMenu string, user User) {
-	tmpl := template.Must(template.ParseFS(content, "templates/header.html"))
+	tmpl := parseTemplate(user, "templates/header.html")
 	data := HeaderData{
 		SelectedMenu: selectedMenu,
 		User:         user,
@@ -182,6 +274,12 @@ func renderHeader(w http.ResponseWriter, selectedMenu string, user User) {
 	}
 }
 
+// Report a failure to read or change the database. The details are only logged.
+func databaseError(w http.ResponseWriter, err error) {
+	log.Println("Database error:", err)
+	http.Error(w, "Something went wrong with the database, so that couldn't be done. Please try again.", http.StatusInternalServerError)
+}
+
 func renderFooter(w http.ResponseWriter) {
 	tmpl := template.Must(template.ParseFS(content, "templates/footer.html"))
 	err := tmpl.Execute(w, nil)
@@ -207,7 +305,10 @@ func homePage(w http.ResponseWriter, r *http.Request, user User) {
 }
 
 type LogInData struct {
-	Error string
+	Error           string
+	OIDCEnabled     bool
+	OIDCButtonText  string
+	PasswordResetOn bool
 }
 
 func logInPage(w http.ResponseWriter, r *http.Request) {
@@ -215,19 +316,49 @@ func logInPage(w http.ResponseWriter, r *http.Request) {
 	username := r.Form["username"]
 	password := r.Form["password"]
 	errText := ""
-	if username != nil {
-		user, err := users.Authenticate(username[0], password[0])
-		if err != nil {
-			errText = "Incorrect login"
+	status := http.StatusOK
+	if username != nil && password != nil {
+		ip := clientIP(r)
+		if wait := loginLimiter.Wait(ip, username[0]); wait > 0 {
+			seconds := int(wait.Seconds()) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			status = http.StatusTooManyRequests
+			errText = "Too many failed attempts. Try again in " + strconv.Itoa(seconds) + " seconds"
+		} else if user, err := users.Authenticate(username[0], password[0]); err != nil {
+			log.Println("Failed login for", username[0], "from", ip)
+			loginLimiter.RecordFailure(ip, username[0])
+			if err == ErrAccountLocked {
+				errText = "This account is temporarily locked after too many failed logins"
+			} else {
+				errText = "Incorrect login"
+			}
+		} else if user.HasTwoFactor() {
+			startLoginChallenge(w, r, user.Username)
+			http.Redirect(w, r, "/login/two-factor", http.StatusFound)
+			return
 		} else {
-			createSessionCookie(w, user.Username)
+			loginLimiter.RecordSuccess(user.Username)
+			users.RecordLoginSuccess(user)
+			if err := createSessionCookie(w, r, user.Username); err != nil {
+				databaseError(w, err)
+				return
+			}
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
 	}
 
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	renderLogInPage(w, errText)
+}
+
+func renderLogInPage(w http.ResponseWriter, errText string) {
 	data := LogInData{
-		Error: errText,
+		Error:           errText,
+		OIDCEnabled:     config.OIDC.Enabled(),
+		OIDCButtonText:  config.OIDC.ButtonText,
+		PasswordResetOn: config.SMTP.Enabled(),
 	}
 	renderHeader(w, "", User{})
 	tmpl := template.Must(template.ParseFS(content, "templates/login.html"))
@@ -244,9 +375,13 @@ func playlistSection(w http.ResponseWriter, r *http.Request, user User) {
 	if path[2] == "new" {
 		editPlaylistPage(w, r, 0, user)
 	} else if path[2] == "submit" && r.Method == "POST" {
-		submitPlaylist(w, r)
+		submitPlaylist(w, r, user)
 	} else if path[2] == "delete" && r.Method == "POST" {
-		deletePlaylist(w, r)
+		deletePlaylist(w, r, user)
+	} else if path[2] == "export" {
+		exportPlaylistsPage(w, r)
+	} else if path[2] == "import" && r.Method == "POST" {
+		importPlaylistsPage(w, r, user)
 	} else if path[2] == "" {
 		playlistsPage(w, r, user)
 	} else {
@@ -266,9 +401,19 @@ func fileSection(w http.ResponseWriter, r *http.Request, user User) {
 		return
 	}
 	if path[2] == "upload" {
-		uploadFile(w, r)
+		uploadFile(w, r, user)
+	} else if path[2] == "upload-init" && r.Method == "POST" {
+		initChunkedUpload(w, r, user)
+	} else if path[2] == "upload-chunk" && r.Method == "POST" {
+		uploadChunk(w, r, user)
+	} else if path[2] == "upload-finalize" && r.Method == "POST" {
+		finalizeChunkedUpload(w, r, user)
 	} else if path[2] == "delete" && r.Method == "POST" {
-		deleteFile(w, r)
+		deleteFile(w, r, user)
+	} else if path[2] == "versions" {
+		fileVersionsPage(w, r, user)
+	} else if path[2] == "restore" && r.Method == "POST" {
+		restoreFile(w, r, user)
 	} else if path[2] == "" {
 		filesPage(w, r, user)
 	} else {
@@ -286,9 +431,21 @@ func radioSection(w http.ResponseWriter, r *http.Request, user User) {
 	if path[2] == "new" {
 		editRadioPage(w, r, 0, user)
 	} else if path[2] == "submit" && r.Method == "POST" {
-		submitRadio(w, r)
+		submitRadio(w, r, user)
 	} else if path[2] == "delete" && r.Method == "POST" {
-		deleteRadio(w, r)
+		deleteRadio(w, r, user)
+	} else if path[2] == "rotate-token" && r.Method == "POST" {
+		rotateRadioTokenPage(w, r, user)
+	} else if path[2] == "revoke-token" && r.Method == "POST" {
+		revokeRadioTokensPage(w, r, user)
+	} else if path[2] == "issue-certificate" && r.Method == "POST" {
+		issueRadioCertificatePage(w, r, user)
+	} else if path[2] == "revoke-certificate" && r.Method == "POST" {
+		revokeRadioCertificatePage(w, r, user)
+	} else if path[2] == "approve" && r.Method == "POST" {
+		approveEnrollment(w, r, user)
+	} else if path[2] == "reject" && r.Method == "POST" {
+		rejectEnrollment(w, r, user)
 	} else if path[2] == "" {
 		radiosPage(w, r, user)
 	} else {
@@ -310,11 +467,19 @@ func userSection(w http.ResponseWriter, r *http.Request, user User) {
 	if path[2] == "new" {
 		editUserPage(w, r, 0, user)
 	} else if path[2] == "submit" && r.Method == "POST" {
-		submitUser(w, r)
+		submitUser(w, r, user)
 	} else if path[2] == "delete" && r.Method == "POST" {
-		deleteUser(w, r)
+		deleteUser(w, r, user)
 	} else if path[2] == "reset-password" && r.Method == "POST" {
-		resetUserPassword(w, r)
+		resetUserPassword(w, r, user)
+	} else if path[2] == "reset-two-factor" && r.Method == "POST" {
+		resetUserTwoFactor(w, r, user)
+	} else if path[2] == "revoke-sessions" && r.Method == "POST" {
+		revokeUserSessions(w, r, user)
+	} else if path[2] == "unlock" && r.Method == "POST" {
+		unlockUser(w, r, user)
+	} else if path[2] == "unblock-address" && r.Method == "POST" {
+		unblockAddress(w, r, user)
 	} else if path[2] == "" {
 		usersPage(w, r, user)
 	} else {
@@ -328,11 +493,16 @@ func userSection(w http.ResponseWriter, r *http.Request, user User) {
 }
 
 type EditUserPageData struct {
-	User User
+	User     User
+	Roles    []RoleInfo
+	Sessions []Session
 }
 
 func editUserPage(w http.ResponseWriter, r *http.Request, id int, user User) {
-	var data EditUserPageData
+	data := EditUserPageData{
+		User:  User{Roles: []string{RoleViewer}},
+		Roles: allRoles,
+	}
 	if id != 0 {
 		user, err := db.GetUserById(id)
 		if err != nil {
@@ -340,46 +510,69 @@ func editUserPage(w http.ResponseWriter, r *http.Request, id int, user User) {
 			return
 		}
 		data.User = user
+		data.Sessions, err = db.GetSessions(user.Username)
+		if err != nil {
+			log.Println("Couldn't load sessions for", user.Username, err)
+		}
 	}
 	renderHeader(w, "users", user)
-	tmpl := template.Must(template.ParseFS(content, "templates/user.html"))
+	tmpl := parseTemplate(user, "templates/user.html")
 	tmpl.Execute(w, data)
 	renderFooter(w)
 }
 
-func submitUser(w http.ResponseWriter, r *http.Request) {
+func submitUser(w http.ResponseWriter, r *http.Request, currentUser User) {
 	err := r.ParseForm()
 	if err == nil {
 		id, err := strconv.Atoi(r.Form.Get("userId"))
 		if err != nil {
 			return
 		}
+		roles := r.Form["roles"]
+		email := strings.TrimSpace(r.Form.Get("email"))
+		if err := validateEmail(email); err != nil {
+			http.Error(w, "Could not save user: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 		if id == 0 {
-			newPassword := r.Form.Get("password")
-			hashed, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+			err = users.CreateUser(r.Form.Get("username"), r.Form.Get("password"), roles)
 			if err != nil {
+				http.Error(w, "Could not create user: "+err.Error(), http.StatusBadRequest)
 				return
 			}
-			user := User{
-				Id:           0,
-				Username:     r.Form.Get("username"),
-				IsAdmin:      r.Form.Get("isAdmin") == "1",
-				PasswordHash: string(hashed),
+			if err := db.SetUserEmail(r.Form.Get("username"), email); err != nil {
+				databaseError(w, err)
+				return
 			}
-			db.CreateUser(user)
+			created, _ := normalizeRoles(roles)
+			recordAudit(r, currentUser, AuditUserCreate, r.Form.Get("username"), rolesSummary(created)+emailSummary(email))
 		} else {
 			user, err := db.GetUserById(id)
 			if err != nil {
 				http.NotFound(w, r)
 				return
 			}
-			db.SetUserIsAdmin(user.Username, r.Form.Get("isAdmin") == "1")
+			// Stop admins from accidentally locking themselves out
+			if user.Username == currentUser.Username && !(User{Roles: roles}).IsAdmin() {
+				http.Error(w, "You cannot remove your own admin role", http.StatusBadRequest)
+				return
+			}
+			if err := users.UpdateRoles(user.Username, roles); err != nil {
+				http.Error(w, "Could not update user: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := db.SetUserEmail(user.Username, email); err != nil {
+				http.Error(w, "Could not update user: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			updated, _ := normalizeRoles(roles)
+			recordAudit(r, currentUser, AuditUserUpdate, user.Username, changeSummary(rolesSummary(user.Roles)+emailSummary(user.Email), rolesSummary(updated)+emailSummary(email)))
 		}
 	}
 	http.Redirect(w, r, "/users/", http.StatusFound)
 }
 
-func deleteUser(w http.ResponseWriter, r *http.Request) {
+func deleteUser(w http.ResponseWriter, r *http.Request, currentUser User) {
 	err := r.ParseForm()
 	if err == nil {
 		id, err := strconv.Atoi(r.Form.Get("userId"))
@@ -391,12 +584,20 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 			http.NotFound(w, r)
 			return
 		}
-		db.DeleteUser(user.Username)
+		if user.Username == currentUser.Username {
+			http.Error(w, "You cannot delete yourself", http.StatusBadRequest)
+			return
+		}
+		if err := db.DeleteUser(user.Username); err != nil {
+			databaseError(w, err)
+			return
+		}
+		recordAudit(r, currentUser, AuditUserDelete, user.Username, rolesSummary(user.Roles))
 	}
 	http.Redirect(w, r, "/users/", http.StatusFound)
 }
 
-func resetUserPassword(w http.ResponseWriter, r *http.Request) {
+func resetUserPassword(w http.ResponseWriter, r *http.Request, currentUser User) {
 	err := r.ParseForm()
 	if err == nil {
 		id, err := strconv.Atoi(r.Form.Get("userId"))
@@ -413,14 +614,21 @@ func resetUserPassword(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			return
 		}
-		db.SetUserPassword(user.Username, string(hashed))
+		if err := db.SetUserPassword(user.Username, string(hashed)); err != nil {
+			databaseError(w, err)
+			return
+		}
+		recordAudit(r, currentUser, AuditUserResetPassword, user.Username, "")
 	}
 	http.Redirect(w, r, "/users/", http.StatusFound)
 }
 
 type ChangePasswordPageData struct {
-	Message  string
-	ShowForm bool
+	Message      string
+	ShowForm     bool
+	Email        string
+	EmailMessage string
+	ShowEmail    bool
 }
 
 func changePasswordPage(w http.ResponseWriter, r *http.Request, user User) {
@@ -440,18 +648,28 @@ func changePasswordPage(w http.ResponseWriter, r *http.Request, user User) {
 		} else {
 			data.Message = "Successfully changed password"
 			data.ShowForm = false
+			recordAudit(r, user, AuditPasswordChange, user.Username, "")
 			cookie, err := r.Cookie("broadcast_session")
 			if err == nil {
 				log.Println("Clearing other sessions for username", user.Username, "token", cookie.Value)
-				db.ClearOtherSessions(user.Username, cookie.Value)
+				if err := db.ClearOtherSessions(user.Username, cookie.Value); err != nil {
+					log.Println("Couldn't clear other sessions for", user.Username, err)
+					data.Message = "Successfully changed password, but other sessions could not be logged out"
+				}
 			}
 		}
 	} else {
 		data.Message = ""
 		data.ShowForm = true
 	}
+	renderChangePasswordPage(w, user, data)
+}
+
+func renderChangePasswordPage(w http.ResponseWriter, user User, data ChangePasswordPageData) {
+	data.Email = user.Email
+	data.ShowEmail = config.SMTP.Enabled() && user.HasPassword()
 	renderHeader(w, "change-password", user)
-	tmpl := template.Must(template.ParseFS(content, "templates/change_password.html"))
+	tmpl := parseTemplate(user, "templates/change_password.html")
 	err := tmpl.Execute(w, data)
 	if err != nil {
 		log.Fatal(err)
@@ -460,16 +678,30 @@ func changePasswordPage(w http.ResponseWriter, r *http.Request, user User) {
 }
 
 type UsersPageData struct {
-	Users []User
+	Users            []User
+	LockedUsers      []User
+	BlockedAddresses []BlockedAddress
 }
 
 func usersPage(w http.ResponseWriter, _ *http.Request, user User) {
-	renderHeader(w, "users", user)
+	list, err := db.GetUsers()
+	if err != nil {
+		databaseError(w, err)
+		return
+	}
 	data := UsersPageData{
-		Users: db.GetUsers(),
+		Users:            list,
+		LockedUsers:      make([]User, 0),
+		BlockedAddresses: loginLimiter.BlockedAddresses(),
 	}
-	tmpl := template.Must(template.ParseFS(content, "templates/users.html"))
-	err := tmpl.Execute(w, data)
+	for _, u := range data.Users {
+		if u.IsLocked() {
+			data.LockedUsers = append(data.LockedUsers, u)
+		}
+	}
+	renderHeader(w, "users", user)
+	tmpl := parseTemplate(user, "templates/users.html")
+	err = tmpl.Execute(w, data)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -477,19 +709,28 @@ func usersPage(w http.ResponseWriter, _ *http.Request, user User) {
 }
 
 type PlaylistsPageData struct {
-	Playlists []Playlist
+	Playlists      []Playlist
+	ImportResults  []string
+	ImportProblems []string
 }
 
 func playlistsPage(w http.ResponseWriter, _ *http.Request, user User) {
-	renderHeader(w, "playlists", user)
-	data := PlaylistsPageData{
-		Playlists: db.GetPlaylists(),
+	renderPlaylistsPage(w, user, PlaylistsPageData{})
+}
+
+func renderPlaylistsPage(w http.ResponseWriter, user User, data PlaylistsPageData) {
+	var err error
+	data.Playlists, err = db.GetPlaylists()
+	if err != nil {
+		databaseError(w, err)
+		return
 	}
 	for i := range data.Playlists {
 		data.Playlists[i].StartTime = strings.Replace(data.Playlists[i].StartTime, "T", " ", -1)
 	}
-	tmpl := template.Must(template.ParseFS(content, "templates/playlists.html"))
-	err := tmpl.Execute(w, data)
+	renderHeader(w, "playlists", user)
+	tmpl := parseTemplate(user, "templates/playlists.html")
+	err = tmpl.Execute(w, data)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -497,16 +738,29 @@ func playlistsPage(w http.ResponseWriter, _ *http.Request, user User) {
 }
 
 type RadiosPageData struct {
-	Radios []Radio
+	Radios  []Radio
+	Pending []PendingEnrollment
+	Error   string
 }
 
 func radiosPage(w http.ResponseWriter, _ *http.Request, user User) {
-	renderHeader(w, "radios", user)
+	renderRadiosPage(w, user, "")
+}
+
+func renderRadiosPage(w http.ResponseWriter, user User, errorMessage string) {
+	radios, err := db.GetRadios()
+	if err != nil {
+		databaseError(w, err)
+		return
+	}
 	data := RadiosPageData{
-		Radios: db.GetRadios(),
+		Radios:  radios,
+		Pending: enrollments.Pending(),
+		Error:   errorMessage,
 	}
-	tmpl := template.Must(template.ParseFS(content, "templates/radios.html"))
-	err := tmpl.Execute(w, data)
+	renderHeader(w, "radios", user)
+	tmpl := parseTemplate(user, "templates/radios.html")
+	err = tmpl.Execute(w, data)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -516,13 +770,24 @@ func radiosPage(w http.ResponseWriter, _ *http.Request, user User) {
 type EditPlaylistPageData struct {
 	Playlist Playlist
 	Entries  []PlaylistEntry
-	Files    []string
+	Files    []FileChoice
+}
+
+// A file that can be chosen for a playlist entry, either following the latest version or pinned to an earlier one
+type FileChoice struct {
+	Name     string
+	Versions []FileVersion
 }
 
 func editPlaylistPage(w http.ResponseWriter, r *http.Request, id int, user User) {
 	var data EditPlaylistPageData
 	for _, f := range files.Files() {
-		data.Files = append(data.Files, f.Name)
+		versions, err := db.GetFileVersions(f.Name)
+		if err != nil {
+			databaseError(w, err)
+			return
+		}
+		data.Files = append(data.Files, FileChoice{Name: f.Name, Versions: versions})
 	}
 	if id == 0 {
 		data.Playlist.Enabled = true
@@ -536,15 +801,19 @@ func editPlaylistPage(w http.ResponseWriter, r *http.Request, id int, user User)
 			return
 		}
 		data.Playlist = playlist
-		data.Entries = db.GetEntriesForPlaylist(id)
+		data.Entries, err = db.GetEntriesForPlaylist(id)
+		if err != nil {
+			databaseError(w, err)
+			return
+		}
 	}
 	renderHeader(w, "playlists", user)
-	tmpl := template.Must(template.ParseFS(content, "templates/playlist.html"))
+	tmpl := parseTemplate(user, "templates/playlist.html")
 	tmpl.Execute(w, data)
 	renderFooter(w)
 }
 
-func submitPlaylist(w http.ResponseWriter, r *http.Request) {
+func submitPlaylist(w http.ResponseWriter, r *http.Request, user User) {
 	err := r.ParseForm()
 	if err == nil {
 		var p Playlist
@@ -552,13 +821,6 @@ func submitPlaylist(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			return
 		}
-		_, err = time.Parse(protocol.StartTimeFormatSecs, r.Form.Get("playlistStartTime"))
-		if err != nil {
-			_, err = time.Parse(protocol.StartTimeFormat, r.Form.Get("playlistStartTime"))
-		}
-		if err != nil {
-			return
-		}
 		p.Id = id
 		p.Enabled = r.Form.Get("playlistEnabled") == "1"
 		p.Name = r.Form.Get("playlistName")
@@ -578,7 +840,7 @@ func submitPlaylist(w http.ResponseWriter, r *http.Request) {
 			e.DelaySeconds = delay
 			e.Position = i
 			e.IsRelative = isRelatives[i] == "1"
-			e.Filename = filenames[i]
+			e.Filename, e.FileVersion = resolveFileRef(filenames[i])
 			entries = append(entries, e)
 		}
 		cleanedEntries := make([]PlaylistEntry, 0)
@@ -588,41 +850,70 @@ func submitPlaylist(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		if problems := validatePlaylist(p, cleanedEntries); len(problems) > 0 {
+			http.Error(w, "Could not save playlist: "+strings.Join(problems, "; "), http.StatusBadRequest)
+			return
+		}
+
+		action := AuditPlaylistCreate
+		before := ""
 		if id != 0 {
-			db.UpdatePlaylist(p)
-		} else {
-			id = db.CreatePlaylist(p)
+			before, err = storedPlaylistSummary(id)
+			if err != nil {
+				databaseError(w, err)
+				return
+			}
+			action = AuditPlaylistUpdate
 		}
-		db.SetEntriesForPlaylist(cleanedEntries, id)
+		if _, err := db.SavePlaylist(p, cleanedEntries); err != nil {
+			databaseError(w, err)
+			return
+		}
+		recordAudit(r, user, action, p.Name, changeSummary(before, playlistSummary(p, cleanedEntries)))
 		// Notify connected radios
 		playlists.NotifyChanges()
 	}
 	http.Redirect(w, r, "/playlists/", http.StatusFound)
 }
 
-func deletePlaylist(w http.ResponseWriter, r *http.Request) {
+func deletePlaylist(w http.ResponseWriter, r *http.Request, user User) {
 	err := r.ParseForm()
 	if err == nil {
 		id, err := strconv.Atoi(r.Form.Get("playlistId"))
 		if err != nil {
 			return
 		}
-		db.DeletePlaylist(id)
+		old, err := db.GetPlaylist(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		before, err := storedPlaylistSummary(id)
+		if err != nil {
+			databaseError(w, err)
+			return
+		}
+		if err := db.DeletePlaylist(id); err != nil {
+			databaseError(w, err)
+			return
+		}
+		recordAudit(r, user, AuditPlaylistDelete, old.Name, changeSummary(before, ""))
 		playlists.NotifyChanges()
 	}
 	http.Redirect(w, r, "/playlists/", http.StatusFound)
 }
 
 type EditRadioPageData struct {
-	Radio Radio
+	Radio               Radio
+	NewToken            string             // only set straight after the token is created
+	NewCertificate      *IssuedCertificate // only set straight after the certificate is issued
+	CertificatesEnabled bool
+	Error               string
 }
 
 func editRadioPage(w http.ResponseWriter, r *http.Request, id int, user User) {
 	var data EditRadioPageData
-	if id == 0 {
-		data.Radio.Name = "New Radio"
-		data.Radio.Token = generateSession()
-	} else {
+	if id != 0 {
 		radio, err := db.GetRadio(id)
 		if err != nil {
 			http.NotFound(w, r)
@@ -630,54 +921,91 @@ func editRadioPage(w http.ResponseWriter, r *http.Request, id int, user User) {
 		}
 		data.Radio = radio
 	}
+	renderRadioPage(w, user, data)
+}
+
+func renderRadioPage(w http.ResponseWriter, user User, data EditRadioPageData) {
+	data.CertificatesEnabled = radioCA != nil
 	renderHeader(w, "radios", user)
-	tmpl := template.Must(template.ParseFS(content, "templates/radio.html"))
+	tmpl := parseTemplate(user, "templates/radio.html")
 	tmpl.Execute(w, data)
 	renderFooter(w)
 }
 
-func submitRadio(w http.ResponseWriter, r *http.Request) {
+func submitRadio(w http.ResponseWriter, r *http.Request, user User) {
 	err := r.ParseForm()
 	if err == nil {
-		var radio Radio
 		id, err := strconv.Atoi(r.Form.Get("radioId"))
 		if err != nil {
 			return
 		}
-		radio.Id = id
-		radio.Name = r.Form.Get("radioName")
-		radio.Token = r.Form.Get("radioToken")
+		name := r.Form.Get("radioName")
 		if id != 0 {
-			db.UpdateRadio(radio)
+			old, err := db.GetRadio(id)
+			if err != nil {
+				databaseError(w, err)
+				return
+			}
+			radio := old
+			radio.Name = name
+			if err := db.UpdateRadio(radio); err != nil {
+				databaseError(w, err)
+				return
+			}
+			recordAudit(r, user, AuditRadioUpdate, radio.Name, radioSummary(old, radio))
 		} else {
-			db.CreateRadio(radio)
+			radio, token, err := createRadio(name)
+			if err != nil {
+				renderRadioPage(w, user, EditRadioPageData{Error: "Could not register radio: " + err.Error()})
+				return
+			}
+			recordAudit(r, user, AuditRadioCreate, radio.Name, radioSummary(Radio{}, radio))
+			// The token can only be shown now, so this page is shown instead of redirecting
+			renderRadioPage(w, user, EditRadioPageData{Radio: radio, NewToken: token})
+			return
 		}
 	}
 	http.Redirect(w, r, "/radios/", http.StatusFound)
 }
 
-func deleteRadio(w http.ResponseWriter, r *http.Request) {
+func deleteRadio(w http.ResponseWriter, r *http.Request, user User) {
 	err := r.ParseForm()
 	if err == nil {
 		id, err := strconv.Atoi(r.Form.Get("radioId"))
 		if err != nil {
 			return
 		}
-		db.DeleteRadio(id)
+		old, err := db.GetRadio(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := db.DeleteRadio(id); err != nil {
+			databaseError(w, err)
+			return
+		}
+		commandRouter.DropInvalidConnection(id)
+		recordAudit(r, user, AuditRadioDelete, old.Name, radioSummary(old, Radio{}))
 	}
 	http.Redirect(w, r, "/radios/", http.StatusFound)
 }
 
 type FilesPageData struct {
 	Files []FileSpec
+	Error string
 }
 
 func filesPage(w http.ResponseWriter, _ *http.Request, user User) {
+	renderFilesPage(w, user, "")
+}
+
+func renderFilesPage(w http.ResponseWriter, user User, errorMessage string) {
 	renderHeader(w, "files", user)
 	data := FilesPageData{
 		Files: files.Files(),
+		Error: errorMessage,
 	}
-	tmpl := template.Must(template.ParseFS(content, "templates/files.html"))
+	tmpl := parseTemplate(user, "templates/files.html")
 	err := tmpl.Execute(w, data)
 	if err != nil {
 		log.Fatal(err)
@@ -685,47 +1013,161 @@ func filesPage(w http.ResponseWriter, _ *http.Request, user User) {
 	renderFooter(w)
 }
 
-func deleteFile(w http.ResponseWriter, r *http.Request) {
+func deleteFile(w http.ResponseWriter, r *http.Request, user User) {
 	err := r.ParseForm()
 	if err == nil {
 		filename := r.Form.Get("filename")
 		if filename == "" {
 			return
 		}
-		files.Delete(filename)
+		if err := files.Delete(filename); err != nil {
+			renderFilesPage(w, user, "Could not delete "+filename+": "+err.Error())
+			return
+		}
+		recordAudit(r, user, AuditFileDelete, filename, "")
 	}
 	http.Redirect(w, r, "/files/", http.StatusFound)
 }
 
-func uploadFile(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(100 << 20)
-	if err != nil {
-		http.Error(w, "Could not parse form", http.StatusBadRequest)
+func uploadFile(w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != "POST" {
+		http.Error(w, "Uploads must use POST", http.StatusMethodNotAllowed)
 		return
 	}
-	file, handler, err := r.FormFile("file")
+	staged, filename, err := stageUpload(w, r)
 	if err != nil {
-		http.Error(w, "No file provided", http.StatusBadRequest)
+		writeUploadError(w, filename, err)
 		return
 	}
-	defer file.Close()
-	path := filepath.Join(files.Path(), filepath.Base(handler.Filename))
-	f, err := os.Create(path)
+	replaced := files.Exists(importedName(filename))
+	imported, err := files.Import(staged, filename, r.URL.Query().Get("overwrite") == "1", user.Username)
 	if err != nil {
-		http.Error(w, "Could not save file", http.StatusInternalServerError)
+		writeUploadError(w, filename, err)
 		return
 	}
-	defer f.Close()
-	io.Copy(f, file)
-	log.Println("Uploaded file to", path)
-	files.Refresh()
+	recordAudit(r, user, AuditFileUpload, imported, uploadSummary(filename, imported, replaced))
 	w.WriteHeader(http.StatusOK)
 }
 
+var errNoFileProvided = errors.New("no file provided")
+
+// Stream the "file" field of a multipart upload into the staging area.
+// Returns the path of the staged file and the filename the uploader gave it.
+func stageUpload(w http.ResponseWriter, r *http.Request) (string, string, error) {
+	// Allow a little extra for the multipart encoding around the file
+	r.Body = http.MaxBytesReader(w, r.Body, int64(config.MaxUploadMB+1)<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return "", "", errNoFileProvided
+	}
+	var part *multipart.Part
+	for {
+		part, err = mr.NextPart()
+		if err == io.EOF {
+			return "", "", errNoFileProvided
+		}
+		if err != nil {
+			return "", "", err
+		}
+		if part.FormName() == "file" {
+			break
+		}
+	}
+	staged, err := os.CreateTemp(files.StagingPath(), "upload-*")
+	if err != nil {
+		return "", part.FileName(), err
+	}
+	_, err = io.Copy(staged, part)
+	staged.Close()
+	if err != nil {
+		os.Remove(staged.Name())
+		return "", part.FileName(), err
+	}
+	return staged.Name(), part.FileName(), nil
+}
+
+type FileVersionsPageData struct {
+	Filename string
+	Versions []FileVersion
+}
+
+func fileVersionsPage(w http.ResponseWriter, r *http.Request, user User) {
+	filename := r.URL.Query().Get("filename")
+	versions, err := db.GetFileVersions(filename)
+	if err != nil || len(versions) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	renderHeader(w, "files", user)
+	data := FileVersionsPageData{
+		Filename: filename,
+		Versions: versions,
+	}
+	tmpl := parseTemplate(user, "templates/file_versions.html")
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	renderFooter(w)
+}
+
+func restoreFile(w http.ResponseWriter, r *http.Request, user User) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	filename := r.Form.Get("filename")
+	version, err := strconv.Atoi(r.Form.Get("version"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := files.Restore(filename, version, user.Username); err != nil {
+		log.Println("Couldn't restore version", version, "of", filename, err)
+		http.Error(w, "Could not restore file", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, AuditFileRestore, filename, "restored version "+strconv.Itoa(version))
+	http.Redirect(w, r, "/files/versions?filename="+url.QueryEscape(filename), http.StatusFound)
+}
+
+// Explain to the uploader why their file wasn't accepted.
+func writeUploadError(w http.ResponseWriter, filename string, err error) {
+	code, message := uploadErrorStatus(filename, err)
+	http.Error(w, message, code)
+}
+
+func uploadErrorStatus(filename string, err error) (int, string) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("File is larger than the %d MB limit", config.MaxUploadMB)
+	case errors.Is(err, errNoFileProvided):
+		return http.StatusBadRequest, "No file provided"
+	case errors.Is(err, ErrFileExists):
+		return http.StatusConflict, fmt.Sprintf("%s already exists", filename)
+	case errors.Is(err, ErrUnsupportedType):
+		return http.StatusUnsupportedMediaType, "Only .wav and .mp3 files are supported"
+	case errors.Is(err, ErrInvalidFilename), errors.Is(err, ErrInvalidAudio):
+		return http.StatusBadRequest, "Could not accept file: " + err.Error()
+	default:
+		log.Println("Upload of", filename, "failed:", err)
+		return http.StatusInternalServerError, "Could not save file"
+	}
+}
+
 func logOutPage(w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
 	cookie, err := r.Cookie("broadcast_session")
 	if err == nil {
-		db.ClearSession(user.Username, cookie.Value)
+		if err := db.ClearSession(user.Username, cookie.Value); err != nil {
+			databaseError(w, err)
+			return
+		}
 	}
 	clearSessionCookie(w)
 	renderHeader(w, "", user)
@@ -735,6 +1177,11 @@ func logOutPage(w http.ResponseWriter, r *http.Request, user User) {
 }
 
 func stopPage(w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Stopping a radio must use POST", http.StatusMethodNotAllowed)
+		return
+	}
 	r.ParseForm()
 	radioId, err := strconv.Atoi(r.Form.Get("radioId"))
 	if err != nil {
@@ -742,5 +1189,10 @@ func stopPage(w http.ResponseWriter, r *http.Request, user User) {
 		return
 	}
 	commandRouter.Stop(radioId)
+	target := strconv.Itoa(radioId)
+	if radio, err := db.GetRadio(radioId); err == nil {
+		target = radio.Name
+	}
+	recordAudit(r, user, AuditRadioStop, target, "")
 	http.Redirect(w, r, "/", http.StatusFound)
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// A numbered change to the database schema. Each one runs in its own transaction and is recorded in
+// the schema_version table, so it is applied exactly once to every database.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *dbTx) error
+}
+
+// Append new migrations to the end of this list. Never change or reorder one that has been released.
+var migrations = []migration{
+	{1, "baseline schema", migrateBaseline},
+	{2, "queued commands", migrateQueuedCommands},
+	{3, "hashed radio tokens", migrateRadioTokens},
+	{4, "radio client certificates", migrateRadioCertificates},
+}
+
+// Before versioned migrations existed, tables and columns were created at every startup if they were missing.
+// This brings a database from any of those versions, or a new empty database, up to the same schema, so
+// unlike later migrations it must be safe to run against tables that already exist.
+func migrateBaseline(tx *dbTx) error {
+	err := tx.ExecSchema(`
+	CREATE TABLE IF NOT EXISTS sessions (id INTEGER PRIMARY KEY AUTOINCREMENT, token TEXT, username TEXT, created TIMESTAMP, expiry TIMESTAMP);
+	CREATE TABLE IF NOT EXISTS playlists (id INTEGER PRIMARY KEY AUTOINCREMENT, enabled INTEGER, name TEXT, start_time TEXT);
+	CREATE TABLE IF NOT EXISTS playlist_entries (id INTEGER PRIMARY KEY AUTOINCREMENT, playlist_id INTEGER, position INTEGER, filename TEXT, delay_seconds INTEGER, is_relative INTEGER, CONSTRAINT fk_playlists FOREIGN KEY (playlist_id) REFERENCES playlists(id) ON DELETE CASCADE);
+	CREATE TABLE IF NOT EXISTS radios (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, token TEXT);
+	CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT UNIQUE, password_hash TEXT, is_admin INTEGER);
+	CREATE TABLE IF NOT EXISTS api_tokens (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT, name TEXT, token_hash TEXT UNIQUE, scope TEXT, created TIMESTAMP, expiry TIMESTAMP, last_used TIMESTAMP, CONSTRAINT fk_users FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE);
+	CREATE TABLE IF NOT EXISTS recovery_codes (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT, code_hash TEXT, CONSTRAINT fk_users FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE);
+	CREATE TABLE IF NOT EXISTS audit_log (id INTEGER PRIMARY KEY AUTOINCREMENT, time TIMESTAMP, username TEXT, action TEXT, target TEXT, details TEXT, ip TEXT);
+	CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time);
+	CREATE TABLE IF NOT EXISTS password_resets (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT, token_hash TEXT UNIQUE, created TIMESTAMP, expiry TIMESTAMP, CONSTRAINT fk_users FOREIGN KEY (username) REFERENCES users(username) ON DELETE CASCADE);
+	CREATE TABLE IF NOT EXISTS file_versions (id INTEGER PRIMARY KEY AUTOINCREMENT, filename TEXT, version INTEGER, hash TEXT, size INTEGER, uploaded TIMESTAMP, uploaded_by TEXT, restored_from INTEGER, UNIQUE(filename, version));
+	`)
+	if err != nil {
+		return err
+	}
+	columns := []struct{ table, column, definition string }{
+		{"playlist_entries", "file_version", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "roles", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "totp_secret", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "failed_logins", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "locked_until", "TIMESTAMP"},
+		{"users", "oidc_subject", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "email", "TEXT NOT NULL DEFAULT ''"},
+		{"sessions", "user_agent", "TEXT NOT NULL DEFAULT ''"},
+		{"sessions", "ip", "TEXT NOT NULL DEFAULT ''"},
+		{"sessions", "last_seen", "TIMESTAMP"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(tx, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+	// Users from before roles existed keep the access they had: admins remain admins and everybody else
+	// can do everything except manage radios and users.
+	_, err = tx.Exec("UPDATE users SET roles = CASE WHEN is_admin <> 0 THEN ? ELSE ? END WHERE roles = ''", RoleAdmin, strings.Join([]string{RoleScheduler, RoleProducer, RoleOperator}, ","))
+	return err
+}
+
+// Commands given on the command line for the running server to carry out.
+func migrateQueuedCommands(tx *dbTx) error {
+	return tx.ExecSchema("CREATE TABLE queued_commands (id INTEGER PRIMARY KEY AUTOINCREMENT, action TEXT, radio_id INTEGER NOT NULL DEFAULT 0, playlist_id INTEGER NOT NULL DEFAULT 0, created TIMESTAMP, username TEXT)")
+}
+
+// Radio tokens used to be stored as they are. Replace each one with its hash so that the radios can
+// carry on connecting with the tokens they already have.
+func migrateRadioTokens(tx *dbTx) error {
+	err := tx.ExecSchema(`
+	ALTER TABLE radios ADD COLUMN token_hash TEXT NOT NULL DEFAULT '';
+	ALTER TABLE radios ADD COLUMN previous_token_hash TEXT NOT NULL DEFAULT '';
+	ALTER TABLE radios ADD COLUMN previous_token_expiry TIMESTAMP;
+	ALTER TABLE radios ADD COLUMN last_seen TIMESTAMP;
+	ALTER TABLE radios ADD COLUMN last_seen_ip TEXT NOT NULL DEFAULT '';
+	`)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT id, token FROM radios WHERE token <> ''")
+	if err != nil {
+		return err
+	}
+	tokens := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var token string
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[id] = token
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, token := range tokens {
+		if _, err := tx.Exec("UPDATE radios SET token_hash = ?, token = '' WHERE id = ?", hashApiToken(token), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Radios can authenticate with a client certificate issued by the server. Only its fingerprint is stored.
+func migrateRadioCertificates(tx *dbTx) error {
+	return tx.ExecSchema(`
+	ALTER TABLE radios ADD COLUMN cert_fingerprint TEXT NOT NULL DEFAULT '';
+	ALTER TABLE radios ADD COLUMN cert_expiry TIMESTAMP;
+	`)
+}
+
+// Add a column to a table that was created by an earlier version of broadcaster-server.
+func addColumnIfMissing(tx *dbTx, table string, column string, definition string) error {
+	var count int
+	err := tx.QueryRow(tx.dialect.countColumnsQuery(), table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	return tx.ExecSchema("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+}
+
+// The version of the newest migration that has been applied, or 0 for a database that has never been migrated.
+func (d *sqlDatabase) SchemaVersion() (int, error) {
+	var count int
+	err := d.queryRow(d.dialect.countTablesQuery(), "schema_version", "schema_version").Scan(&count)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+	var version int
+	err = d.queryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+func pendingMigrations(version int) []migration {
+	ret := make([]migration, 0)
+	for _, m := range migrations {
+		if m.version > version {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// Print what MigrateDatabase would do without changing anything.
+func (d *sqlDatabase) DescribeMigrations() error {
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Database schema version:", version)
+	pending := pendingMigrations(version)
+	if len(pending) == 0 {
+		fmt.Println("No migrations to apply")
+		return nil
+	}
+	for _, m := range pending {
+		fmt.Printf("Would apply migration %d: %s\n", m.version, m.description)
+	}
+	return nil
+}
+
+// Bring the database up to date, taking a backup first if it already has data in it.
+func (d *sqlDatabase) MigrateDatabase() error {
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if version > latest {
+		return fmt.Errorf("database schema version %d is newer than this broadcaster-server supports (%d); upgrade broadcaster-server or restore a backup", version, latest)
+	}
+	pending := pendingMigrations(version)
+	if len(pending) == 0 {
+		return nil
+	}
+	empty, err := d.isEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		path, err := d.backupBeforeMigrating(version)
+		if err == ErrBackupNotSupported {
+			log.Println("Not backing up the database before migrating; make sure you have a backup, e.g. from pg_dump")
+		} else if err != nil {
+			return fmt.Errorf("could not back up database before migrating: %w", err)
+		} else {
+			log.Println("Backed up database to", path)
+		}
+	}
+	_, err = d.exec(d.dialect.translateSchema("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, description TEXT, applied TIMESTAMP)"))
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		log.Printf("Applying database migration %d: %s\n", m.version, m.description)
+		if err := d.applyMigration(m); err != nil {
+			return fmt.Errorf("database migration %d failed: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+func (d *sqlDatabase) applyMigration(m migration) error {
+	tx, err := d.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.apply(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version, description, applied) VALUES (?, ?, ?)", m.version, m.description, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// True if the database has no tables, i.e. it was just created.
+func (d *sqlDatabase) isEmpty() (bool, error) {
+	var count int
+	err := d.queryRow(d.dialect.countTablesQuery(), "", "").Scan(&count)
+	return count == 0, err
+}
+
+// Write a consistent copy of the database next to it, named after the schema version and time.
+func (d *sqlDatabase) backupBeforeMigrating(version int) (string, error) {
+	path := fmt.Sprintf("%s.v%d-%s.bak", config.SqliteDB, version, time.Now().Format("20060102-150405"))
+	return path, d.Backup(path)
+}
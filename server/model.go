@@ -1,18 +1,70 @@
 package main
 
+import (
+	"time"
+)
+
 type PlaylistEntry struct {
 	Id           int
 	Position     int
 	Filename     string
+	FileVersion  int // 0 means follow the latest version
 	DelaySeconds int
 	IsRelative   bool
 }
 
+// The name under which radios know this entry's file, which differs from Filename if a version is pinned.
+func (e PlaylistEntry) FileRef() string {
+	if e.FileVersion == 0 {
+		return e.Filename
+	}
+	return versionedName(e.Filename, e.FileVersion)
+}
+
 type User struct {
 	Id           int
 	Username     string
 	PasswordHash string
-	IsAdmin      bool
+	Roles        []string
+	TotpSecret   string // empty if two-factor authentication is not enabled
+	FailedLogins int
+	LockedUntil  time.Time // zero if the account has never been locked
+	OidcSubject  string    // the user's ID at the single sign-on provider, empty for local users
+	Email        string    // empty if the user can't reset their own password
+	csrfToken    string    // only set when logged in with a session cookie
+	sessionId    int       // only set when logged in with a session cookie
+}
+
+// A record of somebody changing something.
+type AuditEntry struct {
+	Id       int
+	Time     time.Time
+	Username string
+	Action   string
+	Target   string // what was changed, e.g. a playlist or file name
+	Details  string // summary of the change
+	IP       string
+}
+
+// Which audit entries to fetch. Empty or zero fields match everything.
+type AuditFilter struct {
+	Username string
+	Action   string // either a full action or a category such as "playlist"
+	Target   string // matches any target containing this text
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+// A browser that is logged in. The session token itself is only kept in the browser's cookie and the database.
+type Session struct {
+	Id        int
+	Username  string
+	Created   time.Time
+	Expiry    time.Time
+	LastSeen  time.Time
+	UserAgent string
+	IP        string
 }
 
 type Playlist struct {
@@ -22,8 +74,63 @@ type Playlist struct {
 	StartTime string
 }
 
+// A playlist and the entries it should have, for saving together.
+type PlaylistWithEntries struct {
+	Playlist Playlist
+	Entries  []PlaylistEntry
+}
+
+// A radio that can connect to the server. Only hashes of its tokens are stored.
 type Radio struct {
-	Id    int
-	Name  string
-	Token string
+	Id                  int
+	Name                string
+	HasToken            bool      // false if the radio's tokens have been revoked
+	PreviousTokenExpiry time.Time // zero unless a previous token still works after a rotation
+	LastSeen            time.Time // zero if the radio has never connected
+	LastSeenIP          string
+	CertFingerprint     string    // SHA-256 of the radio's client certificate, empty if it hasn't been issued one
+	CertExpiry          time.Time // when the client certificate stops working
+}
+
+// Something the command line has asked the running server to do, such as stopping a radio.
+type QueuedCommand struct {
+	Id         int
+	Action     string
+	RadioId    int // zero if the command isn't for a radio
+	PlaylistId int // zero if the command doesn't need a playlist
+	Created    time.Time
+	Username   string
+}
+
+type FileVersion struct {
+	Id           int
+	Filename     string
+	Version      int
+	Hash         string
+	Size         int64
+	Uploaded     time.Time
+	UploadedBy   string
+	RestoredFrom int
+}
+
+func (v FileVersion) Ref() string {
+	return versionedName(v.Filename, v.Version)
+}
+
+type ApiToken struct {
+	Id       int
+	Username string
+	Name     string
+	Scope    string
+	Created  time.Time
+	Expiry   time.Time // zero if the token never expires
+	LastUsed time.Time // zero if the token has never been used
+}
+
+// An emailed link that lets a user choose a new password. Only a hash of the link's token is stored.
+type PasswordReset struct {
+	Id       int
+	Username string
+	Created  time.Time
+	Expiry   time.Time
 }
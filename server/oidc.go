@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// How long a user has to finish logging in at the identity provider
+const oidcLoginLifetime = 10 * time.Minute
+
+const oidcLoginCookie = "broadcast_oidc"
+
+var ErrOidcNotPermitted = errors.New("your account is not permitted to use broadcaster")
+
+// Settings for logging in through an OpenID Connect identity provider such as Keycloak.
+type OIDCConfig struct {
+	// Single sign-on is turned on by setting an issuer
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Where the provider sends users back to, ending in /login/oidc/callback.
+	// If empty it is worked out from the address used to reach the server.
+	RedirectURL string
+	ButtonText  string
+	// Claim holding the username for new users
+	UsernameClaim string
+	// Claim holding the user's groups or roles at the provider. Nested claims can be given
+	// with dots, e.g. "realm_access.roles" for Keycloak realm roles.
+	RolesClaim string
+	// Maps values of RolesClaim to broadcaster roles
+	RoleMapping map[string][]string
+	// Roles for users who don't match anything in RoleMapping. If empty, those users can't log in.
+	DefaultRoles []string
+	// Create users on their first login
+	AutoProvision bool
+	// Allow a provider user to log into an existing local account with the same username
+	LinkExistingUsers bool
+}
+
+func NewOIDCConfig() OIDCConfig {
+	return OIDCConfig{
+		ButtonText:    "Log in with single sign-on",
+		UsernameClaim: "preferred_username",
+		RolesClaim:    "groups",
+		RoleMapping:   map[string][]string{},
+		DefaultRoles:  []string{},
+		AutoProvision: true,
+	}
+}
+
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != ""
+}
+
+func (c OIDCConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.ClientID == "" {
+		return errors.New("OIDC configuration must provide ClientID")
+	}
+	if c.UsernameClaim == "" || c.RolesClaim == "" {
+		return errors.New("OIDC UsernameClaim and RolesClaim cannot be empty")
+	}
+	for group, roles := range c.RoleMapping {
+		if _, err := normalizeRoles(roles); err != nil {
+			return fmt.Errorf("OIDC RoleMapping for %q must only contain: %s", group, strings.Join(roleNames(), ", "))
+		}
+	}
+	if _, err := normalizeRoles(c.DefaultRoles); err != nil {
+		return errors.New("OIDC DefaultRoles must only contain: " + strings.Join(roleNames(), ", "))
+	}
+	return nil
+}
+
+// The provider's configuration is discovered on first use, so that the server can still start
+// if the provider is unavailable.
+var oidcProvider struct {
+	sync.Mutex
+	provider *oidc.Provider
+}
+
+func getOidcProvider(ctx context.Context) (*oidc.Provider, error) {
+	oidcProvider.Lock()
+	defer oidcProvider.Unlock()
+	if oidcProvider.provider == nil {
+		p, err := oidc.NewProvider(context.WithoutCancel(ctx), config.OIDC.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		oidcProvider.provider = p
+	}
+	return oidcProvider.provider, nil
+}
+
+func oauth2Config(r *http.Request, provider *oidc.Provider) oauth2.Config {
+	redirect := config.OIDC.RedirectURL
+	if redirect == "" {
+		scheme := "http"
+		if isSecureRequest(r) {
+			scheme = "https"
+		}
+		redirect = scheme + "://" + r.Host + "/login/oidc/callback"
+	}
+	return oauth2.Config{
+		ClientID:     config.OIDC.ClientID,
+		ClientSecret: config.OIDC.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirect,
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+// A login that has been sent to the identity provider and not yet come back.
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	expiry   time.Time
+}
+
+var oidcLogins = struct {
+	sync.Mutex
+	m map[string]*oidcLogin
+}{m: make(map[string]*oidcLogin)}
+
+// Send the user to the identity provider to log in.
+func oidcLogInPage(w http.ResponseWriter, r *http.Request) {
+	if !config.OIDC.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := getOidcProvider(r.Context())
+	if err != nil {
+		log.Println("Couldn't reach OIDC provider", config.OIDC.Issuer, err)
+		http.Error(w, "Single sign-on is not available right now", http.StatusBadGateway)
+		return
+	}
+	state := generateSession()
+	login := &oidcLogin{
+		nonce:    generateSession(),
+		verifier: oauth2.GenerateVerifier(),
+		expiry:   time.Now().Add(oidcLoginLifetime),
+	}
+	oidcLogins.Lock()
+	for k, l := range oidcLogins.m {
+		if time.Now().After(l.expiry) {
+			delete(oidcLogins.m, k)
+		}
+	}
+	oidcLogins.m[state] = login
+	oidcLogins.Unlock()
+	// The state is also kept in a cookie so that a login can only be finished in the browser that started it
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcLoginLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	oc := oauth2Config(r, provider)
+	http.Redirect(w, r, oc.AuthCodeURL(state, oidc.Nonce(login.nonce), oauth2.S256ChallengeOption(login.verifier)), http.StatusFound)
+}
+
+// Where the identity provider sends the user back to after they have logged in.
+func oidcCallbackPage(w http.ResponseWriter, r *http.Request) {
+	if !config.OIDC.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(oidcLoginCookie)
+	http.SetCookie(w, &http.Cookie{Name: oidcLoginCookie, Value: "", Path: "/login/oidc", MaxAge: -1, HttpOnly: true})
+	if err != nil || state == "" || cookie.Value != state {
+		oidcLogInFailed(w, "Your single sign-on login has expired. Please try again.")
+		return
+	}
+	oidcLogins.Lock()
+	login, ok := oidcLogins.m[state]
+	delete(oidcLogins.m, state)
+	oidcLogins.Unlock()
+	if !ok || time.Now().After(login.expiry) {
+		oidcLogInFailed(w, "Your single sign-on login has expired. Please try again.")
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		log.Println("OIDC provider returned an error:", e, r.URL.Query().Get("error_description"))
+		oidcLogInFailed(w, "The single sign-on provider did not log you in.")
+		return
+	}
+
+	provider, err := getOidcProvider(r.Context())
+	if err != nil {
+		log.Println("Couldn't reach OIDC provider", config.OIDC.Issuer, err)
+		oidcLogInFailed(w, "Single sign-on is not available right now.")
+		return
+	}
+	oc := oauth2Config(r, provider)
+	token, err := oc.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(login.verifier))
+	if err != nil {
+		log.Println("Couldn't exchange OIDC code:", err)
+		oidcLogInFailed(w, "Single sign-on failed. Please try again.")
+		return
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		log.Println("OIDC provider did not return an ID token")
+		oidcLogInFailed(w, "Single sign-on failed. Please try again.")
+		return
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: config.OIDC.ClientID}).Verify(r.Context(), rawIdToken)
+	if err != nil || idToken.Nonce != login.nonce {
+		log.Println("Invalid OIDC ID token:", err)
+		oidcLogInFailed(w, "Single sign-on failed. Please try again.")
+		return
+	}
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		log.Println("Couldn't read OIDC claims:", err)
+		oidcLogInFailed(w, "Single sign-on failed. Please try again.")
+		return
+	}
+
+	user, err := oidcUser(r, idToken.Subject, claims)
+	if err != nil {
+		log.Println("OIDC login refused for subject", idToken.Subject, err)
+		oidcLogInFailed(w, "Could not log in: "+err.Error())
+		return
+	}
+	log.Println("User", user.Username, "logged in with single sign-on from", clientIP(r))
+	users.RecordLoginSuccess(user)
+	if err := createSessionCookie(w, r, user.Username); err != nil {
+		databaseError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func oidcLogInFailed(w http.ResponseWriter, errText string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	renderLogInPage(w, errText)
+}
+
+// Look up a claim, following dots into nested objects.
+func claimValue(claims map[string]any, name string) any {
+	var value any = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = m[part]
+	}
+	return value
+}
+
+// A claim as a list of strings, whether the provider sent a single string or a list.
+func claimStrings(claims map[string]any, name string) []string {
+	ret := make([]string, 0)
+	switch v := claimValue(claims, name).(type) {
+	case string:
+		ret = append(ret, v)
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+	}
+	return ret
+}
+
+// The broadcaster roles for a provider user, from the role mapping. An empty result means they aren't allowed in.
+func oidcRoles(claims map[string]any) []string {
+	roles := make([]string, 0)
+	for _, group := range claimStrings(claims, config.OIDC.RolesClaim) {
+		// Some providers give groups as paths like "/broadcaster/admins"; allow either form in the mapping
+		mapped, ok := config.OIDC.RoleMapping[group]
+		if !ok {
+			mapped = config.OIDC.RoleMapping[strings.TrimPrefix(group, "/")]
+		}
+		roles = append(roles, mapped...)
+	}
+	if len(roles) == 0 {
+		roles = append(roles, config.OIDC.DefaultRoles...)
+	}
+	return roles
+}
+
+// Find the local user for someone who has logged in at the identity provider, creating them if necessary.
+// Their roles are updated from the provider's claims on every login.
+func oidcUser(r *http.Request, subject string, claims map[string]any) (User, error) {
+	roles := oidcRoles(claims)
+	if len(roles) == 0 {
+		return User{}, ErrOidcNotPermitted
+	}
+	roles, err := normalizeRoles(roles)
+	if err != nil {
+		return User{}, err
+	}
+
+	user, err := db.GetUserByOidcSubject(subject)
+	if err != nil {
+		username, _ := claimValue(claims, config.OIDC.UsernameClaim).(string)
+		username = strings.TrimSpace(username)
+		if username == "" {
+			return User{}, errors.New("the provider did not supply a username")
+		}
+		existing, err := db.GetUser(username)
+		if err == nil {
+			// Otherwise anybody who can choose their username at the provider could take over a local account
+			if existing.OidcSubject != "" || !config.OIDC.LinkExistingUsers {
+				return User{}, errors.New("a different account already uses the username " + username)
+			}
+			if err := db.SetUserOidcSubject(username, subject); err != nil {
+				return User{}, err
+			}
+			log.Println("Linked existing user", username, "to OIDC subject", subject)
+		} else {
+			if !config.OIDC.AutoProvision {
+				return User{}, ErrOidcNotPermitted
+			}
+			// No local password, so the user can only log in through the provider
+			if err := db.CreateUser(User{Username: username, Roles: roles}); err != nil {
+				return User{}, err
+			}
+			if err := db.SetUserOidcSubject(username, subject); err != nil {
+				return User{}, err
+			}
+			log.Println("Created user", username, "for OIDC subject", subject)
+		}
+		user, err = db.GetUserByOidcSubject(subject)
+		if err != nil {
+			return User{}, err
+		}
+		if existing.Id == 0 {
+			recordAudit(r, user, AuditUserProvision, username, rolesSummary(roles))
+		} else {
+			recordAudit(r, user, AuditUserUpdate, username, "linked to single sign-on")
+		}
+	}
+
+	if strings.Join(user.Roles, ",") != strings.Join(roles, ",") {
+		if err := users.UpdateRoles(user.Username, roles); err != nil {
+			return User{}, err
+		}
+		recordAudit(r, user, AuditUserUpdate, user.Username, "from single sign-on; "+changeSummary(rolesSummary(user.Roles), rolesSummary(roles)))
+		user.Roles = roles
+	}
+	return user, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A minimal OpenID Connect provider: discovery, signing keys, an authorization endpoint that logs in
+// whoever the test says is at the browser, and a token endpoint that hands out their ID token.
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	mutex  sync.Mutex
+	// Claims for the next login, on top of the standard ones
+	claims map[string]any
+	// Nonce for each authorization code handed out
+	codes map[string]string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, codes: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                m.server.URL,
+		"authorization_endpoint":                m.server.URL + "/authorize",
+		"token_endpoint":                        m.server.URL + "/token",
+		"jwks_uri":                              m.server.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (m *mockIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (m *mockIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	code := generateSession()
+	m.mutex.Lock()
+	m.codes[code] = q.Get("nonce")
+	m.mutex.Unlock()
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mutex.Lock()
+	nonce, ok := m.codes[r.Form.Get("code")]
+	delete(m.codes, r.Form.Get("code"))
+	claims := map[string]any{
+		"iss":   m.server.URL,
+		"aud":   config.OIDC.ClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	m.mutex.Unlock()
+	if !ok {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": generateSession(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     m.sign(claims),
+	})
+}
+
+func (m *mockIssuer) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func setupOidcTest(t *testing.T) *mockIssuer {
+	setupTestServer(t)
+	issuer := newMockIssuer(t)
+	config.OIDC = NewOIDCConfig()
+	config.OIDC.Issuer = issuer.server.URL
+	config.OIDC.ClientID = "broadcaster"
+	config.OIDC.ClientSecret = "secret"
+	config.OIDC.RoleMapping = map[string][]string{
+		"radio-ops":   {RoleOperator, RoleScheduler},
+		"broadcaster": {RoleAdmin},
+	}
+	oidcProvider.provider = nil
+	t.Cleanup(func() {
+		oidcProvider.provider = nil
+	})
+	return issuer
+}
+
+// Go through the whole login as a browser would, returning the response to the callback.
+func oidcLogIn(t *testing.T, issuer *mockIssuer, claims map[string]any) *httptest.ResponseRecorder {
+	t.Helper()
+	issuer.mutex.Lock()
+	issuer.claims = claims
+	issuer.mutex.Unlock()
+
+	start := httptest.NewRecorder()
+	oidcLogInPage(start, httptest.NewRequest("GET", "http://broadcaster.test/login/oidc", nil))
+	if start.Code != http.StatusFound {
+		t.Fatalf("starting login: got status %d", start.Code)
+	}
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirects.Get(start.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callbackURL := resp.Header.Get("Location")
+	if !strings.HasPrefix(callbackURL, "http://broadcaster.test/login/oidc/callback?") {
+		t.Fatalf("provider redirected to %q", callbackURL)
+	}
+
+	callback := httptest.NewRequest("GET", callbackURL, nil)
+	for _, c := range start.Result().Cookies() {
+		callback.AddCookie(c)
+	}
+	finish := httptest.NewRecorder()
+	oidcCallbackPage(finish, callback)
+	return finish
+}
+
+func sessionUser(t *testing.T, resp *httptest.ResponseRecorder) User {
+	t.Helper()
+	for _, c := range resp.Result().Cookies() {
+		if c.Name == "broadcast_session" && c.Value != "" {
+			user, err := users.GetUserForSession(c.Value, "192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return user
+		}
+	}
+	t.Fatal("no session cookie was set")
+	return User{}
+}
+
+func TestOidcLoginProvisionsUserWithMappedRoles(t *testing.T) {
+	issuer := setupOidcTest(t)
+
+	resp := oidcLogIn(t, issuer, map[string]any{
+		"sub":                "subject-1",
+		"preferred_username": "alice",
+		"groups":             []string{"/radio-ops", "unrelated"},
+	})
+	if resp.Code != http.StatusFound || resp.Header().Get("Location") != "/" {
+		t.Fatalf("got status %d to %q, want a redirect to /", resp.Code, resp.Header().Get("Location"))
+	}
+	user := sessionUser(t, resp)
+	if user.Username != "alice" || user.OidcSubject != "subject-1" {
+		t.Errorf("logged in as %q with subject %q", user.Username, user.OidcSubject)
+	}
+	if got := strings.Join(user.Roles, ","); got != "scheduler,operator" {
+		t.Errorf("provisioned with roles %q, want scheduler,operator", got)
+	}
+
+	// Roles follow the provider's groups on every login, and the same local user is used
+	resp = oidcLogIn(t, issuer, map[string]any{
+		"sub":                "subject-1",
+		"preferred_username": "alice",
+		"groups":             "broadcaster",
+	})
+	user = sessionUser(t, resp)
+	if got := strings.Join(user.Roles, ","); user.Username != "alice" || got != "admin" {
+		t.Errorf("second login was %q with roles %q, want alice with admin", user.Username, got)
+	}
+}
+
+func TestOidcLoginRefusesUnmappedUser(t *testing.T) {
+	issuer := setupOidcTest(t)
+
+	resp := oidcLogIn(t, issuer, map[string]any{
+		"sub":                "subject-2",
+		"preferred_username": "mallory",
+		"groups":             []string{"unrelated"},
+	})
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", resp.Code, http.StatusUnauthorized)
+	}
+	if _, err := db.GetUser("mallory"); err == nil {
+		t.Error("a user was created for somebody with no mapped roles")
+	}
+
+	// Unless there are roles for everybody else
+	config.OIDC.DefaultRoles = []string{RoleViewer}
+	resp = oidcLogIn(t, issuer, map[string]any{
+		"sub":                "subject-2",
+		"preferred_username": "mallory",
+		"groups":             []string{"unrelated"},
+	})
+	if got := strings.Join(sessionUser(t, resp).Roles, ","); got != "viewer" {
+		t.Errorf("provisioned with roles %q, want viewer", got)
+	}
+}
+
+func TestOidcLoginDoesNotTakeOverLocalAccount(t *testing.T) {
+	issuer := setupOidcTest(t)
+	if err := users.CreateUser("bob", "local password", []string{RoleViewer}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := oidcLogIn(t, issuer, map[string]any{
+		"sub":                "subject-3",
+		"preferred_username": "bob",
+		"groups":             []string{"broadcaster"},
+	})
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", resp.Code, http.StatusUnauthorized)
+	}
+	bob, err := db.GetUser("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.OidcSubject != "" || strings.Join(bob.Roles, ",") != "viewer" {
+		t.Errorf("local account was changed to subject %q with roles %v", bob.OidcSubject, bob.Roles)
+	}
+}
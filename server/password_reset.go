@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// How long an emailed reset link works for
+const passwordResetLifetime = time.Hour
+
+// A user can't be sent another reset link until this long after the last one, so the form can't be used to flood their inbox
+const passwordResetInterval = 5 * time.Minute
+
+var ErrPasswordResetUsed = errors.New("password reset has already been used")
+
+func resetLifetimeText() string {
+	return strconv.Itoa(int(passwordResetLifetime.Minutes())) + " minutes"
+}
+
+type ForgotPasswordData struct {
+	Message string
+}
+
+// Ask for a reset link to be emailed. The response is the same whether or not the account exists.
+func forgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	if !config.SMTP.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+	var data ForgotPasswordData
+	if r.Method == "POST" {
+		r.ParseForm()
+		account := strings.TrimSpace(r.Form.Get("account"))
+		if account != "" {
+			// Failures are only logged, as telling the user would reveal whether the account exists
+			accounts, err := usersForReset(account)
+			if err != nil {
+				log.Println("Couldn't look up account for password reset:", err)
+			}
+			for _, user := range accounts {
+				sendPasswordReset(r, user)
+			}
+			data.Message = "If that account has an email address, a link to reset the password has been sent to it. The link works for " + resetLifetimeText() + "."
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderHeader(w, "", User{})
+	tmpl := template.Must(template.ParseFS(content, "templates/forgot_password.html"))
+	tmpl.Execute(w, data)
+	renderFooter(w)
+}
+
+// Users can give either their username or their email address.
+func usersForReset(account string) ([]User, error) {
+	if strings.Contains(account, "@") {
+		return db.GetUsersByEmail(account)
+	}
+	user, err := db.GetUser(account)
+	if err != nil || user.Email == "" {
+		return []User{}, nil
+	}
+	return []User{user}, nil
+}
+
+func sendPasswordReset(r *http.Request, user User) {
+	now := time.Now()
+	last, err := db.GetLastPasswordReset(user.Username)
+	if err != nil {
+		log.Println("Couldn't check previous password resets for", user.Username, err)
+		return
+	}
+	if now.Sub(last) < passwordResetInterval {
+		log.Println("Not sending another password reset to", user.Username, "so soon")
+		return
+	}
+	token := generateSession()
+	err = db.InsertPasswordReset(PasswordReset{
+		Username: user.Username,
+		Created:  now,
+		Expiry:   now.Add(passwordResetLifetime),
+	}, hashApiToken(token))
+	if err != nil {
+		log.Println("Couldn't create password reset for", user.Username, err)
+		return
+	}
+	body := "Somebody, hopefully you, asked to reset the password for the broadcaster account " + user.Username + ".\n\n" +
+		"To choose a new password, open this link within " + resetLifetimeText() + ":\n\n" +
+		config.BaseURL + "/reset-password?token=" + token + "\n\n" +
+		"If you didn't ask for this you can ignore this email. Your password has not been changed.\n"
+	log.Println("Sending password reset to", user.Username, "requested from", clientIP(r))
+	// Sent in the background so that how long the page takes doesn't reveal whether the account exists
+	go func() {
+		if err := sendMail(user.Email, "Reset your broadcaster password", body); err != nil {
+			log.Println("Couldn't send password reset email to", user.Username, err)
+		}
+	}()
+}
+
+type ResetPasswordData struct {
+	Token    string
+	Message  string
+	ShowForm bool
+}
+
+// Where the emailed link leads. Choosing a new password uses up the link and logs the user out everywhere.
+func resetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	if !config.SMTP.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+	// Keep the token out of the Referer header of anything the page loads
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	r.ParseForm()
+	data := ResetPasswordData{
+		Token:    r.Form.Get("token"),
+		ShowForm: true,
+	}
+	reset, err := db.GetPasswordReset(hashApiToken(data.Token))
+	if err != nil || time.Now().After(reset.Expiry) {
+		data.Message = "This password reset link is invalid or has expired. You can ask for a new one."
+		data.ShowForm = false
+	} else if r.Method == "POST" {
+		newPassword := r.Form.Get("newPassword")
+		if newPassword == "" {
+			data.Message = "Password cannot be empty"
+		} else if newPassword != r.Form.Get("confirmPassword") {
+			data.Message = "The passwords did not match"
+		} else if err := resetPassword(r, reset, newPassword); errors.Is(err, ErrPasswordResetUsed) {
+			data.Message = "This password reset link is invalid or has expired. You can ask for a new one."
+			data.ShowForm = false
+		} else if err != nil {
+			log.Println("Couldn't reset password for", reset.Username, err)
+			data.Message = "Your password could not be changed. Please try again."
+		} else {
+			data.Message = "Your password has been changed. You can now log in with it."
+			data.ShowForm = false
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderHeader(w, "", User{})
+	tmpl := template.Must(template.ParseFS(content, "templates/reset_password.html"))
+	tmpl.Execute(w, data)
+	renderFooter(w)
+}
+
+func resetPassword(r *http.Request, reset PasswordReset, newPassword string) error {
+	user, err := db.GetUser(reset.Username)
+	if err != nil {
+		return err
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	ok, err := db.UsePasswordReset(reset, string(hashed))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrPasswordResetUsed
+	}
+	if err := users.Unlock(user.Username); err != nil {
+		log.Println("Couldn't unlock", user.Username, "after password reset", err)
+	}
+	loginLimiter.RecordSuccess(user.Username)
+	log.Println("Password reset by email for", user.Username, "from", clientIP(r))
+	recordAudit(r, user, AuditPasswordReset, user.Username, "")
+	return nil
+}
+
+// Users set their own email address from the change password page. Their password is needed so that
+// somebody using a browser they left logged in can't take over the account by changing the address.
+func changeEmailPage(w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/change-password", http.StatusFound)
+		return
+	}
+	r.ParseForm()
+	data := ChangePasswordPageData{ShowForm: true}
+	email := strings.TrimSpace(r.Form.Get("email"))
+	if err := validateEmail(email); err != nil {
+		data.EmailMessage = "Failed to change email address: " + err.Error()
+	} else if _, err := users.Authenticate(user.Username, r.Form.Get("password")); err != nil {
+		data.EmailMessage = "Failed to change email address: password is incorrect"
+	} else if err := db.SetUserEmail(user.Username, email); err != nil {
+		log.Println("Couldn't change email address for", user.Username, err)
+		data.EmailMessage = "Failed to change email address"
+	} else {
+		recordAudit(r, user, AuditEmailChange, user.Username, changeSummary(user.Email, email))
+		user.Email = email
+		data.EmailMessage = "Successfully changed email address"
+	}
+	renderChangePasswordPage(w, user, data)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Just enough of an SMTP server to accept mail from net/smtp, which skips STARTTLS and AUTH
+// when the server doesn't offer them. Each message received is sent on the returned channel.
+func startSMTPSink(t *testing.T) (int, chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go receiveMail(conn, messages)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, messages
+}
+
+func receiveMail(conn net.Conn, messages chan string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) {
+		conn.Write([]byte(s + "\r\n"))
+	}
+	reply("220 localhost test mail sink")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			messages <- msg.String()
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func setupPasswordResetTest(t *testing.T) chan string {
+	setupTestServer(t)
+	port, messages := startSMTPSink(t)
+	config.SMTP = NewSMTPConfig()
+	config.SMTP.Host = "127.0.0.1"
+	config.SMTP.Port = port
+	config.SMTP.From = "Broadcaster <broadcaster@example.com>"
+	config.BaseURL = "http://broadcaster.test"
+	if err := users.CreateUser("alice", "old password", []string{RoleViewer}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetUserEmail("alice", "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+var resetLinkPattern = regexp.MustCompile(`http://broadcaster\.test/reset-password\?token=([0-9a-f]+)`)
+
+// Ask for a reset link for an account and return the token from the email that arrives.
+func requestPasswordReset(t *testing.T, messages chan string, account string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	forgotPasswordPage(w, formRequest("/forgot-password", url.Values{"account": {account}}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("asking for a reset link: got status %d", w.Code)
+	}
+	select {
+	case msg := <-messages:
+		if !strings.Contains(msg, "To: alice@example.com\r\n") {
+			t.Errorf("reset email was not addressed to alice:\n%s", msg)
+		}
+		m := resetLinkPattern.FindStringSubmatch(msg)
+		if m == nil {
+			t.Fatalf("no reset link in email:\n%s", msg)
+		}
+		return m[1]
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reset email was sent")
+	}
+	return ""
+}
+
+func formRequest(path string, form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", "http://broadcaster.test"+path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func resetPasswordWith(token string, password string) string {
+	w := httptest.NewRecorder()
+	resetPasswordPage(w, formRequest("/reset-password", url.Values{
+		"token":           {token},
+		"newPassword":     {password},
+		"confirmPassword": {password},
+	}))
+	return w.Body.String()
+}
+
+func TestPasswordResetLinkWorksOnce(t *testing.T) {
+	messages := setupPasswordResetTest(t)
+	token := requestPasswordReset(t, messages, "alice@example.com")
+
+	w := httptest.NewRecorder()
+	resetPasswordPage(w, httptest.NewRequest("GET", "http://broadcaster.test/reset-password?token="+token, nil))
+	if !strings.Contains(w.Body.String(), `name="newPassword"`) {
+		t.Fatalf("reset link did not show the new password form:\n%s", w.Body.String())
+	}
+
+	if body := resetPasswordWith(token, "new password"); !strings.Contains(body, "Your password has been changed") {
+		t.Fatalf("password was not reset:\n%s", body)
+	}
+	if _, err := users.Authenticate("alice", "new password"); err != nil {
+		t.Errorf("can't log in with the new password: %v", err)
+	}
+
+	if body := resetPasswordWith(token, "another password"); !strings.Contains(body, "invalid or has expired") {
+		t.Errorf("reset link worked a second time:\n%s", body)
+	}
+	if _, err := users.Authenticate("alice", "new password"); err != nil {
+		t.Errorf("password changed after the link was used: %v", err)
+	}
+}
+
+func TestPasswordResetLinkExpires(t *testing.T) {
+	messages := setupPasswordResetTest(t)
+	token := requestPasswordReset(t, messages, "alice")
+
+	if _, err := db.(*sqlDatabase).exec("UPDATE password_resets SET expiry = ?", time.Now().Add(-time.Minute).UTC()); err != nil {
+		t.Fatal(err)
+	}
+	if body := resetPasswordWith(token, "new password"); !strings.Contains(body, "invalid or has expired") {
+		t.Errorf("expired reset link still worked:\n%s", body)
+	}
+	if _, err := users.Authenticate("alice", "old password"); err != nil {
+		t.Errorf("password changed by an expired link: %v", err)
+	}
+}
+
+func TestPasswordResetNotSentForUnknownAccount(t *testing.T) {
+	messages := setupPasswordResetTest(t)
+	w := httptest.NewRecorder()
+	forgotPasswordPage(w, formRequest("/forgot-password", url.Values{"account": {"nobody@example.com"}}))
+	if !strings.Contains(w.Body.String(), "If that account has an email address") {
+		t.Errorf("response differs for an unknown account:\n%s", w.Body.String())
+	}
+	select {
+	case msg := <-messages:
+		t.Errorf("email sent for an unknown account:\n%s", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"sync"
+	"time"
+
+	"code.octet-stream.net/broadcaster/internal/protocol"
 )
 
 type Playlists struct {
@@ -15,16 +20,19 @@ func InitPlaylists() {
 	playlists.changeWait = make(chan bool)
 }
 
-func (p *Playlists) GetPlaylists() []Playlist {
+func (p *Playlists) GetPlaylists() ([]Playlist, error) {
 	p.playlistMutex.Lock()
 	defer p.playlistMutex.Unlock()
 	return db.GetPlaylists()
 }
 
-func (p *Playlists) WatchForChanges() ([]Playlist, chan bool) {
+// The current playlists and a channel that is closed when they change. The channel is valid even if the
+// playlists couldn't be loaded, so callers can wait and try again.
+func (p *Playlists) WatchForChanges() ([]Playlist, chan bool, error) {
 	p.playlistMutex.Lock()
 	defer p.playlistMutex.Unlock()
-	return db.GetPlaylists(), p.changeWait
+	list, err := db.GetPlaylists()
+	return list, p.changeWait, err
 }
 
 func (p *Playlists) NotifyChanges() {
@@ -33,3 +41,33 @@ func (p *Playlists) NotifyChanges() {
 	close(p.changeWait)
 	p.changeWait = make(chan bool)
 }
+
+// Check a playlist before it is saved, returning a description of each problem found.
+func validatePlaylist(p Playlist, entries []PlaylistEntry) []string {
+	problems := make([]string, 0)
+	if strings.TrimSpace(p.Name) == "" {
+		problems = append(problems, "name must not be empty")
+	}
+	if _, err := protocol.ParseStartTime(p.StartTime, time.Local); err != nil {
+		problems = append(problems, fmt.Sprintf("start time %q must be in the format %s", p.StartTime, protocol.StartTimeFormatSecs))
+	}
+	for i, e := range entries {
+		if e.DelaySeconds < 0 {
+			problems = append(problems, fmt.Sprintf("entry %d: delay must not be negative", i+1))
+		}
+		if e.Filename == "" {
+			if e.DelaySeconds == 0 {
+				problems = append(problems, fmt.Sprintf("entry %d: must have a file or a delay", i+1))
+			}
+			continue
+		}
+		if e.FileVersion != 0 {
+			if _, err := db.GetFileVersion(e.Filename, e.FileVersion); err != nil {
+				problems = append(problems, fmt.Sprintf("entry %d: version %d of %s does not exist", i+1, e.FileVersion, e.Filename))
+			}
+		} else if !files.Exists(e.Filename) {
+			problems = append(problems, fmt.Sprintf("entry %d: file %s does not exist", i+1, e.Filename))
+		}
+	}
+	return problems
+}
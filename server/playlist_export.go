@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Version of the playlist document format. Increase this if a change would stop older servers importing it correctly.
+const playlistDocumentFormat = 1
+
+// Largest playlist document that can be imported
+const maxPlaylistDocumentSize = 4 << 20
+
+var ErrPlaylistDocument = errors.New("invalid playlist document")
+
+// Playlists in a form that can be kept in version control, copied to another server or written by a script.
+// Documents hold playlists by name rather than ID, and files by name and hash.
+type PlaylistDocument struct {
+	Format    int                `yaml:"Format"`
+	Playlists []PortablePlaylist `yaml:"Playlists"`
+}
+
+type PortablePlaylist struct {
+	Name      string                  `yaml:"Name"`
+	Enabled   *bool                   `yaml:"Enabled"` // missing means enabled, as with new playlists in the API
+	StartTime string                  `yaml:"StartTime"`
+	Entries   []PortablePlaylistEntry `yaml:"Entries"`
+}
+
+type PortablePlaylistEntry struct {
+	Filename     string `json:",omitempty" yaml:"Filename,omitempty"`
+	FileVersion  int    `json:",omitempty" yaml:"FileVersion,omitempty"` // 0 means follow the latest version
+	Hash         string `json:",omitempty" yaml:"Hash,omitempty"`        // SHA-256 of the file when exported
+	DelaySeconds int    `yaml:"DelaySeconds"`
+	IsRelative   bool   `yaml:"IsRelative"`
+}
+
+// The result of importing one playlist from a document.
+type PlaylistImportResult struct {
+	Id     int
+	Name   string
+	Action string // "created" or "updated"
+}
+
+func exportPlaylists(p []Playlist) (PlaylistDocument, error) {
+	hashes := make(map[string]string)
+	for _, f := range files.Files() {
+		hashes[f.Name] = f.Hash
+	}
+	doc := PlaylistDocument{Format: playlistDocumentFormat, Playlists: make([]PortablePlaylist, 0)}
+	for _, playlist := range p {
+		pp := PortablePlaylist{
+			Name:      playlist.Name,
+			Enabled:   &playlist.Enabled,
+			StartTime: playlist.StartTime,
+			Entries:   make([]PortablePlaylistEntry, 0),
+		}
+		entries, err := db.GetEntriesForPlaylist(playlist.Id)
+		if err != nil {
+			return doc, err
+		}
+		for _, e := range entries {
+			pe := PortablePlaylistEntry{
+				Filename:     e.Filename,
+				FileVersion:  e.FileVersion,
+				DelaySeconds: e.DelaySeconds,
+				IsRelative:   e.IsRelative,
+			}
+			if e.FileVersion != 0 {
+				if v, err := db.GetFileVersion(e.Filename, e.FileVersion); err == nil {
+					pe.Hash = v.Hash
+				}
+			} else {
+				pe.Hash = hashes[e.Filename]
+			}
+			pp.Entries = append(pp.Entries, pe)
+		}
+		doc.Playlists = append(doc.Playlists, pp)
+	}
+	return doc, nil
+}
+
+// Write a document as YAML if format is "yaml", otherwise as JSON.
+func encodePlaylistDocument(w io.Writer, doc PlaylistDocument, format string) error {
+	if format == "yaml" {
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// Read a document in either format. JSON is recognised by its opening brace.
+func decodePlaylistDocument(data []byte) (PlaylistDocument, error) {
+	var doc PlaylistDocument
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&doc)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&doc)
+	}
+	if err != nil {
+		return doc, fmt.Errorf("%w: %v", ErrPlaylistDocument, err)
+	}
+	if doc.Format != playlistDocumentFormat {
+		return doc, fmt.Errorf("%w: Format must be %d", ErrPlaylistDocument, playlistDocumentFormat)
+	}
+	return doc, nil
+}
+
+// Turn a document's entries into playlist entries, checking that each file is the one that was exported.
+// A pinned version is matched by its hash if it has one, since version numbers differ between servers.
+func resolvePortableEntries(pp PortablePlaylist) ([]PlaylistEntry, []string) {
+	entries := make([]PlaylistEntry, 0)
+	problems := make([]string, 0)
+	for i, pe := range pp.Entries {
+		e := PlaylistEntry{
+			Position:     i,
+			Filename:     pe.Filename,
+			FileVersion:  pe.FileVersion,
+			DelaySeconds: pe.DelaySeconds,
+			IsRelative:   pe.IsRelative,
+		}
+		if e.FileVersion == 0 {
+			e.Filename, e.FileVersion = resolveFileRef(e.Filename)
+		}
+		if pe.Hash != "" && e.Filename != "" {
+			if e.FileVersion != 0 {
+				e.FileVersion = matchVersionByHash(e.Filename, e.FileVersion, pe.Hash)
+			}
+			if hash, ok := entryFileHash(e); ok && hash != pe.Hash {
+				problems = append(problems, fmt.Sprintf("entry %d: %s on this server is different from the one in the document", i+1, e.FileRef()))
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, problems
+}
+
+func matchVersionByHash(filename string, version int, hash string) int {
+	versions, err := db.GetFileVersions(filename)
+	if err != nil {
+		return version
+	}
+	for _, v := range versions {
+		if v.Version == version && v.Hash == hash {
+			return version
+		}
+	}
+	for _, v := range versions {
+		if v.Hash == hash {
+			return v.Version
+		}
+	}
+	return version
+}
+
+// The hash of the file an entry plays, if it exists.
+func entryFileHash(e PlaylistEntry) (string, bool) {
+	if e.FileVersion != 0 {
+		v, err := db.GetFileVersion(e.Filename, e.FileVersion)
+		return v.Hash, err == nil
+	}
+	for _, f := range files.Files() {
+		if f.Name == e.Filename {
+			return f.Hash, true
+		}
+	}
+	return "", false
+}
+
+// Create or replace the playlists in a document. A playlist replaces the existing one with the same name,
+// if any. Nothing is changed unless every playlist in the document is valid, and all of them are saved
+// in one transaction.
+func importPlaylists(r *http.Request, user User, doc PlaylistDocument) ([]PlaylistImportResult, []string, error) {
+	current, err := db.GetPlaylists()
+	if err != nil {
+		return nil, nil, err
+	}
+	byName := make(map[string][]Playlist)
+	for _, p := range current {
+		byName[p.Name] = append(byName[p.Name], p)
+	}
+	seen := make(map[string]bool)
+	toSave := make([]PlaylistWithEntries, 0)
+	before := make([]string, 0)
+	problems := make([]string, 0)
+	for _, pp := range doc.Playlists {
+		p := Playlist{Enabled: pp.Enabled == nil || *pp.Enabled, Name: pp.Name, StartTime: pp.StartTime}
+		label := fmt.Sprintf("playlist %q: ", pp.Name)
+		if seen[pp.Name] {
+			problems = append(problems, label+"appears more than once in the document")
+			continue
+		}
+		seen[pp.Name] = true
+		existing := byName[pp.Name]
+		if len(existing) > 1 {
+			problems = append(problems, label+"more than one playlist on this server has that name")
+			continue
+		}
+		summary := ""
+		if len(existing) == 1 {
+			p.Id = existing[0].Id
+			summary, err = storedPlaylistSummary(p.Id)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		entries, entryProblems := resolvePortableEntries(pp)
+		for _, problem := range append(validatePlaylist(p, entries), entryProblems...) {
+			problems = append(problems, label+problem)
+		}
+		toSave = append(toSave, PlaylistWithEntries{Playlist: p, Entries: entries})
+		before = append(before, summary)
+	}
+	if len(doc.Playlists) == 0 {
+		problems = append(problems, "the document contains no playlists")
+	}
+	if len(problems) > 0 {
+		return nil, problems, nil
+	}
+
+	ids, err := db.SavePlaylists(toSave)
+	if err != nil {
+		return nil, nil, err
+	}
+	results := make([]PlaylistImportResult, 0)
+	for i, s := range toSave {
+		p := s.Playlist
+		action := AuditPlaylistCreate
+		result := "created"
+		if p.Id != 0 {
+			action = AuditPlaylistUpdate
+			result = "updated"
+		}
+		p.Id = ids[i]
+		recordAudit(r, user, action, p.Name, "imported; "+changeSummary(before[i], playlistSummary(p, s.Entries)))
+		results = append(results, PlaylistImportResult{Id: p.Id, Name: p.Name, Action: result})
+	}
+	playlists.NotifyChanges()
+	return results, nil, nil
+}
+
+// The playlists to export: the one given by id, or all of them if it is empty. An id that doesn't
+// exist gives sql.ErrNoRows.
+func playlistsToExport(id string) ([]Playlist, error) {
+	if id == "" {
+		return db.GetPlaylists()
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	p, err := db.GetPlaylist(n)
+	if err != nil {
+		return nil, err
+	}
+	return []Playlist{p}, nil
+}
+
+func exportFormat(r *http.Request) string {
+	if r.URL.Query().Get("format") == "yaml" {
+		return "yaml"
+	}
+	return "json"
+}
+
+// Download playlists from the web interface as /playlists/export?format=yaml&id=3
+func exportPlaylistsPage(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	p, err := playlistsToExport(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	var doc PlaylistDocument
+	if err == nil {
+		doc, err = exportPlaylists(p)
+	}
+	if err != nil {
+		databaseError(w, err)
+		return
+	}
+	format := exportFormat(r)
+	filename := "playlists"
+	if id != "" {
+		filename = "playlist-" + id
+	}
+	if format == "yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"."+format+"\"")
+	if err := encodePlaylistDocument(w, doc, format); err != nil {
+		log.Println("Couldn't export playlists:", err)
+	}
+}
+
+func importPlaylistsPage(w http.ResponseWriter, r *http.Request, user User) {
+	data := PlaylistsPageData{}
+	file, _, err := r.FormFile("document")
+	if err != nil {
+		data.ImportProblems = []string{"choose a JSON or YAML file to import"}
+	} else {
+		defer file.Close()
+		content, err := io.ReadAll(io.LimitReader(file, maxPlaylistDocumentSize))
+		if err != nil {
+			data.ImportProblems = []string{err.Error()}
+		} else if doc, err := decodePlaylistDocument(content); err != nil {
+			data.ImportProblems = []string{err.Error()}
+		} else {
+			results, problems, err := importPlaylists(r, user, doc)
+			if err != nil {
+				databaseError(w, err)
+				return
+			}
+			data.ImportProblems = problems
+			for _, result := range results {
+				data.ImportResults = append(data.ImportResults, result.Name+" ("+result.Action+")")
+			}
+		}
+	}
+	renderPlaylistsPage(w, user, data)
+}
+
+// API access to the same documents: GET /api/v1/playlists/export or /api/v1/playlists/<id>/export, and
+// POST /api/v1/playlists/import with a JSON or YAML body.
+func apiExportPlaylists(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+	p, err := playlistsToExport(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeApiError(w, http.StatusNotFound, "playlist not found")
+		return
+	}
+	var doc PlaylistDocument
+	if err == nil {
+		doc, err = exportPlaylists(p)
+	}
+	if err != nil {
+		writeApiDatabaseError(w, err)
+		return
+	}
+	format := exportFormat(r)
+	if format == "yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err := encodePlaylistDocument(w, doc, format); err != nil {
+		log.Println("Couldn't export playlists:", err)
+	}
+}
+
+func apiImportPlaylists(w http.ResponseWriter, r *http.Request, user User) {
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w, "POST")
+		return
+	}
+	// As with readJson, only content types a browser can't send cross-site without asking first
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" && mediaType != "application/yaml" && mediaType != "application/x-yaml" {
+		writeApiError(w, http.StatusUnsupportedMediaType, "request body must be application/json or application/yaml")
+		return
+	}
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPlaylistDocumentSize))
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	doc, err := decodePlaylistDocument(content)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	results, problems, err := importPlaylists(r, user, doc)
+	if err != nil {
+		writeApiDatabaseError(w, err)
+		return
+	}
+	if len(problems) > 0 {
+		writeApiProblems(w, problems)
+		return
+	}
+	writeJson(w, http.StatusOK, results)
+}
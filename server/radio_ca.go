@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// How long the certificate authority that issues radio certificates is valid for
+const radioCALifetime = 20 * 365 * 24 * time.Hour
+
+// How long a radio's client certificate is valid for. It can be reissued at any time from the radio's page.
+const radioCertificateLifetime = 2 * 365 * 24 * time.Hour
+
+// How long the certificate for the radio TLS listener is valid for
+const radioServerCertificateLifetime = 365 * 24 * time.Hour
+
+// The listener's certificate is replaced at startup if it expires sooner than this
+const radioServerCertificateRenewal = 30 * 24 * time.Hour
+
+var ErrCertificatesDisabled = errors.New("client certificates are not enabled; set RadioTLSPort and RadioCAPath in the server configuration")
+
+// A small certificate authority, kept in RadioCAPath, which issues each radio's client certificate and the
+// certificate for the TLS listener that radios connect to.
+type RadioCA struct {
+	dir     string
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+// Loaded at startup when RadioTLSPort is set, otherwise nil
+var radioCA *RadioCA
+
+// Load the certificate authority from RadioCAPath, creating it the first time.
+func InitRadioCA() error {
+	if config.RadioTLSPort == 0 {
+		return ErrCertificatesDisabled
+	}
+	if radioCA != nil {
+		return nil
+	}
+	ca, err := loadRadioCA(config.RadioCAPath)
+	if err != nil {
+		return err
+	}
+	radioCA = ca
+	return nil
+}
+
+func loadRadioCA(dir string) (*RadioCA, error) {
+	certPath := filepath.Join(dir, "ca.crt")
+	keyPath := filepath.Join(dir, "ca.key")
+	if _, err := os.Stat(certPath); errors.Is(err, os.ErrNotExist) {
+		log.Println("Creating certificate authority for radio certificates in", dir)
+		if err := createRadioCA(certPath, keyPath); err != nil {
+			return nil, err
+		}
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("certificate authority key in " + keyPath + " is not an ECDSA key")
+	}
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	return &RadioCA{dir: dir, cert: cert, key: key, certPEM: certPEM}, nil
+}
+
+func createRadioCA(certPath string, keyPath string) error {
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Broadcaster Radio CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(radioCALifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := encodeCertificateAndKey(der, key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, certPEM, 0644)
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeCertificateAndKey(der []byte, key *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+// Identifies a certificate in the database. Only the fingerprint of a radio's certificate is stored.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// Everything a radio needs to authenticate with a client certificate. The key is never stored by the server.
+type IssuedCertificate struct {
+	Certificate   string
+	Key           string
+	CACertificate string
+	Fingerprint   string
+	Expiry        time.Time
+}
+
+func (ca *RadioCA) issueClientCertificate(name string) (IssuedCertificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	expiry := time.Now().Add(radioCertificateLifetime)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     expiry,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	certPEM, keyPEM, err := encodeCertificateAndKey(der, key)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	return IssuedCertificate{
+		Certificate:   string(certPEM),
+		Key:           string(keyPEM),
+		CACertificate: string(ca.certPEM),
+		Fingerprint:   certFingerprint(der),
+		Expiry:        expiry,
+	}, nil
+}
+
+// The certificate for the radio TLS listener, issued by the CA so that radios can trust it with the same
+// CA file. It is reissued when it is close to expiring or RadioTLSHosts has changed.
+func (ca *RadioCA) serverCertificate(hosts []string) (tls.Certificate, error) {
+	certPath := filepath.Join(ca.dir, "server.crt")
+	keyPath := filepath.Join(ca.dir, "server.key")
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil && ca.serverCertificateCurrent(pair, hosts) {
+		return pair, nil
+	}
+	log.Println("Issuing certificate for radio TLS listener for", hosts)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(radioServerCertificateLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM, keyPEM, err := encodeCertificateAndKey(der, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func (ca *RadioCA) serverCertificateCurrent(pair tls.Certificate, hosts []string) bool {
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil || cert.CheckSignatureFrom(ca.cert) != nil {
+		return false
+	}
+	if time.Until(cert.NotAfter) < radioServerCertificateRenewal {
+		return false
+	}
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (ca *RadioCA) clientPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// The fingerprint of the client certificate a request was made with, if the certificate was issued by
+// the radio CA. Empty for requests without one, including every request to the main web listener.
+func verifiedCertFingerprint(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return certFingerprint(r.TLS.PeerCertificates[0].Raw)
+}
+
+// Serve the radio websocket and audio file downloads over TLS on RadioTLSPort. Radios may present a client
+// certificate here instead of sending a token. Token authentication works on this listener too.
+func serveRadioTLS(fileDownloads http.Handler) {
+	cert, err := radioCA.serverCertificate(config.RadioTLSHosts)
+	if err != nil {
+		log.Fatal("could not set up certificate for radio TLS listener: ", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/radio-ws", websocket.Handler(RadioSync))
+	mux.Handle("/file-downloads/", fileDownloads)
+	server := &http.Server{
+		Addr:      config.BindAddress + ":" + strconv.Itoa(config.RadioTLSPort),
+		Handler:   mux,
+		TLSConfig: radioCA.listenerTLSConfig(cert),
+	}
+	log.Println("Radio TLS listener on port", config.RadioTLSPort)
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+// Radios may connect with or without a client certificate, but any certificate given must be from the CA.
+func (ca *RadioCA) listenerTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.clientPool(),
+		MinVersion:   tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.octet-stream.net/broadcaster/internal/protocol"
+	"golang.org/x/net/websocket"
+)
+
+// Serve the radio websocket with the same TLS settings as the radio listener, using a new CA.
+func setupRadioTLSTest(t *testing.T) (*httptest.Server, Radio, string) {
+	setupTestServer(t)
+	config.RadioTLSPort = 55135
+	config.RadioCAPath = filepath.Join(t.TempDir(), "ca")
+	radioCA = nil
+	t.Cleanup(func() {
+		radioCA = nil
+	})
+	if err := InitRadioCA(); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := radioCA.serverCertificate([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(websocket.Handler(RadioSync))
+	server.TLS = radioCA.listenerTLSConfig(cert)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	radio, token, err := createRadio("R1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, radio, token
+}
+
+func clientCertificate(t *testing.T, issued IssuedCertificate) []tls.Certificate {
+	t.Helper()
+	pair, err := tls.X509KeyPair([]byte(issued.Certificate), []byte(issued.Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []tls.Certificate{pair}
+}
+
+// Connect to the radio websocket as a radio would and send its credentials.
+func dialRadioTLS(server *httptest.Server, certs []tls.Certificate, token string) (*websocket.Conn, error) {
+	addr := server.Listener.Addr().String()
+	wsConfig, err := websocket.NewConfig("wss://"+addr+"/radio-ws", "https://"+addr)
+	if err != nil {
+		return nil, err
+	}
+	wsConfig.TlsConfig = &tls.Config{
+		RootCAs:      radioCA.clientPool(),
+		Certificates: certs,
+	}
+	ws, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		return nil, err
+	}
+	auth, _ := json.Marshal(protocol.AuthenticateMessage{T: protocol.AuthenticateType, Token: token})
+	if _, err := ws.Write(auth); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// The server sends an authenticated radio its files and playlists straight away, and closes the
+// websocket of one it doesn't accept.
+func radioAccepted(t *testing.T, ws *websocket.Conn) bool {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16384)
+	n, err := ws.Read(buf)
+	if err != nil {
+		return false
+	}
+	msgType, _, err := protocol.ParseMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != protocol.FilesType && msgType != protocol.PlaylistsType {
+		t.Fatalf("unexpected %q message from server", msgType)
+	}
+	return true
+}
+
+func TestRadioWithClientCertificateIsAccepted(t *testing.T) {
+	server, radio, _ := setupRadioTLSTest(t)
+	issued, err := issueRadioCertificate(radio)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := dialRadioTLS(server, clientCertificate(t, issued), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if !radioAccepted(t, ws) {
+		t.Fatal("radio with a valid certificate was not accepted")
+	}
+
+	// Revoking the certificate disconnects the radio using it
+	if err := revokeRadioCertificate(radio); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16384)
+	for {
+		if _, err := ws.Read(buf); err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+				t.Fatal("radio was still connected after its certificate was revoked")
+			}
+			break
+		}
+	}
+}
+
+func TestRadioWithoutClientCertificate(t *testing.T) {
+	server, _, token := setupRadioTLSTest(t)
+
+	ws, err := dialRadioTLS(server, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if radioAccepted(t, ws) {
+		t.Error("radio with neither a certificate nor a token was accepted")
+	}
+
+	// A token still works on the TLS listener
+	ws, err = dialRadioTLS(server, nil, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if !radioAccepted(t, ws) {
+		t.Error("radio with a token but no certificate was not accepted")
+	}
+}
+
+func TestRadioWithRevokedClientCertificateIsRefused(t *testing.T) {
+	server, radio, token := setupRadioTLSTest(t)
+	issued, err := issueRadioCertificate(radio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := revokeRadioCertificate(radio); err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate is identified by its fingerprint, so a token sent alongside it doesn't help
+	ws, err := dialRadioTLS(server, clientCertificate(t, issued), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if radioAccepted(t, ws) {
+		t.Error("radio with a revoked certificate was accepted")
+	}
+
+	// Nor does reissuing: only the newest certificate works
+	if _, err := issueRadioCertificate(radio); err != nil {
+		t.Fatal(err)
+	}
+	ws, err = dialRadioTLS(server, clientCertificate(t, issued), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if radioAccepted(t, ws) {
+		t.Error("radio with a replaced certificate was accepted")
+	}
+}
+
+func TestRadioWithCertificateFromAnotherCAIsRefused(t *testing.T) {
+	server, radio, _ := setupRadioTLSTest(t)
+	other, err := loadRadioCA(filepath.Join(t.TempDir(), "other-ca"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := other.issueClientCertificate(radio.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := dialRadioTLS(server, clientCertificate(t, issued), "")
+	if err == nil {
+		defer ws.Close()
+		if radioAccepted(t, ws) {
+			t.Error("radio with a certificate from another CA was accepted")
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Issue a radio a new client certificate. Any certificate it had before stops working and the radio is
+// disconnected if it is using it.
+func issueRadioCertificate(radio Radio) (IssuedCertificate, error) {
+	if err := InitRadioCA(); err != nil {
+		return IssuedCertificate{}, err
+	}
+	issued, err := radioCA.issueClientCertificate(radio.Name)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	if err := db.SetRadioCertificate(radio.Id, issued.Fingerprint, issued.Expiry); err != nil {
+		return IssuedCertificate{}, err
+	}
+	commandRouter.DropInvalidConnection(radio.Id)
+	return issued, nil
+}
+
+// Stop a radio's client certificate from working and disconnect it if it is using it.
+func revokeRadioCertificate(radio Radio) error {
+	if err := db.SetRadioCertificate(radio.Id, "", time.Time{}); err != nil {
+		return err
+	}
+	commandRouter.DropInvalidConnection(radio.Id)
+	return nil
+}
+
+func certificateSummary(issued IssuedCertificate) string {
+	return "fingerprint " + issued.Fingerprint + ", expires " + issued.Expiry.Format("2006-01-02")
+}
+
+func issueRadioCertificatePage(w http.ResponseWriter, r *http.Request, user User) {
+	radio, ok := radioFromForm(w, r)
+	if !ok {
+		return
+	}
+	issued, err := issueRadioCertificate(radio)
+	if err != nil {
+		renderRadioPage(w, user, EditRadioPageData{Radio: radio, Error: "Could not issue certificate: " + err.Error()})
+		return
+	}
+	recordAudit(r, user, AuditRadioIssueCertificate, radio.Name, certificateSummary(issued))
+	radio.CertFingerprint = issued.Fingerprint
+	radio.CertExpiry = issued.Expiry
+	renderRadioPage(w, user, EditRadioPageData{Radio: radio, NewCertificate: &issued})
+}
+
+func revokeRadioCertificatePage(w http.ResponseWriter, r *http.Request, user User) {
+	radio, ok := radioFromForm(w, r)
+	if !ok {
+		return
+	}
+	if err := revokeRadioCertificate(radio); err != nil {
+		databaseError(w, err)
+		return
+	}
+	recordAudit(r, user, AuditRadioRevokeCertificate, radio.Name, "")
+	http.Redirect(w, r, "/radios/"+strconv.Itoa(radio.Id), http.StatusFound)
+}
+
+func apiIssueRadioCertificate(w http.ResponseWriter, r *http.Request, radio Radio, user User) {
+	issued, err := issueRadioCertificate(radio)
+	if err != nil {
+		if errors.Is(err, ErrCertificatesDisabled) {
+			writeApiError(w, http.StatusConflict, err.Error())
+		} else {
+			writeApiDatabaseError(w, err)
+		}
+		return
+	}
+	recordAudit(r, user, AuditRadioIssueCertificate, radio.Name, certificateSummary(issued))
+	writeJson(w, http.StatusCreated, issued)
+}
+
+func apiRevokeRadioCertificate(w http.ResponseWriter, r *http.Request, radio Radio, user User) {
+	if err := revokeRadioCertificate(radio); err != nil {
+		writeApiDatabaseError(w, err)
+		return
+	}
+	recordAudit(r, user, AuditRadioRevokeCertificate, radio.Name, "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"code.octet-stream.net/broadcaster/internal/protocol"
 	"encoding/json"
 	"golang.org/x/net/websocket"
 	"log"
+	"sort"
+	"time"
 )
 
+// Playlists which began this long ago may still be playing, so their files are still scheduled.
+const scheduleLookback = 6 * time.Hour
+
+// How often the scheduled files are recalculated as playlists move into the sync horizon.
+const scheduleRecheckInterval = 15 * time.Minute
+
 func RadioSync(ws *websocket.Conn) {
 	log.Println("Radio websocket connected, not yet authenticated")
 	buf := make([]byte, 16384)
@@ -14,6 +23,9 @@ func RadioSync(ws *websocket.Conn) {
 	badRead := false
 	isAuthenticated := false
 	var radio Radio
+	var lastSeen time.Time
+	done := make(chan bool)
+	defer close(done)
 	for {
 		// Ignore any massively oversize messages
 		n, err := ws.Read(buf)
@@ -40,86 +52,244 @@ func RadioSync(ws *websocket.Conn) {
 			return
 		}
 
+		if t == protocol.EnrollType && !isAuthenticated {
+			enrollRadio(ws, msg.(protocol.EnrollMessage))
+			return
+		}
+
 		if !isAuthenticated && t != protocol.AuthenticateType {
 			continue
 		}
 
 		if t == protocol.AuthenticateType && !isAuthenticated {
 			authMsg := msg.(protocol.AuthenticateMessage)
-			r, err := db.GetRadioByToken(authMsg.Token)
+			// A radio connecting with a client certificate is identified by it and any token is ignored
+			conn := radioConn{certFingerprint: verifiedCertFingerprint(ws.Request())}
+			var r Radio
+			var err error
+			if conn.certFingerprint != "" {
+				r, err = db.GetRadioByCertificate(conn.certFingerprint)
+			} else {
+				conn.tokenHash = hashApiToken(authMsg.Token)
+				r, err = db.GetRadioByTokenHash(conn.tokenHash)
+			}
 			if err != nil {
-				log.Println("Could not find radio for offered token", authMsg.Token)
+				log.Println("Rejecting radio websocket from", clientIP(ws.Request()), "with unknown credentials:", err)
+				return
 			}
 			radio = r
+			conn.radioId = r.Id
 			log.Println("Radio authenticated:", radio.Name)
 			isAuthenticated = true
-			commandRouter.AddWebsocket(r.Id, ws)
+			commandRouter.AddWebsocket(ws, conn)
 			defer commandRouter.RemoveWebsocket(ws)
+			recordRadioSeen(ws, radio.Id)
+			lastSeen = time.Now()
+			// In case the radio's credential is about to stop working, either a previous token or its certificate
+			var expiry time.Time
+			if conn.certFingerprint != "" {
+				expiry = radio.CertExpiry
+			} else if !radio.PreviousTokenExpiry.IsZero() {
+				expiry = radio.PreviousTokenExpiry
+			}
+			if !expiry.IsZero() {
+				timer := time.AfterFunc(time.Until(expiry), func() {
+					commandRouter.DropInvalidConnection(radio.Id)
+				})
+				defer timer.Stop()
+			}
 
-			go KeepFilesUpdated(ws)
-			go KeepPlaylistsUpdated(ws)
+			loc := time.Local
+			if authMsg.TimeZone != "" {
+				if l, err := time.LoadLocation(authMsg.TimeZone); err == nil {
+					loc = l
+				}
+			}
+			go KeepFilesUpdated(ws, loc, done)
+			go KeepPlaylistsUpdated(ws, done)
 		}
 
 		if t == protocol.StatusType {
 			statusMsg := msg.(protocol.StatusMessage)
 			log.Println("Received Status from", radio.Name, ":", statusMsg)
 			status.MergeStatus(radio.Id, statusMsg)
+			if time.Since(lastSeen) > radioLastSeenInterval {
+				recordRadioSeen(ws, radio.Id)
+				lastSeen = time.Now()
+			}
 		}
 	}
 }
 
-func sendPlaylistsMessageToRadio(ws *websocket.Conn, p []Playlist) error {
+func recordRadioSeen(ws *websocket.Conn, radioId int) {
+	if err := db.SetRadioLastSeen(radioId, time.Now(), clientIP(ws.Request())); err != nil {
+		log.Println("Couldn't record when radio", radioId, "was last seen:", err)
+	}
+}
+
+func playlistSpecForRadio(p Playlist) (protocol.PlaylistSpec, error) {
+	entries, err := db.GetEntriesForPlaylist(p.Id)
+	if err != nil {
+		return protocol.PlaylistSpec{}, err
+	}
+	entrySpecs := make([]protocol.EntrySpec, 0)
+	for _, e := range entries {
+		entrySpecs = append(entrySpecs, protocol.EntrySpec{Filename: e.FileRef(), DelaySeconds: e.DelaySeconds, IsRelative: e.IsRelative})
+	}
+	return protocol.PlaylistSpec{Id: p.Id, Name: p.Name, StartTime: p.StartTime, Entries: entrySpecs}, nil
+}
+
+func playlistsMessageForRadio(p []Playlist) ([]byte, error) {
 	playlistSpecs := make([]protocol.PlaylistSpec, 0)
 	for _, v := range p {
 		if v.Enabled {
-			entrySpecs := make([]protocol.EntrySpec, 0)
-			for _, e := range db.GetEntriesForPlaylist(v.Id) {
-				entrySpecs = append(entrySpecs, protocol.EntrySpec{Filename: e.Filename, DelaySeconds: e.DelaySeconds, IsRelative: e.IsRelative})
+			spec, err := playlistSpecForRadio(v)
+			if err != nil {
+				return nil, err
 			}
-			playlistSpecs = append(playlistSpecs, protocol.PlaylistSpec{Id: v.Id, Name: v.Name, StartTime: v.StartTime, Entries: entrySpecs})
+			playlistSpecs = append(playlistSpecs, spec)
 		}
 	}
 	playlists := protocol.PlaylistsMessage{
 		T:         protocol.PlaylistsType,
 		Playlists: playlistSpecs,
 	}
-	msg, _ := json.Marshal(playlists)
-	_, err := ws.Write(msg)
-	return err
+	return json.Marshal(playlists)
 }
 
-func KeepPlaylistsUpdated(ws *websocket.Conn) {
+// If the playlists can't be loaded the radio keeps the ones it was last sent, rather than being told there are none.
+func KeepPlaylistsUpdated(ws *websocket.Conn, done <-chan bool) {
 	for {
-		p, ch := playlists.WatchForChanges()
-		err := sendPlaylistsMessageToRadio(ws, p)
+		p, ch, err := playlists.WatchForChanges()
+		var msg []byte
+		if err == nil {
+			msg, err = playlistsMessageForRadio(p)
+		}
 		if err != nil {
+			log.Println("Couldn't load playlists to send to radio:", err)
+		} else if _, err := ws.Write(msg); err != nil {
 			return
 		}
-		<-ch
+		select {
+		case <-ch:
+		case <-done:
+			return
+		}
+	}
+}
+
+// Names of files used by enabled playlists that start within the sync horizon, in the order they will be played.
+func scheduledFiles(p []Playlist, loc *time.Location, now time.Time) ([]string, error) {
+	type upcoming struct {
+		start time.Time
+		id    int
+	}
+	horizonStart := now.Add(-scheduleLookback)
+	horizonEnd := now.Add(time.Duration(config.SyncHorizonHours) * time.Hour)
+	soon := make([]upcoming, 0)
+	for _, v := range p {
+		if !v.Enabled {
+			continue
+		}
+		t, err := protocol.ParseStartTime(v.StartTime, loc)
+		if err != nil || t.Before(horizonStart) || t.After(horizonEnd) {
+			continue
+		}
+		soon = append(soon, upcoming{start: t, id: v.Id})
+	}
+	sort.SliceStable(soon, func(i, j int) bool {
+		return soon[i].start.Before(soon[j].start)
+	})
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, u := range soon {
+		entries, err := db.GetEntriesForPlaylist(u.id)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Filename == "" || seen[e.FileRef()] {
+				continue
+			}
+			seen[e.FileRef()] = true
+			names = append(names, e.FileRef())
+		}
 	}
+	return names, nil
 }
 
-func sendFilesMessageToRadio(ws *websocket.Conn, f []FileSpec) error {
+// Earlier versions of files which are pinned by enabled playlists. Radios download these alongside the current files.
+func pinnedVersionSpecs(p []Playlist) ([]protocol.FileSpec, error) {
+	specs := make([]protocol.FileSpec, 0)
+	seen := make(map[string]bool)
+	for _, v := range p {
+		if !v.Enabled {
+			continue
+		}
+		entries, err := db.GetEntriesForPlaylist(v.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.FileVersion == 0 || seen[e.FileRef()] {
+				continue
+			}
+			seen[e.FileRef()] = true
+			version, err := db.GetFileVersion(e.Filename, e.FileVersion)
+			if err != nil {
+				continue
+			}
+			specs = append(specs, protocol.FileSpec{Name: version.Ref(), Hash: version.Hash, Size: version.Size})
+		}
+	}
+	return specs, nil
+}
+
+func filesMessageForRadio(f []FileSpec, p []Playlist, loc *time.Location) ([]byte, error) {
 	specs := make([]protocol.FileSpec, 0)
 	for _, v := range f {
-		specs = append(specs, protocol.FileSpec{Name: v.Name, Hash: v.Hash})
+		specs = append(specs, protocol.FileSpec{Name: v.Name, Hash: v.Hash, Size: v.Size})
+	}
+	pinned, err := pinnedVersionSpecs(p)
+	if err != nil {
+		return nil, err
+	}
+	scheduled, err := scheduledFiles(p, loc, time.Now())
+	if err != nil {
+		return nil, err
 	}
 	files := protocol.FilesMessage{
-		T:     protocol.FilesType,
-		Files: specs,
+		T:         protocol.FilesType,
+		Files:     append(specs, pinned...),
+		Scheduled: scheduled,
 	}
-	msg, _ := json.Marshal(files)
-	_, err := ws.Write(msg)
-	return err
+	return json.Marshal(files)
 }
 
-func KeepFilesUpdated(ws *websocket.Conn) {
+// Send the files message whenever the files change, or the playlists change such that the scheduled files might differ.
+func KeepFilesUpdated(ws *websocket.Conn, loc *time.Location, done <-chan bool) {
+	var lastSent []byte
 	for {
-		f, ch := files.WatchForChanges()
-		err := sendFilesMessageToRadio(ws, f)
+		f, filesCh := files.WatchForChanges()
+		p, playlistsCh, err := playlists.WatchForChanges()
+		var msg []byte
+		if err == nil {
+			msg, err = filesMessageForRadio(f, p, loc)
+		}
 		if err != nil {
+			log.Println("Couldn't load playlists to work out files for radio:", err)
+		} else if !bytes.Equal(msg, lastSent) {
+			if _, err := ws.Write(msg); err != nil {
+				return
+			}
+			lastSent = msg
+		}
+		select {
+		case <-filesCh:
+		case <-playlistsCh:
+		case <-time.After(scheduleRecheckInterval):
+		case <-done:
 			return
 		}
-		<-ch
 	}
 }
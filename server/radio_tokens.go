@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a radio's previous token keeps working after a rotation, unless a different overlap is chosen.
+// This gives time to update the radio's configuration file without it going offline.
+const defaultRadioTokenOverlap = 24 * time.Hour
+
+// Longest overlap that can be chosen when rotating a token
+const maxRadioTokenOverlap = 30 * 24 * time.Hour
+
+var ErrInvalidOverlap = fmt.Errorf("overlap must be between 0 and %d hours", int(maxRadioTokenOverlap.Hours()))
+
+// How often to record that a connected radio is still there, to avoid a database write on every status message
+const radioLastSeenInterval = time.Minute
+
+// Register a new radio and return it along with its token. This is the only time the token itself is available.
+func createRadio(name string) (Radio, string, error) {
+	radio := Radio{Name: strings.TrimSpace(name), HasToken: true}
+	if radio.Name == "" {
+		return Radio{}, "", errors.New("name cannot be empty")
+	}
+	token := generateSession()
+	id, err := db.CreateRadio(radio, hashApiToken(token))
+	if err != nil {
+		return Radio{}, "", err
+	}
+	radio.Id = id
+	return radio, token, nil
+}
+
+// Give a radio a new token, keeping the current one working for the overlap. With no overlap the current
+// token stops working straight away and the radio is disconnected if it is using it.
+func rotateRadioToken(radio Radio, overlap time.Duration) (string, time.Time, error) {
+	if overlap < 0 || overlap > maxRadioTokenOverlap {
+		return "", time.Time{}, ErrInvalidOverlap
+	}
+	var previousExpiry time.Time
+	if overlap > 0 && radio.HasToken {
+		previousExpiry = time.Now().Add(overlap)
+	}
+	token := generateSession()
+	if err := db.RotateRadioToken(radio.Id, hashApiToken(token), previousExpiry); err != nil {
+		return "", time.Time{}, err
+	}
+	commandRouter.DropInvalidConnection(radio.Id)
+	return token, previousExpiry, nil
+}
+
+// Stop a radio's tokens from working and disconnect it.
+func revokeRadioTokens(radio Radio) error {
+	if err := db.RevokeRadioTokens(radio.Id); err != nil {
+		return err
+	}
+	commandRouter.DropInvalidConnection(radio.Id)
+	return nil
+}
+
+func rotationSummary(previousExpiry time.Time) string {
+	if previousExpiry.IsZero() {
+		return "previous token stopped working immediately"
+	}
+	return "previous token works until " + previousExpiry.Format("2006-01-02 15:04")
+}
+
+// Parse an overlap given in whole hours, as offered by the radio page, the API and the command line.
+func parseRadioTokenOverlap(hours string) (time.Duration, error) {
+	if hours == "" {
+		return defaultRadioTokenOverlap, nil
+	}
+	n, err := strconv.Atoi(hours)
+	if err != nil {
+		return 0, errors.New("overlap must be a whole number of hours")
+	}
+	return time.Duration(n) * time.Hour, nil
+}
+
+// Load the radio named in a submitted form, writing an error response if there isn't one.
+func radioFromForm(w http.ResponseWriter, r *http.Request) (Radio, bool) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return Radio{}, false
+	}
+	id, err := strconv.Atoi(r.Form.Get("radioId"))
+	if err != nil {
+		http.NotFound(w, r)
+		return Radio{}, false
+	}
+	radio, err := db.GetRadio(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return Radio{}, false
+	}
+	return radio, true
+}
+
+func rotateRadioTokenPage(w http.ResponseWriter, r *http.Request, user User) {
+	radio, ok := radioFromForm(w, r)
+	if !ok {
+		return
+	}
+	overlap, err := parseRadioTokenOverlap(r.Form.Get("overlapHours"))
+	if err != nil {
+		renderRadioPage(w, user, EditRadioPageData{Radio: radio, Error: err.Error()})
+		return
+	}
+	token, previousExpiry, err := rotateRadioToken(radio, overlap)
+	if err != nil {
+		renderRadioPage(w, user, EditRadioPageData{Radio: radio, Error: "Could not rotate token: " + err.Error()})
+		return
+	}
+	recordAudit(r, user, AuditRadioRotateToken, radio.Name, rotationSummary(previousExpiry))
+	radio.HasToken = true
+	radio.PreviousTokenExpiry = previousExpiry
+	renderRadioPage(w, user, EditRadioPageData{Radio: radio, NewToken: token})
+}
+
+func revokeRadioTokensPage(w http.ResponseWriter, r *http.Request, user User) {
+	radio, ok := radioFromForm(w, r)
+	if !ok {
+		return
+	}
+	if err := revokeRadioTokens(radio); err != nil {
+		databaseError(w, err)
+		return
+	}
+	recordAudit(r, user, AuditRadioRevokeToken, radio.Name, "")
+	http.Redirect(w, r, "/radios/"+strconv.Itoa(radio.Id), http.StatusFound)
+}
+
+func apiRotateRadioToken(w http.ResponseWriter, r *http.Request, radio Radio, user User) {
+	var req ApiRotateRadioToken
+	if r.ContentLength != 0 && !readJson(w, r, &req) {
+		return
+	}
+	overlap := defaultRadioTokenOverlap
+	if req.OverlapHours != nil {
+		overlap = time.Duration(*req.OverlapHours) * time.Hour
+	}
+	token, previousExpiry, err := rotateRadioToken(radio, overlap)
+	if err != nil {
+		if errors.Is(err, ErrInvalidOverlap) {
+			writeApiProblems(w, []string{err.Error()})
+		} else {
+			writeApiDatabaseError(w, err)
+		}
+		return
+	}
+	recordAudit(r, user, AuditRadioRotateToken, radio.Name, rotationSummary(previousExpiry))
+	radio.HasToken = true
+	radio.PreviousTokenExpiry = previousExpiry
+	writeJson(w, http.StatusCreated, RadioWithToken{Radio: radio, Token: token})
+}
+
+func apiRevokeRadioTokens(w http.ResponseWriter, r *http.Request, radio Radio, user User) {
+	if err := revokeRadioTokens(radio); err != nil {
+		writeApiDatabaseError(w, err)
+		return
+	}
+	recordAudit(r, user, AuditRadioRevokeToken, radio.Name, "")
+	w.WriteHeader(http.StatusNoContent)
+}
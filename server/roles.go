@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// Can see the status of the radios but change nothing
+	RoleViewer = "viewer"
+	// Can create and edit playlists
+	RoleScheduler = "scheduler"
+	// Can upload and delete audio files
+	RoleProducer = "producer"
+	// Can stop transmissions in progress
+	RoleOperator = "operator"
+	// Can do everything, including managing radios and users
+	RoleAdmin = "admin"
+)
+
+type RoleInfo struct {
+	Name        string
+	Description string
+}
+
+// Every role, in the order they are shown in the web interface
+var allRoles = []RoleInfo{
+	{RoleViewer, "Viewer - can see the status of radios"},
+	{RoleScheduler, "Scheduler - can manage playlists"},
+	{RoleProducer, "Producer - can upload and delete audio files"},
+	{RoleOperator, "Control operator - can stop transmissions"},
+	{RoleAdmin, "Administrator - can do everything, including managing radios and users"},
+}
+
+// Something a user might be allowed to do. Every logged-in user can view the status page.
+type Permission string
+
+const (
+	PermManagePlaylists Permission = "manage-playlists"
+	PermManageFiles     Permission = "manage-files"
+	PermControlRadios   Permission = "control-radios"
+	PermManageRadios    Permission = "manage-radios"
+	PermManageUsers     Permission = "manage-users"
+	PermViewAuditLog    Permission = "view-audit-log"
+	PermManageBackups   Permission = "manage-backups"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleViewer:    {},
+	RoleScheduler: {PermManagePlaylists},
+	RoleProducer:  {PermManageFiles},
+	RoleOperator:  {PermControlRadios},
+	RoleAdmin:     {PermManagePlaylists, PermManageFiles, PermControlRadios, PermManageRadios, PermManageUsers, PermViewAuditLog, PermManageBackups},
+}
+
+var ErrInvalidRole = errors.New("invalid role")
+
+func (u User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (u User) IsAdmin() bool {
+	return u.HasRole(RoleAdmin)
+}
+
+func (u User) Can(p Permission) bool {
+	for _, r := range u.Roles {
+		for _, rp := range rolePermissions[r] {
+			if rp == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check a set of roles, putting them in a consistent order. A user with no other roles is a viewer.
+func normalizeRoles(roles []string) ([]string, error) {
+	for _, r := range roles {
+		if _, ok := rolePermissions[r]; !ok {
+			return nil, ErrInvalidRole
+		}
+	}
+	ret := make([]string, 0)
+	for _, info := range allRoles {
+		for _, r := range roles {
+			if r == info.Name && info.Name != RoleViewer {
+				ret = append(ret, r)
+				break
+			}
+		}
+	}
+	if len(ret) == 0 {
+		ret = append(ret, RoleViewer)
+	}
+	return ret, nil
+}
+
+func roleNames() []string {
+	ret := make([]string, 0)
+	for _, info := range allRoles {
+		ret = append(ret, info.Name)
+	}
+	return ret
+}
+
+func parseRoles(roles string) []string {
+	ret := make([]string, 0)
+	for _, r := range strings.Split(roles, ",") {
+		if r != "" {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
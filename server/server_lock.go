@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var ErrServerRunning = errors.New("broadcaster-server is running with this database; stop it first")
+
+// Take an exclusive lock next to the SQLite database for as long as the server runs, so that a restore
+// can't swap the database and audio files out from under it. Returns a function that releases the lock.
+func lockServer() (func(), error) {
+	if config.DatabaseType != "sqlite" {
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(config.SqliteDB+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrServerRunning
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+var ErrServerRunning = errors.New("broadcaster-server is running with this database; stop it first")
+
+// File locks aren't available here, so make sure the server is stopped before restoring.
+func lockServer() (func(), error) {
+	return func() {}, nil
+}
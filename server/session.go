@@ -5,9 +5,17 @@ import (
 	"encoding/hex"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// How often to record that a session is still in use, to avoid a database write on every request
+const sessionActivityInterval = time.Minute
+
+// Long user agent strings are cut down to this many bytes before being stored
+const maxUserAgentLength = 256
+
 func generateSession() string {
 	b := make([]byte, 32)
 	_, err := rand.Read(b)
@@ -17,29 +25,198 @@ func generateSession() string {
 	return hex.EncodeToString(b)
 }
 
+// Identify the user making a request, either from an API token or their session cookie.
 func currentUser(_ http.ResponseWriter, r *http.Request) (User, error) {
+	if token, ok := bearerToken(r); ok {
+		user, apiToken, err := users.GetUserForApiToken(token)
+		if err != nil {
+			return User{}, err
+		}
+		if !apiToken.Allows(r) {
+			return User{}, ErrApiTokenScope
+		}
+		return user, nil
+	}
 	cookie, e := r.Cookie("broadcast_session")
 	if e != nil {
 		return User{}, e
 	}
 
-	return users.GetUserForSession(cookie.Value)
+	return users.GetUserForSession(cookie.Value, clientIP(r))
+}
+
+// A session ends when it reaches its expiry, or if it hasn't been used for longer than the idle timeout.
+func (s Session) Expired() bool {
+	if time.Now().After(s.Expiry) {
+		return true
+	}
+	if config.SessionIdleHours > 0 {
+		lastActive := s.LastSeen
+		if lastActive.IsZero() {
+			lastActive = s.Created
+		}
+		return time.Since(lastActive) > time.Duration(config.SessionIdleHours)*time.Hour
+	}
+	return false
 }
 
-func createSessionCookie(w http.ResponseWriter, username string) {
+// Log the user in by storing a new session and sending its cookie.
+func createSessionCookie(w http.ResponseWriter, r *http.Request, username string) error {
 	sess := generateSession()
-	expiration := time.Now().Add(365 * 24 * time.Hour)
-	cookie := http.Cookie{Name: "broadcast_session", Value: sess, Expires: expiration, SameSite: http.SameSiteLaxMode}
-	db.InsertSession(username, sess, expiration)
+	now := time.Now()
+	expiration := now.AddDate(0, 0, config.SessionLifetimeDays)
+	cookie := http.Cookie{
+		Name:     "broadcast_session",
+		Value:    sess,
+		Path:     "/",
+		Expires:  expiration,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	err := db.InsertSession(Session{
+		Username:  username,
+		Created:   now,
+		Expiry:    expiration,
+		LastSeen:  now,
+		UserAgent: userAgent,
+		IP:        clientIP(r),
+	}, sess)
+	if err != nil {
+		return err
+	}
 	http.SetCookie(w, &cookie)
+	return nil
 }
 
 func clearSessionCookie(w http.ResponseWriter) {
 	c := &http.Cookie{
 		Name:     "broadcast_session",
 		Value:    "",
+		Path:     "/",
 		MaxAge:   -1,
 		HttpOnly: true,
 	}
 	http.SetCookie(w, c)
 }
+
+func sessionSection(w http.ResponseWriter, r *http.Request, user User) {
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	if path[2] == "revoke" && r.Method == "POST" {
+		revokeSession(w, r, user)
+	} else if path[2] == "revoke-others" && r.Method == "POST" {
+		revokeOtherSessions(w, r, user)
+	} else if path[2] == "" {
+		sessionsPage(w, user)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+type SessionsPageData struct {
+	Sessions    []Session
+	AllSessions []Session
+	CurrentId   int
+	IsAdmin     bool
+}
+
+func sessionsPage(w http.ResponseWriter, user User) {
+	data := SessionsPageData{
+		CurrentId: user.sessionId,
+		IsAdmin:   user.Can(PermManageUsers),
+	}
+	var err error
+	data.Sessions, err = db.GetSessions(user.Username)
+	if err != nil {
+		log.Println("Couldn't load sessions", err)
+	}
+	if data.IsAdmin {
+		data.AllSessions, err = db.GetSessions("")
+		if err != nil {
+			log.Println("Couldn't load sessions", err)
+		}
+	}
+	renderHeader(w, "sessions", user)
+	tmpl := parseTemplate(user, "templates/sessions.html")
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	renderFooter(w)
+}
+
+// Users can log out their own sessions, and admins can log out anybody's.
+func revokeSession(w http.ResponseWriter, r *http.Request, user User) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(r.Form.Get("sessionId"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	s, err := db.GetSession(id)
+	if err != nil || (s.Username != user.Username && !user.Can(PermManageUsers)) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := db.DeleteSession(id); err != nil {
+		log.Println("Couldn't revoke session", id, err)
+		http.Error(w, "Could not revoke session", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, AuditSessionRevoke, s.Username, changeSummary(s.UserAgent+" from "+s.IP, ""))
+	if id == user.sessionId {
+		clearSessionCookie(w)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/sessions/", http.StatusFound)
+}
+
+func revokeOtherSessions(w http.ResponseWriter, r *http.Request, user User) {
+	cookie, err := r.Cookie("broadcast_session")
+	if err != nil {
+		http.Error(w, "Not logged in with a session", http.StatusBadRequest)
+		return
+	}
+	if err := db.ClearOtherSessions(user.Username, cookie.Value); err != nil {
+		databaseError(w, err)
+		return
+	}
+	recordAudit(r, user, AuditSessionRevoke, user.Username, "all other sessions")
+	http.Redirect(w, r, "/sessions/", http.StatusFound)
+}
+
+// Log a user out everywhere, for example if their password may have been compromised.
+func revokeUserSessions(w http.ResponseWriter, r *http.Request, currentUser User) {
+	r.ParseForm()
+	id, err := strconv.Atoi(r.Form.Get("userId"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	user, err := db.GetUserById(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := db.DeleteSessions(user.Username); err != nil {
+		log.Println("Couldn't revoke sessions for", user.Username, err)
+		http.Error(w, "Could not revoke sessions", http.StatusInternalServerError)
+		return
+	}
+	log.Println("All sessions revoked for", user.Username)
+	recordAudit(r, currentUser, AuditUserLogOut, user.Username, "")
+	http.Redirect(w, r, "/users/"+strconv.Itoa(id), http.StatusFound)
+}
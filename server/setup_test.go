@@ -0,0 +1,27 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Point the server at a fresh SQLite database and audio directory that are removed when the test ends.
+func setupTestServer(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	config = NewServerConfig()
+	config.SqliteDB = filepath.Join(dir, "broadcaster.db")
+	config.AudioFilesPath = filepath.Join(dir, "audio")
+	InitDatabase()
+	t.Cleanup(func() {
+		db.CloseDatabase()
+	})
+	if err := db.MigrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	InitCommandRouter()
+	InitPlaylists()
+	InitAudioFiles(config.AudioFilesPath)
+	InitServerStatus()
+	InitEnrollments()
+}
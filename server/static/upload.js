@@ -3,7 +3,10 @@
   var fileInput = document.getElementById("file-input");
   var fileList = document.getElementById("file-list");
   var uploadBtn = document.getElementById("upload-btn");
+  var csrfToken = dropZone.dataset.csrfToken;
   var pendingFiles = [];
+  var anyFailed = false;
+  var finished = false;
 
   dropZone.addEventListener("dragover", function(e) {
     e.preventDefault();
@@ -83,6 +86,10 @@
   }
 
   uploadBtn.addEventListener("click", function() {
+    if (finished) {
+      window.location.reload();
+      return;
+    }
     if (pendingFiles.length === 0) return;
     uploadBtn.disabled = true;
     // Disable all remove buttons
@@ -95,47 +102,270 @@
 
   function uploadNext(index) {
     if (index >= pendingFiles.length) {
-      // All done — reload page to show updated file list
-      window.location.reload();
+      // All done — reload page to show updated file list, unless there are errors to read
+      if (!anyFailed) {
+        window.location.reload();
+      } else {
+        finished = true;
+        uploadBtn.value = "Reload";
+        uploadBtn.disabled = false;
+      }
       return;
     }
+    uploadFile(index, false);
+  }
 
+  // Files are sent in pieces so that a dropped connection only costs the current chunk
+  var chunkSize = 4 * 1024 * 1024;
+  var maxRetryDelay = 30000;
+
+  function uploadFile(index, overwrite) {
+    var file = pendingFiles[index];
     var statusCell = document.getElementById("status-" + index);
     var progressBar = document.getElementById("progress-" + index);
-    statusCell.textContent = "Uploading…";
 
-    var formData = new FormData();
-    formData.append("file", pendingFiles[index]);
+    function fail(message) {
+      progressBar.value = 0;
+      statusCell.textContent = "Error: " + message;
+      anyFailed = true;
+      uploadNext(index + 1);
+    }
+
+    function showProgress(sent) {
+      var pct = Math.floor((sent / file.size) * 100);
+      progressBar.value = pct;
+      statusCell.textContent = "Uploading… " + pct + "%";
+    }
 
-    var xhr = new XMLHttpRequest();
+    // Keep trying after a network failure, waiting longer each time
+    function retry(attempt, fn) {
+      var delay = Math.min(1000 * Math.pow(2, attempt), maxRetryDelay);
+      statusCell.textContent = "Connection lost, retrying…";
+      setTimeout(fn, delay);
+    }
 
-    xhr.upload.addEventListener("progress", function(e) {
-      if (e.lengthComputable) {
-        var pct = Math.round((e.loaded / e.total) * 100);
-        progressBar.value = pct;
-        statusCell.textContent = "Uploading… " + pct + "%";
+    function post(url, body, contentType, onLoad, onError) {
+      var xhr = new XMLHttpRequest();
+      xhr.addEventListener("load", function() { onLoad(xhr); });
+      xhr.addEventListener("error", onError);
+      xhr.open("POST", url);
+      xhr.setRequestHeader("X-CSRF-Token", csrfToken);
+      if (contentType) {
+        xhr.setRequestHeader("Content-Type", contentType);
       }
-    });
+      return xhr;
+    }
 
-    xhr.addEventListener("load", function() {
-      if (xhr.status >= 200 && xhr.status < 400) {
-        progressBar.value = 100;
-        statusCell.textContent = "Done";
-      } else {
-        statusCell.textContent = "Error";
+    function offsetFrom(xhr) {
+      try {
+        return JSON.parse(xhr.responseText).Offset;
+      } catch (e) {
+        return null;
       }
-      uploadNext(index + 1);
-    });
+    }
 
-    xhr.addEventListener("error", function() {
-      statusCell.textContent = "Error";
-      uploadNext(index + 1);
+    function init(hash, attempt) {
+      var body = "filename=" + encodeURIComponent(file.name) +
+        "&size=" + file.size +
+        "&hash=" + hash +
+        (overwrite ? "&overwrite=1" : "");
+      post("/files/upload-init", body, "application/x-www-form-urlencoded", function(xhr) {
+        if (xhr.status === 200) {
+          var reply = JSON.parse(xhr.responseText);
+          sendChunk(reply.Id, reply.Offset, 0);
+        } else if (xhr.status === 409 && !overwrite &&
+            window.confirm(file.name + " already exists. Replace it?")) {
+          overwrite = true;
+          init(hash, 0);
+        } else {
+          fail(xhr.responseText.trim());
+        }
+      }, function() {
+        retry(attempt, function() { init(hash, attempt + 1); });
+      }).send(body);
+    }
+
+    function sendChunk(id, offset, attempt) {
+      if (offset >= file.size) {
+        finalize(id, 0);
+        return;
+      }
+      showProgress(offset);
+      var chunk = file.slice(offset, Math.min(offset + chunkSize, file.size));
+      var xhr = post("/files/upload-chunk?id=" + encodeURIComponent(id) + "&offset=" + offset, null, "application/octet-stream", function(xhr) {
+        var serverOffset = offsetFrom(xhr);
+        if ((xhr.status === 200 || xhr.status === 409) && serverOffset !== null) {
+          // A conflict means the server has a different amount than we thought, so carry on from its offset
+          sendChunk(id, serverOffset, 0);
+        } else if (xhr.status >= 500) {
+          retry(attempt, function() { sendChunk(id, offset, attempt + 1); });
+        } else {
+          fail(xhr.responseText.trim());
+        }
+      }, function() {
+        retry(attempt, function() { resume(id, attempt + 1); });
+      });
+      xhr.upload.addEventListener("progress", function(e) {
+        if (e.lengthComputable) {
+          showProgress(offset + e.loaded);
+        }
+      });
+      xhr.send(chunk);
+    }
+
+    // After a dropped connection we don't know how much of the last chunk arrived, so ask the server
+    function resume(id, attempt) {
+      post("/files/upload-chunk?id=" + encodeURIComponent(id) + "&offset=-1", null, null, function(xhr) {
+        var serverOffset = offsetFrom(xhr);
+        if (serverOffset !== null) {
+          sendChunk(id, serverOffset, 0);
+        } else {
+          fail(xhr.responseText.trim());
+        }
+      }, function() {
+        retry(attempt, function() { resume(id, attempt + 1); });
+      }).send();
+    }
+
+    function finalize(id, attempt) {
+      statusCell.textContent = "Checking…";
+      post("/files/upload-finalize?id=" + encodeURIComponent(id), null, null, function(xhr) {
+        var serverOffset = offsetFrom(xhr);
+        if (xhr.status === 200) {
+          progressBar.value = 100;
+          statusCell.textContent = "Done";
+          uploadNext(index + 1);
+        } else if (xhr.status === 409 && serverOffset !== null) {
+          sendChunk(id, serverOffset, 0);
+        } else {
+          fail(xhr.responseText.trim());
+        }
+      }, function() {
+        retry(attempt, function() { finalize(id, attempt + 1); });
+      }).send();
+    }
+
+    statusCell.textContent = "Hashing…";
+    hashFile(file, function(pct) {
+      progressBar.value = pct;
+      statusCell.textContent = "Hashing… " + pct + "%";
+    }, function(hash) {
+      init(hash, 0);
+    }, function() {
+      fail("could not read file");
     });
+  }
+
+  // Compute the SHA-256 of a file a slice at a time so that large recordings don't need to fit in memory
+  function hashFile(file, onProgress, onDone, onError) {
+    var hasher = new Sha256();
+    var offset = 0;
+    var reader = new FileReader();
+    reader.onload = function() {
+      hasher.update(new Uint8Array(reader.result));
+      offset += reader.result.byteLength;
+      onProgress(Math.floor((offset / file.size) * 100));
+      readNext();
+    };
+    reader.onerror = onError;
+    function readNext() {
+      if (offset >= file.size) {
+        onDone(hasher.digest());
+        return;
+      }
+      reader.readAsArrayBuffer(file.slice(offset, offset + chunkSize));
+    }
+    readNext();
+  }
+
+  // Incremental SHA-256. Browsers only provide a one-shot digest, and only over HTTPS.
+  var K = [
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+  ];
 
-    xhr.open("POST", "/files/upload");
-    xhr.send(formData);
+  function Sha256() {
+    this.h = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+    this.block = new Uint8Array(64);
+    this.blockLen = 0;
+    this.total = 0;
+    this.w = new Int32Array(64);
   }
 
+  Sha256.prototype.update = function(data) {
+    var pos = 0;
+    this.total += data.length;
+    if (this.blockLen > 0) {
+      while (this.blockLen < 64 && pos < data.length) {
+        this.block[this.blockLen++] = data[pos++];
+      }
+      if (this.blockLen < 64) return;
+      this.compress(this.block, 0);
+      this.blockLen = 0;
+    }
+    while (pos + 64 <= data.length) {
+      this.compress(data, pos);
+      pos += 64;
+    }
+    while (pos < data.length) {
+      this.block[this.blockLen++] = data[pos++];
+    }
+  };
+
+  Sha256.prototype.compress = function(data, p) {
+    var w = this.w;
+    var i;
+    for (i = 0; i < 16; i++) {
+      w[i] = (data[p + i * 4] << 24) | (data[p + i * 4 + 1] << 16) | (data[p + i * 4 + 2] << 8) | data[p + i * 4 + 3];
+    }
+    for (i = 16; i < 64; i++) {
+      var x = w[i - 15], y = w[i - 2];
+      var s0 = ((x >>> 7) | (x << 25)) ^ ((x >>> 18) | (x << 14)) ^ (x >>> 3);
+      var s1 = ((y >>> 17) | (y << 15)) ^ ((y >>> 19) | (y << 13)) ^ (y >>> 10);
+      w[i] = (w[i - 16] + s0 + w[i - 7] + s1) | 0;
+    }
+    var h = this.h;
+    var a = h[0], b = h[1], c = h[2], d = h[3], e = h[4], f = h[5], g = h[6], hh = h[7];
+    for (i = 0; i < 64; i++) {
+      var S1 = ((e >>> 6) | (e << 26)) ^ ((e >>> 11) | (e << 21)) ^ ((e >>> 25) | (e << 7));
+      var ch = (e & f) ^ (~e & g);
+      var t1 = (hh + S1 + ch + K[i] + w[i]) | 0;
+      var S0 = ((a >>> 2) | (a << 30)) ^ ((a >>> 13) | (a << 19)) ^ ((a >>> 22) | (a << 10));
+      var maj = (a & b) ^ (a & c) ^ (b & c);
+      var t2 = (S0 + maj) | 0;
+      hh = g; g = f; f = e; e = (d + t1) | 0;
+      d = c; c = b; b = a; a = (t1 + t2) | 0;
+    }
+    h[0] = (h[0] + a) | 0; h[1] = (h[1] + b) | 0; h[2] = (h[2] + c) | 0; h[3] = (h[3] + d) | 0;
+    h[4] = (h[4] + e) | 0; h[5] = (h[5] + f) | 0; h[6] = (h[6] + g) | 0; h[7] = (h[7] + hh) | 0;
+  };
+
+  Sha256.prototype.digest = function() {
+    var bits = this.total * 8;
+    var padLen = this.blockLen < 56 ? 56 - this.blockLen : 120 - this.blockLen;
+    var pad = new Uint8Array(padLen + 8);
+    pad[0] = 0x80;
+    var hi = Math.floor(bits / 0x100000000), lo = bits >>> 0;
+    for (var i = 0; i < 4; i++) {
+      pad[padLen + i] = (hi >>> (24 - i * 8)) & 0xff;
+      pad[padLen + 4 + i] = (lo >>> (24 - i * 8)) & 0xff;
+    }
+    var total = this.total;
+    this.update(pad);
+    this.total = total;
+    var out = "";
+    for (var j = 0; j < 8; j++) {
+      out += ("00000000" + (this.h[j] >>> 0).toString(16)).slice(-8);
+    }
+    return out;
+  };
+
   function formatSize(bytes) {
     if (bytes < 1024) return bytes + " B";
     if (bytes < 1024 * 1024) return (bytes / 1024).toFixed(1) + " KB";
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often the certificate and key files are checked for changes, e.g. after a renewal
+const tlsReloadInterval = 30 * time.Second
+
+// Holds the certificate for the HTTPS listener and swaps in a new one when the files change or on SIGHUP.
+// Only new connections see the new certificate, so connected radios and browsers aren't disturbed.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	c.modified = c.filesModified()
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+func (c *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+// The most recent modification time of the certificate and key files, or zero if neither can be read.
+func (c *certReloader) filesModified() time.Time {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// Reload the certificate whenever the server gets SIGHUP or the files change. If the new files can't be
+// loaded, e.g. because only one of them has been replaced so far, the current certificate is kept.
+func (c *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(tlsReloadInterval)
+	for {
+		select {
+		case <-hup:
+			c.modified = c.filesModified()
+			log.Println("Reloading TLS certificate after SIGHUP")
+		case <-ticker.C:
+			modified := c.filesModified()
+			if modified.Equal(c.modified) {
+				continue
+			}
+			c.modified = modified
+			log.Println("Reloading TLS certificate as its files have changed")
+		}
+		if err := c.reload(); err != nil {
+			log.Println("Could not reload TLS certificate, still using the previous one:", err)
+		}
+	}
+}
+
+// Serve the web interface, API and radio websocket over HTTPS on Port, with a plain HTTP listener on
+// HTTPRedirectPort that sends browsers to it if one is configured.
+func serveTLS(addr string) error {
+	reloader, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	go reloader.watch()
+	if config.HTTPRedirectPort != 0 {
+		go serveHTTPRedirect()
+	}
+	server := &http.Server{
+		Addr: addr,
+		TLSConfig: &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
+	}
+	log.Println("Serving HTTPS on port", config.Port)
+	return server.ListenAndServeTLS("", "")
+}
+
+func serveHTTPRedirect() {
+	addr := config.BindAddress + ":" + strconv.Itoa(config.HTTPRedirectPort)
+	log.Println("Redirecting HTTP on port", config.HTTPRedirectPort, "to HTTPS")
+	log.Fatal(http.ListenAndServe(addr, http.HandlerFunc(redirectToHTTPS)))
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if config.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(config.Port))
+	} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+		host = "[" + host + "]"
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What a personal API token may be used for. A token never grants more than its owner is allowed to do.
+const (
+	// Only requests that don't change anything
+	ScopeRead = "read"
+	// Reading, plus managing playlists and files and stopping playback
+	ScopeSchedule = "schedule"
+	// Everything the owner can do
+	ScopeAdmin = "admin"
+)
+
+// Makes API tokens easy to recognise if they turn up somewhere they shouldn't
+const apiTokenPrefix = "bc_"
+
+// How often to record that a token has been used, to avoid a database write on every request
+const apiTokenUsageInterval = time.Minute
+
+var ErrApiTokenScope = errors.New("API token scope does not allow this request")
+
+// Paths that tokens with ScopeSchedule may make changes through
+var schedulePaths = []string{"/playlists/", "/files/", "/stop", "/api/v1/playlists", "/api/v1/files"}
+
+func isValidScope(scope string) bool {
+	return scope == ScopeRead || scope == ScopeSchedule || scope == ScopeAdmin
+}
+
+func hashApiToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func (t ApiToken) Expired() bool {
+	return !t.Expiry.IsZero() && time.Now().After(t.Expiry)
+}
+
+// Paths, and last path segments, of pages and API actions that change something. These are held to the
+// token's scope whatever the request method so that a read token can never be used to make changes.
+var mutatingPaths = []string{"/stop", "/logout", "/change-password", "/change-email"}
+var mutatingActions = map[string]bool{
+	"approve": true, "create": true, "delete": true, "disable": true, "enable": true, "import": true,
+	"issue-certificate": true, "recovery-codes": true, "reject": true, "reset-password": true,
+	"reset-two-factor": true, "restore": true, "revoke": true, "revoke-certificate": true,
+	"revoke-others": true, "revoke-sessions": true, "revoke-token": true, "rotate-token": true,
+	"stop": true, "submit": true, "unblock-address": true, "unlock": true, "upload": true,
+	"upload-chunk": true, "upload-finalize": true, "upload-init": true,
+}
+
+func isMutatingPath(path string) bool {
+	for _, p := range mutatingPaths {
+		if path == p {
+			return true
+		}
+	}
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	return mutatingActions[segments[len(segments)-1]]
+}
+
+func (t ApiToken) Allows(r *http.Request) bool {
+	if (r.Method == "GET" || r.Method == "HEAD") && !isMutatingPath(r.URL.Path) {
+		return true
+	}
+	switch t.Scope {
+	case ScopeAdmin:
+		return true
+	case ScopeSchedule:
+		if strings.HasPrefix(r.URL.Path, "/api/v1/radios/") && strings.HasSuffix(r.URL.Path, "/stop") {
+			return true
+		}
+		for _, p := range schedulePaths {
+			if strings.HasPrefix(r.URL.Path, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the token from an "Authorization: Bearer" header, if there is one.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	token, found := strings.CutPrefix(auth, "Bearer ")
+	return strings.TrimSpace(token), found
+}
+
+func (u *Users) GetUserForApiToken(token string) (User, ApiToken, error) {
+	apiToken, err := db.GetApiTokenByHash(hashApiToken(token))
+	if err != nil {
+		return User{}, ApiToken{}, errors.New("no matching API token")
+	}
+	if apiToken.Expired() {
+		return User{}, ApiToken{}, errors.New("API token has expired")
+	}
+	user, err := db.GetUser(apiToken.Username)
+	if err != nil {
+		return User{}, ApiToken{}, err
+	}
+	if time.Since(apiToken.LastUsed) > apiTokenUsageInterval {
+		if err := db.SetApiTokenLastUsed(apiToken.Id, time.Now()); err != nil {
+			log.Println("Couldn't record use of API token", apiToken.Id, err)
+		}
+	}
+	return user, apiToken, nil
+}
+
+// Create a token for the user and return it. This is the only time the token itself is available.
+func (u *Users) CreateApiToken(username string, name string, scope string, expiry time.Time) (string, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", errors.New("name cannot be empty")
+	}
+	if !isValidScope(scope) {
+		return "", errors.New("invalid scope")
+	}
+	token := apiTokenPrefix + generateSession()
+	err := db.CreateApiToken(ApiToken{
+		Username: username,
+		Name:     name,
+		Scope:    scope,
+		Created:  time.Now(),
+		Expiry:   expiry,
+	}, hashApiToken(token))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func tokenSection(w http.ResponseWriter, r *http.Request, user User) {
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	if path[2] == "create" && r.Method == "POST" {
+		createApiToken(w, r, user)
+	} else if path[2] == "revoke" && r.Method == "POST" {
+		revokeApiToken(w, r, user)
+	} else if path[2] == "" {
+		tokensPage(w, user, "", "")
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+type TokensPageData struct {
+	Tokens    []ApiToken
+	AllTokens []ApiToken
+	NewToken  string
+	Error     string
+	IsAdmin   bool
+}
+
+func tokensPage(w http.ResponseWriter, user User, newToken string, errText string) {
+	data := TokensPageData{
+		NewToken: newToken,
+		Error:    errText,
+		IsAdmin:  user.Can(PermManageUsers),
+	}
+	var err error
+	data.Tokens, err = db.GetApiTokens(user.Username)
+	if err != nil {
+		log.Println("Couldn't load API tokens", err)
+	}
+	if data.IsAdmin {
+		data.AllTokens, err = db.GetApiTokens("")
+		if err != nil {
+			log.Println("Couldn't load API tokens", err)
+		}
+	}
+	renderHeader(w, "tokens", user)
+	tmpl := parseTemplate(user, "templates/tokens.html")
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	renderFooter(w)
+}
+
+func createApiToken(w http.ResponseWriter, r *http.Request, user User) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	var expiry time.Time
+	if e := r.Form.Get("expiry"); e != "" {
+		day, err := time.ParseInLocation("2006-01-02", e, time.Local)
+		if err != nil {
+			tokensPage(w, user, "", "Invalid expiry date")
+			return
+		}
+		// The token remains valid for the whole of the chosen day
+		expiry = day.AddDate(0, 0, 1)
+	}
+	token, err := users.CreateApiToken(user.Username, r.Form.Get("name"), r.Form.Get("scope"), expiry)
+	if err != nil {
+		tokensPage(w, user, "", "Could not create token: "+err.Error())
+		return
+	}
+	details := "scope " + r.Form.Get("scope")
+	if !expiry.IsZero() {
+		details += ", expires " + expiry.Format("2006-01-02 15:04")
+	}
+	recordAudit(r, user, AuditTokenCreate, r.Form.Get("name"), details)
+	tokensPage(w, user, token, "")
+}
+
+// Users can revoke their own tokens, and admins can revoke anybody's.
+func revokeApiToken(w http.ResponseWriter, r *http.Request, user User) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(r.Form.Get("tokenId"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	t, err := db.GetApiToken(id)
+	if err != nil || (t.Username != user.Username && !user.Can(PermManageUsers)) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := db.DeleteApiToken(id); err != nil {
+		log.Println("Couldn't revoke API token", id, err)
+		http.Error(w, "Could not revoke token", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, AuditTokenRevoke, t.Name, "owned by "+t.Username)
+	http.Redirect(w, r, "/tokens/", http.StatusFound)
+}
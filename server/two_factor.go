@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const totpIssuer = "Broadcaster"
+
+const totpPeriod = 30
+
+const recoveryCodeCount = 10
+
+// How long a user has to enter their code after giving the right password
+const loginChallengeLifetime = 5 * time.Minute
+
+// Wrong codes allowed before the user has to enter their password again
+const maxLoginChallengeAttempts = 5
+
+const loginChallengeCookie = "broadcast_2fa"
+
+var ErrInvalidSecondFactor = errors.New("incorrect code")
+
+func (u User) HasTwoFactor() bool {
+	return u.TotpSecret != ""
+}
+
+// Whether the server's policy requires this user to use two-factor authentication.
+// Admins can do anything the listed roles can, so they are always included.
+// Users without a local password log in through single sign-on, where the provider handles this.
+func (u User) MustUseTwoFactor() bool {
+	if !u.HasPassword() {
+		return false
+	}
+	for _, role := range config.RequireTwoFactorRoles {
+		if u.HasRole(role) || (role != RoleViewer && u.IsAdmin()) {
+			return true
+		}
+	}
+	return false
+}
+
+// True if the user must set up two-factor authentication before they can do anything else.
+func needsTwoFactorEnrolment(user User, r *http.Request) bool {
+	if !user.MustUseTwoFactor() || user.HasTwoFactor() {
+		return false
+	}
+	return !strings.HasPrefix(r.URL.Path, "/two-factor/") && r.URL.Path != "/logout"
+}
+
+// Check a TOTP code, allowing for one time step of clock drift either way. Returns the step that matched.
+func validateTotp(secret string, code string, now time.Time) (int64, bool) {
+	opts := totp.ValidateOpts{
+		Period:    totpPeriod,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	for _, skew := range []int64{0, -1, 1} {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(secret, t, opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return t.Unix() / totpPeriod, true
+		}
+	}
+	return 0, false
+}
+
+// Recovery codes are compared case-insensitively and ignoring dashes and spaces.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashApiToken(code)
+}
+
+func generateRecoveryCodes() ([]string, []string) {
+	codes := make([]string, 0)
+	hashes := make([]string, 0)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatal(err)
+		}
+		code := hex.EncodeToString(b)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes
+}
+
+// Check the second factor offered by a user, which is either a code from their authenticator app
+// or one of their recovery codes. Either kind can only be used once.
+func (u *Users) CheckSecondFactor(user User, code string) error {
+	code = strings.TrimSpace(code)
+	if !user.HasTwoFactor() || code == "" {
+		return ErrInvalidSecondFactor
+	}
+	if len(code) == 6 {
+		step, ok := validateTotp(user.TotpSecret, code, time.Now())
+		if !ok {
+			return ErrInvalidSecondFactor
+		}
+		fresh, err := db.UseTotpStep(user.Username, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return errors.New("that code has already been used, wait for the next one")
+		}
+		return nil
+	}
+	used, err := db.UseRecoveryCode(user.Username, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidSecondFactor
+	}
+	log.Println("User", user.Username, "logged in with a recovery code")
+	return nil
+}
+
+// A user who has given the right password but not yet their second factor.
+type loginChallenge struct {
+	username string
+	expiry   time.Time
+	attempts int
+}
+
+var loginChallenges = struct {
+	sync.Mutex
+	m map[string]*loginChallenge
+}{m: make(map[string]*loginChallenge)}
+
+func startLoginChallenge(w http.ResponseWriter, r *http.Request, username string) {
+	token := generateSession()
+	loginChallenges.Lock()
+	defer loginChallenges.Unlock()
+	for k, c := range loginChallenges.m {
+		if time.Now().After(c.expiry) {
+			delete(loginChallenges.m, k)
+		}
+	}
+	loginChallenges.m[token] = &loginChallenge{username: username, expiry: time.Now().Add(loginChallengeLifetime)}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    token,
+		Path:     "/login",
+		MaxAge:   int(loginChallengeLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Find the login in progress for this request, if it hasn't expired or had too many wrong codes.
+func currentLoginChallenge(r *http.Request) (string, string, bool) {
+	cookie, err := r.Cookie(loginChallengeCookie)
+	if err != nil {
+		return "", "", false
+	}
+	loginChallenges.Lock()
+	defer loginChallenges.Unlock()
+	c, ok := loginChallenges.m[cookie.Value]
+	if !ok || time.Now().After(c.expiry) || c.attempts >= maxLoginChallengeAttempts {
+		delete(loginChallenges.m, cookie.Value)
+		return "", "", false
+	}
+	return cookie.Value, c.username, true
+}
+
+func recordLoginChallengeAttempt(token string) {
+	loginChallenges.Lock()
+	defer loginChallenges.Unlock()
+	if c, ok := loginChallenges.m[token]; ok {
+		c.attempts++
+	}
+}
+
+func endLoginChallenge(w http.ResponseWriter, token string) {
+	loginChallenges.Lock()
+	delete(loginChallenges.m, token)
+	loginChallenges.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: loginChallengeCookie, Value: "", Path: "/login", MaxAge: -1, HttpOnly: true})
+}
+
+// The second step of logging in for users with two-factor authentication.
+func twoFactorLogInPage(w http.ResponseWriter, r *http.Request) {
+	token, username, ok := currentLoginChallenge(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	errText := ""
+	status := http.StatusOK
+	if r.Method == "POST" {
+		r.ParseForm()
+		ip := clientIP(r)
+		user, err := db.GetUser(username)
+		if wait := loginLimiter.Wait(ip, username); wait > 0 {
+			seconds := int(wait.Seconds()) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			status = http.StatusTooManyRequests
+			errText = "Too many failed attempts. Try again in " + strconv.Itoa(seconds) + " seconds"
+		} else {
+			if err == nil && user.IsLocked() {
+				err = ErrAccountLocked
+			} else if err == nil {
+				err = users.CheckSecondFactor(user, r.Form.Get("code"))
+			}
+			if err == nil {
+				endLoginChallenge(w, token)
+				loginLimiter.RecordSuccess(user.Username)
+				users.RecordLoginSuccess(user)
+				if err := createSessionCookie(w, r, user.Username); err != nil {
+					databaseError(w, err)
+					return
+				}
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+			log.Println("Failed second factor for", username, "from", ip)
+			loginLimiter.RecordFailure(ip, username)
+			if user.Username != "" && err != ErrAccountLocked {
+				users.RecordLoginFailure(user)
+			}
+			recordLoginChallengeAttempt(token)
+			errText = "Could not log in: " + err.Error()
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	renderHeader(w, "", User{})
+	tmpl := template.Must(template.ParseFS(content, "templates/login_two_factor.html"))
+	tmpl.Execute(w, LogInData{Error: errText})
+	renderFooter(w)
+}
+
+func twoFactorSection(w http.ResponseWriter, r *http.Request, user User) {
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	if path[2] == "enable" && r.Method == "POST" {
+		enableTwoFactor(w, r, user)
+	} else if path[2] == "recovery-codes" && r.Method == "POST" {
+		regenerateRecoveryCodes(w, r, user)
+	} else if path[2] == "disable" && r.Method == "POST" {
+		disableTwoFactor(w, r, user)
+	} else if path[2] == "" {
+		twoFactorPage(w, user, TwoFactorPageData{})
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+type TwoFactorPageData struct {
+	Enabled       bool
+	Required      bool
+	Secret        string
+	QRCode        template.URL
+	RecoveryCodes []string
+	CodesLeft     int
+	Message       string
+}
+
+func twoFactorPage(w http.ResponseWriter, user User, data TwoFactorPageData) {
+	data.Enabled = user.HasTwoFactor()
+	data.Required = user.MustUseTwoFactor()
+	if data.Enabled {
+		var err error
+		data.CodesLeft, err = db.CountRecoveryCodes(user.Username)
+		if err != nil {
+			log.Println("Couldn't count recovery codes for", user.Username, err)
+		}
+	} else {
+		key, err := totp.Generate(totp.GenerateOpts{
+			Issuer:      totpIssuer,
+			AccountName: user.Username,
+			Period:      totpPeriod,
+		})
+		if err != nil {
+			log.Println("Couldn't generate TOTP key", err)
+			http.Error(w, "Could not set up two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		data.Secret = key.Secret()
+		img, err := key.Image(200, 200)
+		if err == nil {
+			var buf bytes.Buffer
+			if png.Encode(&buf, img) == nil {
+				data.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()))
+			}
+		}
+	}
+	renderHeader(w, "two-factor", user)
+	tmpl := parseTemplate(user, "templates/two_factor.html")
+	err := tmpl.Execute(w, data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	renderFooter(w)
+}
+
+// Turn on two-factor authentication once the user has shown that their app produces the right codes.
+func enableTwoFactor(w http.ResponseWriter, r *http.Request, user User) {
+	r.ParseForm()
+	if user.HasTwoFactor() {
+		http.Redirect(w, r, "/two-factor/", http.StatusFound)
+		return
+	}
+	secret := r.Form.Get("secret")
+	step, ok := validateTotp(secret, strings.TrimSpace(r.Form.Get("code")), time.Now())
+	if !ok {
+		twoFactorPage(w, user, TwoFactorPageData{Message: "That code was not correct. Scan the new QR code below and try again."})
+		return
+	}
+	codes, hashes := generateRecoveryCodes()
+	if err := db.EnableTwoFactor(user.Username, secret, hashes); err != nil {
+		log.Println("Couldn't enable two-factor authentication for", user.Username, err)
+		http.Error(w, "Could not enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	// The code that was just used mustn't work again for logging in
+	if _, err := db.UseTotpStep(user.Username, step); err != nil {
+		log.Println("Couldn't record use of two-factor code for", user.Username, err)
+	}
+	log.Println("User", user.Username, "enabled two-factor authentication")
+	recordAudit(r, user, AuditTwoFactorEnable, user.Username, "")
+	user.TotpSecret = secret
+	twoFactorPage(w, user, TwoFactorPageData{
+		Message:       "Two-factor authentication is now enabled.",
+		RecoveryCodes: codes,
+	})
+}
+
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, user User) {
+	r.ParseForm()
+	if err := users.CheckSecondFactor(user, r.Form.Get("code")); err != nil {
+		twoFactorPage(w, user, TwoFactorPageData{Message: "Could not create new recovery codes: " + err.Error()})
+		return
+	}
+	codes, hashes := generateRecoveryCodes()
+	if err := db.SetRecoveryCodes(user.Username, hashes); err != nil {
+		log.Println("Couldn't replace recovery codes for", user.Username, err)
+		http.Error(w, "Could not create new recovery codes", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, user, AuditRecoveryCodes, user.Username, "")
+	twoFactorPage(w, user, TwoFactorPageData{
+		Message:       "Your old recovery codes no longer work.",
+		RecoveryCodes: codes,
+	})
+}
+
+func disableTwoFactor(w http.ResponseWriter, r *http.Request, user User) {
+	r.ParseForm()
+	if user.MustUseTwoFactor() {
+		twoFactorPage(w, user, TwoFactorPageData{Message: "Your roles require two-factor authentication, so it can't be turned off."})
+		return
+	}
+	if err := users.CheckSecondFactor(user, r.Form.Get("code")); err != nil {
+		twoFactorPage(w, user, TwoFactorPageData{Message: "Could not turn off two-factor authentication: " + err.Error()})
+		return
+	}
+	if err := db.DisableTwoFactor(user.Username); err != nil {
+		log.Println("Couldn't disable two-factor authentication for", user.Username, err)
+		http.Error(w, "Could not turn off two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	log.Println("User", user.Username, "disabled two-factor authentication")
+	recordAudit(r, user, AuditTwoFactorDisable, user.Username, "")
+	user.TotpSecret = ""
+	twoFactorPage(w, user, TwoFactorPageData{Message: "Two-factor authentication is now turned off."})
+}
+
+// Lets an admin help a user who has lost both their authenticator and their recovery codes.
+func resetUserTwoFactor(w http.ResponseWriter, r *http.Request, currentUser User) {
+	r.ParseForm()
+	id, err := strconv.Atoi(r.Form.Get("userId"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	user, err := db.GetUserById(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := db.DisableTwoFactor(user.Username); err != nil {
+		log.Println("Couldn't reset two-factor authentication for", user.Username, err)
+		http.Error(w, "Could not reset two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	log.Println("Two-factor authentication reset for", user.Username)
+	recordAudit(r, currentUser, AuditUserResetTwoFA, user.Username, "")
+	http.Redirect(w, r, "/users/"+strconv.Itoa(id), http.StatusFound)
+}
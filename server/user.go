@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"log"
+	"time"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -9,34 +12,102 @@ var users Users
 
 type Users struct{}
 
-func (u *Users) GetUserForSession(token string) (User, error) {
-	username, err := db.GetUserNameForSession(token)
+var ErrAccountLocked = errors.New("account is temporarily locked after too many failed logins")
+
+func (u User) IsLocked() bool {
+	return time.Now().Before(u.LockedUntil)
+}
+
+// Find the user logged in with a session token, recording that the session is still in use from this address.
+func (u *Users) GetUserForSession(token string, ip string) (User, error) {
+	session, err := db.GetSessionByToken(token)
 	if err != nil {
 		return User{}, err
 	}
-	user, err := db.GetUser(username)
+	if session.Expired() {
+		if err := db.DeleteSession(session.Id); err != nil {
+			log.Println("Couldn't delete expired session", session.Id, err)
+		}
+		return User{}, errors.New("session has expired")
+	}
+	user, err := db.GetUser(session.Username)
 	if err != nil {
 		return User{}, err
 	}
+	if time.Since(session.LastSeen) > sessionActivityInterval || session.IP != ip {
+		if err := db.SetSessionLastSeen(session.Id, time.Now(), ip); err != nil {
+			log.Println("Couldn't record use of session", session.Id, err)
+		}
+	}
+	user.csrfToken = csrfTokenForSession(token)
+	user.sessionId = session.Id
 	return user, nil
 }
 
+// Users created by single sign-on have no local password until an admin sets one.
+func (u User) HasPassword() bool {
+	return u.PasswordHash != ""
+}
+
 func (u *Users) Authenticate(username string, clearPassword string) (User, error) {
 	user, err := db.GetUser(username)
 	if err != nil {
 		return User{}, err
 	}
+	// Don't even check the password while locked, so that guesses made during the lockout tell the attacker nothing
+	if user.IsLocked() {
+		return User{}, ErrAccountLocked
+	}
 	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(clearPassword))
 	if err != nil {
+		u.RecordLoginFailure(user)
 		return User{}, err
 	}
 	return user, nil
 }
 
-func (u *Users) CreateUser(username string, clearPassword string, isAdmin bool) error {
+// Count a failed password or second factor against the user, locking the account once there have been too many in a row.
+func (u *Users) RecordLoginFailure(user User) {
+	if config.LoginLockoutThreshold == 0 {
+		return
+	}
+	count := user.FailedLogins + 1
+	if !user.LockedUntil.IsZero() && !user.IsLocked() {
+		// The previous lockout has ended so the user starts afresh
+		count = 1
+	}
+	var lockedUntil time.Time
+	if count >= config.LoginLockoutThreshold {
+		lockedUntil = time.Now().Add(time.Duration(config.LoginLockoutMinutes) * time.Minute)
+		log.Println("Locking account", user.Username, "after", count, "failed logins")
+	}
+	if err := db.SetLoginFailures(user.Username, count, lockedUntil); err != nil {
+		log.Println("Couldn't record failed login for", user.Username, err)
+	}
+}
+
+// Called once the user has fully logged in, including any second factor.
+func (u *Users) RecordLoginSuccess(user User) {
+	if user.FailedLogins == 0 && user.LockedUntil.IsZero() {
+		return
+	}
+	if err := db.SetLoginFailures(user.Username, 0, time.Time{}); err != nil {
+		log.Println("Couldn't clear failed logins for", user.Username, err)
+	}
+}
+
+func (u *Users) Unlock(username string) error {
+	return db.SetLoginFailures(username, 0, time.Time{})
+}
+
+func (u *Users) CreateUser(username string, clearPassword string, roles []string) error {
 	if clearPassword == "" {
 		return errors.New("password cannot be empty")
 	}
+	roles, err := normalizeRoles(roles)
+	if err != nil {
+		return err
+	}
 	hashed, err := bcrypt.GenerateFromPassword([]byte(clearPassword), bcrypt.DefaultCost)
 	if err != nil {
 		return err
@@ -45,12 +116,12 @@ func (u *Users) CreateUser(username string, clearPassword string, isAdmin bool)
 		Id:           0,
 		Username:     username,
 		PasswordHash: string(hashed),
-		IsAdmin:      isAdmin,
+		Roles:        roles,
 	})
 }
 
-func (u *Users) DeleteUser(username string) {
-	db.DeleteUser(username)
+func (u *Users) DeleteUser(username string) error {
+	return db.DeleteUser(username)
 }
 
 func (u *Users) UpdatePassword(username string, oldClearPassword string, newClearPassword string) error {
@@ -69,14 +140,17 @@ func (u *Users) UpdatePassword(username string, oldClearPassword string, newClea
 	if err != nil {
 		return err
 	}
-	db.SetUserPassword(username, string(hashed))
-	return nil
+	return db.SetUserPassword(username, string(hashed))
 }
 
-func (u *Users) UpdateIsAdmin(username string, isAdmin bool) {
-	db.SetUserIsAdmin(username, isAdmin)
+func (u *Users) UpdateRoles(username string, roles []string) error {
+	roles, err := normalizeRoles(roles)
+	if err != nil {
+		return err
+	}
+	return db.SetUserRoles(username, roles)
 }
 
-func (u *Users) Users() []User {
+func (u *Users) Users() ([]User, error) {
 	return db.GetUsers()
 }
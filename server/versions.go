@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directory inside the audio files path where every uploaded version of each file is kept
+const versionsDir = ".versions"
+
+// Radios see a pinned version of a file under a distinct name, e.g. version 3 of "news.mp3" is "news@v3.mp3".
+func versionedName(filename string, version int) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "@v" + strconv.Itoa(version) + ext
+}
+
+func parseVersionedName(name string) (string, int, bool) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	i := strings.LastIndex(base, "@v")
+	if i <= 0 {
+		return "", 0, false
+	}
+	version, err := strconv.Atoi(base[i+2:])
+	if err != nil || version <= 0 {
+		return "", 0, false
+	}
+	return base[:i] + ext, version, true
+}
+
+// Work out which file and version a name refers to. A real file with exactly that name always wins.
+func resolveFileRef(ref string) (string, int) {
+	if _, err := os.Stat(filepath.Join(files.Path(), filepath.Base(ref))); err == nil {
+		return ref, 0
+	}
+	filename, version, ok := parseVersionedName(ref)
+	if !ok {
+		return ref, 0
+	}
+	if _, err := db.GetFileVersion(filename, version); err != nil {
+		return ref, 0
+	}
+	return filename, version
+}
+
+func (r *AudioFiles) VersionPath(filename string, version int) string {
+	return filepath.Join(r.path, versionsDir, filepath.Base(filename), "v"+strconv.Itoa(version))
+}
+
+// Add the current contents of a file to its version history.
+func (r *AudioFiles) recordVersion(filename string, uploadedBy string, restoredFrom int, uploaded time.Time) error {
+	versions, err := db.GetFileVersions(filename)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = versions[0].Version + 1
+	}
+	dest := r.VersionPath(filename, next)
+	if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+		return err
+	}
+	if err := linkOrCopy(filepath.Join(r.path, filename), dest); err != nil {
+		return err
+	}
+	hash, size, err := hashFile(dest)
+	if err != nil {
+		return err
+	}
+	return db.CreateFileVersion(FileVersion{
+		Filename:     filename,
+		Version:      next,
+		Hash:         hash,
+		Size:         size,
+		Uploaded:     uploaded,
+		UploadedBy:   uploadedBy,
+		RestoredFrom: restoredFrom,
+	})
+}
+
+// Files uploaded before version history existed get their current contents saved as version 1
+// before they are replaced, so that the replacement can be undone.
+func (r *AudioFiles) snapshotUnversioned(filename string) error {
+	info, err := os.Stat(filepath.Join(r.path, filename))
+	if err != nil {
+		return nil
+	}
+	versions, err := db.GetFileVersions(filename)
+	if err != nil || len(versions) > 0 {
+		return err
+	}
+	return r.recordVersion(filename, "", 0, info.ModTime())
+}
+
+// Make an earlier version of a file the current one. This is recorded as a new version.
+func (r *AudioFiles) Restore(filename string, version int, restoredBy string) error {
+	r.importMutex.Lock()
+	defer r.importMutex.Unlock()
+	if _, err := db.GetFileVersion(filename, version); err != nil {
+		return err
+	}
+	staged := filepath.Join(r.StagingPath(), "restore-"+generateSession()[:16])
+	if err := linkOrCopy(r.VersionPath(filename, version), staged); err != nil {
+		return err
+	}
+	if err := os.Rename(staged, filepath.Join(r.path, filename)); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	log.Println("Restored version", version, "of", filename)
+	err := r.recordVersion(filename, restoredBy, version, time.Now())
+	r.Refresh()
+	return err
+}
+
+// Versions share storage with the current file where possible. This is safe because files are only ever
+// replaced by renaming a new file over the top, never modified in place.
+func linkOrCopy(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
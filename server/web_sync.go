@@ -1,12 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"html/template"
 	"log"
+	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"code.octet-stream.net/broadcaster/internal/protocol"
 	"golang.org/x/net/websocket"
@@ -14,55 +16,54 @@ import (
 
 func WebSync(ws *websocket.Conn) {
 	log.Println("A web user connected with WebSocket")
-	buf := make([]byte, 16384)
+	// The session cookie is HttpOnly so the page can't send it to us; use the one that came with the handshake
+	cookie, err := ws.Request().Cookie("broadcast_session")
+	if err != nil {
+		log.Println("Web user connected without a session")
+		ws.Close()
+		return
+	}
+	user, err := users.GetUserForSession(cookie.Value, clientIP(ws.Request()))
+	if err != nil {
+		log.Println("Could not find user for websocket session", err)
+		ws.Close()
+		return
+	}
+	log.Println("User authenticated:", user.Username)
+
+	go KeepWebUpdated(ws, user)
+
+	// send initial playlists message
+	err = sendRadioStatusToWeb(ws, user)
+	if err != nil {
+		return
+	}
 
-	badRead := false
-	isAuthenticated := false
-	var user User
+	// Nothing is expected from the browser, but keep reading so we notice when it goes away
+	buf := make([]byte, 16384)
 	for {
-		// Ignore any massively oversize messages
-		n, err := ws.Read(buf)
-		if err != nil {
-			if user.Username != "" {
-				log.Println("Lost websocket to user:", user.Username)
-			} else {
-				log.Println("Lost unauthenticated website websocket")
-			}
+		if _, err := ws.Read(buf); err != nil {
+			log.Println("Lost websocket to user:", user.Username)
 			return
 		}
-		if n == len(buf) {
-			badRead = true
-			continue
-		} else if badRead {
-			badRead = false
-			continue
-		}
-
-		if !isAuthenticated {
-			token := string(buf[:n])
-			u, err := users.GetUserForSession(token)
-			if err != nil {
-				log.Println("Could not find user for offered token", token, err)
-				ws.Close()
-				return
-			}
-			user = u
-			log.Println("User authenticated:", user.Username)
-			isAuthenticated = true
-
-			go KeepWebUpdated(ws)
+	}
+}
 
-			// send initial playlists message
-			err = sendRadioStatusToWeb(ws)
-			if err != nil {
-				return
-			}
-		}
+// Only accept status websockets from our own pages, so another site can't use a visitor's session to open one.
+func checkWebSyncOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil || origin.Host != r.Host {
+		return errors.New("websocket origin does not match host")
 	}
+	return nil
 }
 
 type WebStatusData struct {
-	Radios []WebRadioStatus
+	Radios  []WebRadioStatus
+	CanStop bool
 }
 
 type WebRadioStatus struct {
@@ -77,9 +78,27 @@ type WebRadioStatus struct {
 	Id            string
 	DisableCancel bool
 	FilesInSync   bool
+	Warnings      []string
+}
+
+// Describe any upcoming playlists within the warning window that the radio doesn't expect to be able to play.
+func readinessWarnings(readiness []protocol.PlaylistReadiness) []string {
+	warnings := make([]string, 0)
+	window := time.Duration(config.ReadinessWarningHours) * time.Hour
+	for _, p := range readiness {
+		if p.Ready {
+			continue
+		}
+		start, err := time.Parse(time.RFC3339, p.StartTime)
+		if err != nil || time.Until(start) > window {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("Not ready for %s at %s: %s", p.Name, start.Format("Mon _2 Jan 15:04"), strings.Join(p.Problems, "; ")))
+	}
+	return warnings
 }
 
-func sendRadioStatusToWeb(ws *websocket.Conn) error {
+func sendRadioStatusToWeb(ws *websocket.Conn, user User) error {
 	webStatuses := make([]WebRadioStatus, 0)
 	radioStatuses := status.Statuses()
 	keys := make([]int, 0)
@@ -139,22 +158,24 @@ func sendRadioStatusToWeb(ws *websocket.Conn) error {
 			Id:            strconv.Itoa(i),
 			DisableCancel: disableCancel,
 			FilesInSync:   v.FilesInSync,
+			Warnings:      readinessWarnings(v.Readiness),
 		})
 	}
 	data := WebStatusData{
-		Radios: webStatuses,
+		Radios:  webStatuses,
+		CanStop: user.Can(PermControlRadios),
 	}
 	buf := new(strings.Builder)
-	tmpl := template.Must(template.ParseFS(content, "templates/radios.partial.html"))
+	tmpl := parseTemplate(user, "templates/radios.partial.html")
 	tmpl.Execute(buf, data)
 	_, err := ws.Write([]byte(buf.String()))
 	return err
 }
 
-func KeepWebUpdated(ws *websocket.Conn) {
+func KeepWebUpdated(ws *websocket.Conn, user User) {
 	for {
 		<-status.ChangeChannel()
-		err := sendRadioStatusToWeb(ws)
+		err := sendRadioStatusToWeb(ws, user)
 		if err != nil {
 			return
 		}